@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"time"
 
 	conf "git.privatehive.de/bjoern/noxon-server/internal"
 	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
@@ -18,6 +19,24 @@ func main() {
 
 	config := conf.ParseConfig()
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate-presets" {
+		if err := migratePresets(config); err != nil {
+			log.Fatalf("Could not migrate presets: %s", err.Error())
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		file, format := config.StationsConfig.File, config.StationsConfig.Format
+		if len(os.Args) > 2 {
+			file, format = os.Args[2], ""
+		}
+		if !validateStations(file, format) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	if config.DnsConfig.Enabled {
 		noxon.StartDnsServer(config.DnsConfig.HostIp, config.DnsConfig.NtpHost, config.DnsConfig.Domains)
 	}
@@ -25,12 +44,135 @@ func main() {
 	serverSettings := noxon.NewDefaultNoxonServerSettings()
 	serverSettings = serverSettings.WithWhitelist(config.Whitelist)
 	serverSettings = serverSettings.WithBlacklist(config.Blacklist)
-	serverSettings = serverSettings.WithStationsModel(noxon.NewJsonStationsModel())
 	serverSettings = serverSettings.WithPresetsModel(noxon.NewJsonPresetsModel())
 	serverSettings = serverSettings.WithLoginEndpoints(config.EndpointConfig.Login)
 	serverSettings = serverSettings.WithSearchEndpoints(config.EndpointConfig.Search)
 	serverSettings = serverSettings.WithGetPresetsEndpoints(config.EndpointConfig.GetPreset)
 	serverSettings = serverSettings.WithAddPresetsEndpoints(config.EndpointConfig.AddPreset)
+	serverSettings = serverSettings.WithHlsBandwidth(config.PlaybackConfig.HlsBandwidth)
+	serverSettings = serverSettings.WithDeviceRedirects(config.PlaybackConfig.DeviceRedirects)
+	if config.PlaybackConfig.Transcoding.Enabled {
+		serverSettings = serverSettings.WithTranscoder(noxon.NewFfmpegTranscoder(config.PlaybackConfig.Transcoding.Ffmpeg, config.PlaybackConfig.Transcoding.Bitrate))
+	}
+	serverSettings = serverSettings.WithTls(noxon.TlsOptions{
+		CaFile:             config.PlaybackConfig.Tls.CaFile,
+		InsecureSkipVerify: &config.PlaybackConfig.Tls.InsecureSkipVerify,
+		ServerName:         config.PlaybackConfig.Tls.ServerName,
+		ClientCertFile:     config.PlaybackConfig.Tls.ClientCertFile,
+		ClientKeyFile:      config.PlaybackConfig.Tls.ClientKeyFile,
+	})
+	serverSettings = serverSettings.WithTimeShift(noxon.TimeShiftSettings{
+		Enabled:  config.PlaybackConfig.TimeShift.Enabled,
+		Duration: time.Duration(config.PlaybackConfig.TimeShift.Minutes) * time.Minute,
+		Dir:      config.PlaybackConfig.TimeShift.Dir,
+	})
+	var history noxon.PlaybackHistory
+	if len(config.PlaybackConfig.HistoryFile) > 0 {
+		history = noxon.NewJsonPlaybackHistory(config.PlaybackConfig.HistoryFile, config.PlaybackConfig.HistorySize)
+	}
+	serverSettings = serverSettings.WithPlaybackManager(noxon.NewMemPlaybackManagerWithHistory(
+		time.Duration(config.PlaybackConfig.CacheMinutes)*time.Minute, config.PlaybackConfig.RecentSize, history))
+	serverSettings = serverSettings.WithReconnect(noxon.ReconnectSettings{
+		Enabled:   config.PlaybackConfig.Reconnect.Enabled,
+		Retries:   config.PlaybackConfig.Reconnect.Retries,
+		Reresolve: config.PlaybackConfig.Reconnect.Reresolve,
+		Silence:   config.PlaybackConfig.Reconnect.Silence,
+	})
+
+	schedule := []noxon.RecordingSchedule{}
+	for _, entry := range config.RecordingConfig.Schedule {
+		schedule = append(schedule, noxon.RecordingSchedule{
+			StationId: entry.StationId,
+			Cron:      entry.Cron,
+			Duration:  time.Duration(entry.Minutes) * time.Minute,
+		})
+	}
+	serverSettings = serverSettings.WithRecording(noxon.RecordingSettings{
+		Enabled:  config.RecordingConfig.Enabled,
+		Dir:      config.RecordingConfig.Dir,
+		Schedule: schedule,
+	})
+
+	var stationsModel noxon.StationsModel
+	if mounts := stationsMounts(config); len(mounts) == 1 && len(mounts[0].Id) == 0 && len(mounts[0].Name) == 0 {
+		stationsModel = mounts[0].Model
+	} else {
+		stationsModel = noxon.NewCompositeStationsModel(mounts...)
+	}
+	if config.StationsConfig.SmartFolders {
+		stationsModel = noxon.NewSmartFoldersStationsModel(stationsModel, serverSettings.PlaybackManager)
+	}
+	serverSettings = serverSettings.WithStationsModel(stationsModel)
 
 	noxon.NewNoxonServer(serverSettings).StartAndServe()
 }
+
+// The configured mounts. Without mounts the stations file is shown at the top level followed by the other sources
+func stationsMounts(config conf.Config) []noxon.Mount {
+
+	stations := config.StationsConfig
+	mounts := []noxon.Mount{}
+	if len(stations.Mounts) > 0 {
+		for _, mount := range stations.Mounts {
+			if model := mountModel(config, mount); model != nil {
+				mounts = append(mounts, noxon.Mount{Id: mount.Id, Name: mount.Name, Model: model})
+			}
+		}
+		return mounts
+	}
+
+	mounts = append(mounts, noxon.Mount{Model: mountModel(config, conf.MountConfig{Type: conf.MountTypeStations})})
+	for _, media := range stations.Media {
+		// the name is the id of the mount too
+		if model := mountModel(config, conf.MountConfig{Type: conf.MountTypeMedia, Name: media.Name, Dir: media.Dir}); model != nil {
+			mounts = append(mounts, noxon.Mount{Id: media.Name, Name: media.Name, Model: model})
+		}
+	}
+	if len(stations.Podcasts) > 0 {
+		mounts = append(mounts, noxon.Mount{Id: "podcasts", Model: mountModel(config, conf.MountConfig{Type: conf.MountTypePodcasts})})
+	}
+	if len(stations.RadioBrowser.Source) > 0 {
+		mounts = append(mounts, noxon.Mount{Id: "radio", Name: stations.RadioBrowser.Name, Model: mountModel(config, conf.MountConfig{Type: conf.MountTypeRadioBrowser})})
+	}
+	if stations.Recordings && config.RecordingConfig.Enabled {
+		mounts = append(mounts, noxon.Mount{Id: "recordings", Name: "Recordings", Model: mountModel(config, conf.MountConfig{Type: conf.MountTypeRecordings})})
+	}
+	return mounts
+}
+
+func mountModel(config conf.Config, mount conf.MountConfig) noxon.StationsModel {
+
+	switch mount.Type {
+	case conf.MountTypeStations:
+		format := config.StationsConfig.Format
+		if len(format) == 0 {
+			format = noxon.DetectStationsFormat(config.StationsConfig.File)
+		}
+		return noxon.NewJsonModelFromFileWithFormat(config.StationsConfig.File, format, 2*time.Second)
+	case conf.MountTypeMedia:
+		if len(mount.Name) == 0 {
+			log.Errorf("Ignoring media dir '%s' without a name", mount.Dir)
+			return nil
+		}
+		return noxon.NewLocalMediaStationsModel(mount.Name, mount.Dir)
+	case conf.MountTypeRecordings:
+		name := mount.Name
+		if len(name) == 0 {
+			name = "Recordings"
+		}
+		return noxon.NewLocalMediaStationsModel(name, config.RecordingConfig.Dir)
+	case conf.MountTypePodcasts:
+		feeds := mount.Feeds
+		if len(feeds) == 0 {
+			feeds = config.StationsConfig.Podcasts
+		}
+		refreshInterval := time.Duration(config.StationsConfig.PodcastRefreshMinutes) * time.Minute
+		return noxon.NewPodcastStationsModel(feeds, refreshInterval)
+	case conf.MountTypeRadioBrowser:
+		radioBrowser := config.StationsConfig.RadioBrowser
+		refreshInterval := time.Duration(radioBrowser.RefreshHours) * time.Hour
+		return noxon.NewRadioBrowserStationsModel(radioBrowser.Name, radioBrowser.Source, radioBrowser.CacheFile, refreshInterval)
+	}
+	log.Errorf("Ignoring mount '%s' with unknown type '%s'", mount.Name, mount.Type)
+	return nil
+}
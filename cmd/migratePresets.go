@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	conf "git.privatehive.de/bjoern/noxon-server/internal"
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	log "github.com/sirupsen/logrus"
+)
+
+// Rewrites the station ids in presets.json from the positional ids of former versions to the stable ids of the
+// configured stations file. A backup is written to presets.json.bak
+func migratePresets(config conf.Config) error {
+
+	file, format := config.StationsConfig.File, config.StationsConfig.Format
+	if len(format) == 0 {
+		format = noxon.DetectStationsFormat(file)
+	}
+	var stations []byte
+	var err error
+	if format == noxon.StationsFormatJson {
+		stations, err = os.ReadFile(file)
+	} else {
+		stations, _, err = noxon.ImportStationsFile(file, format)
+	}
+	if err != nil {
+		return err
+	}
+	ids, err := noxon.MigratePositionalIds(stations)
+	if err != nil {
+		return err
+	}
+	// the ids of a stations mount with an id are prefixed with the id of the mount
+	for _, mount := range config.StationsConfig.Mounts {
+		if mount.Type == conf.MountTypeStations {
+			if len(mount.Id) > 0 {
+				for positionalId, id := range ids {
+					ids[positionalId] = mount.Id + "/" + id
+				}
+			}
+			break
+		}
+	}
+	data, err := os.ReadFile("presets.json")
+	if err != nil {
+		return err
+	}
+	presets := map[string]string{}
+	if err := json.Unmarshal(data, &presets); err != nil {
+		return err
+	}
+
+	// presets that already use a stable id are kept (the migration may run twice)
+	stableIds := map[string]bool{}
+	for _, id := range ids {
+		stableIds[id] = true
+	}
+	for presetKey, stationId := range presets {
+		if id, ok := ids[stationId]; ok && stableIds[stationId] && id != stationId {
+			// a short explicit id (like "3") might be a positional id as well - it is left alone
+			log.Warnf("Keeping preset '%s' - stationId '%s' is the id of a station but the positional id of '%s' as well. Change the preset by hand if needed", presetKey, stationId, id)
+		} else if stableIds[stationId] {
+			log.Infof("Keeping preset '%s' with stationId '%s'", presetKey, stationId)
+		} else if id, ok := ids[stationId]; ok {
+			log.Infof("Migrating preset '%s' from stationId '%s' to '%s'", presetKey, stationId, id)
+			presets[presetKey] = id
+		} else {
+			log.Warnf("Preset '%s' points to the unknown stationId '%s'", presetKey, stationId)
+		}
+	}
+
+	if err := os.WriteFile("presets.json.bak", data, 0644); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(presets); err != nil {
+		return err
+	}
+	return os.WriteFile("presets.json", data, 0644)
+}
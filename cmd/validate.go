@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+)
+
+// Prints the problems of the stations file. Returns false if the file can't be loaded
+func validateStations(file string, format string) bool {
+
+	if len(format) == 0 {
+		format = noxon.DetectStationsFormat(file)
+	}
+	imported := format != noxon.StationsFormatJson
+	var data []byte
+	var err error
+	if imported {
+		data, _, err = noxon.ImportStationsFile(file, format)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		fmt.Printf("%s: error: %s\n", file, err.Error())
+		return false
+	}
+	validationErrors := noxon.ValidateStations(data)
+	for _, err := range validationErrors {
+		if imported {
+			// the positions refer to the converted json
+			err.Line, err.Column = 0, 0
+		}
+		if err.Line > 0 {
+			fmt.Printf("%s:%s\n", file, err.Error())
+		} else {
+			fmt.Printf("%s: %s\n", file, err.Error())
+		}
+	}
+	if errs := validationErrors.Errors(); len(errs) > 0 {
+		fmt.Printf("%s is invalid: %d errors, %d warnings\n", file, len(errs), len(validationErrors)-len(errs))
+		return false
+	}
+	fmt.Printf("%s is valid: %d warnings\n", file, len(validationErrors))
+	return true
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -23,11 +24,106 @@ type EndpointsConfig struct {
 	AddPreset []string `json:"addPreset" toml:"addPreset"`
 }
 
+type TranscodingConfig struct {
+	Enabled bool   `json:"enabled" toml:"enabled"`
+	Ffmpeg  string `json:"ffmpeg" toml:"ffmpeg"`
+	Bitrate int    `json:"bitrate" toml:"bitrate"`
+}
+
+type ReconnectConfig struct {
+	Enabled   bool `json:"enabled" toml:"enabled"`
+	Retries   int  `json:"retries" toml:"retries"`
+	Reresolve bool `json:"reresolve" toml:"reresolve"`
+	Silence   bool `json:"silence" toml:"silence"`
+}
+
+type TlsConfig struct {
+	CaFile             string `json:"caFile" toml:"caFile"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify" toml:"insecureSkipVerify"`
+	ServerName         string `json:"serverName" toml:"serverName"`
+	ClientCertFile     string `json:"clientCertFile" toml:"clientCertFile"`
+	ClientKeyFile      string `json:"clientKeyFile" toml:"clientKeyFile"`
+}
+
+type TimeShiftConfig struct {
+	Enabled bool   `json:"enabled" toml:"enabled"`
+	Minutes int    `json:"minutes" toml:"minutes"`
+	Dir     string `json:"dir" toml:"dir"`
+}
+
+type PlaybackConfig struct {
+	HlsBandwidth    int               `json:"hlsBandwidth" toml:"hlsBandwidth"`
+	DeviceRedirects bool              `json:"deviceRedirects" toml:"deviceRedirects"`
+	Transcoding     TranscodingConfig `json:"transcoding" toml:"transcoding"`
+	Reconnect       ReconnectConfig   `json:"reconnect" toml:"reconnect"`
+	Tls             TlsConfig         `json:"tls" toml:"tls"`
+	TimeShift       TimeShiftConfig   `json:"timeShift" toml:"timeShift"`
+	HistoryFile     string            `json:"historyFile" toml:"historyFile"` // Not persisted if empty
+	HistorySize     int               `json:"historySize" toml:"historySize"` // Per device
+	RecentSize      int               `json:"recentSize" toml:"recentSize"`   // The latest playbacks of all devices
+	CacheMinutes    int               `json:"cacheMinutes" toml:"cacheMinutes"`
+}
+
+type RecordingScheduleConfig struct {
+	StationId string `json:"stationId" toml:"stationId"`
+	Cron      string `json:"cron" toml:"cron"`
+	Minutes   int    `json:"minutes" toml:"minutes"`
+}
+
+type RecordingConfig struct {
+	Enabled  bool                      `json:"enabled" toml:"enabled"`
+	Dir      string                    `json:"dir" toml:"dir"`
+	Schedule []RecordingScheduleConfig `json:"schedule" toml:"schedule"`
+}
+
+type MediaConfig struct {
+	Name string `json:"name" toml:"name"`
+	Dir  string `json:"dir" toml:"dir"`
+}
+
+type RadioBrowserConfig struct {
+	Name         string `json:"name" toml:"name"`
+	Source       string `json:"source" toml:"source"`
+	CacheFile    string `json:"cacheFile" toml:"cacheFile"`
+	RefreshHours int    `json:"refreshHours" toml:"refreshHours"`
+}
+
+const (
+	MountTypeStations     = "stations" // The stations.json file
+	MountTypeMedia        = "media"
+	MountTypeRecordings   = "recordings"
+	MountTypePodcasts     = "podcasts"
+	MountTypeRadioBrowser = "radioBrowser"
+)
+
+type MountConfig struct {
+	Id    string   `json:"id" toml:"id"`
+	Name  string   `json:"name" toml:"name"`
+	Type  string   `json:"type" toml:"type"`
+	Dir   string   `json:"dir" toml:"dir"`     // Only for media mounts
+	Feeds []string `json:"feeds" toml:"feeds"` // Only for podcast mounts (stations.podcasts if empty)
+}
+
+type StationsConfig struct {
+	File                  string             `json:"file" toml:"file"`
+	Format                string             `json:"format" toml:"format"` // By the extension of the file if empty
+	Media                 []MediaConfig      `json:"media" toml:"media"`
+	Recordings            bool               `json:"recordings" toml:"recordings"`
+	Podcasts              []string           `json:"podcasts" toml:"podcasts"`
+	PodcastRefreshMinutes int                `json:"podcastRefreshMinutes" toml:"podcastRefreshMinutes"`
+	RadioBrowser          RadioBrowserConfig `json:"radioBrowser" toml:"radioBrowser"`
+	Mounts                []MountConfig      `json:"mounts" toml:"mounts"`
+	SmartFolders          bool               `json:"smartFolders" toml:"smartFolders"`
+}
+
 type Config struct {
-	DnsConfig      DnsConfig       `json:"dns" toml:"dns"`
-	EndpointConfig EndpointsConfig `json:"endpoints" toml:"endpoints"`
-	Whitelist      []string        `json:"whitelist" toml:"whitelist"`
-	Blacklist      []string        `json:"blacklist" toml:"blacklist"`
+	DnsConfig       DnsConfig       `json:"dns" toml:"dns"`
+	EndpointConfig  EndpointsConfig `json:"endpoints" toml:"endpoints"`
+	PlaybackConfig  PlaybackConfig  `json:"playback" toml:"playback"`
+	RecordingConfig RecordingConfig `json:"recording" toml:"recording"`
+	StationsConfig  StationsConfig  `json:"stations" toml:"stations"`
+	Whitelist       []string        `json:"whitelist" toml:"whitelist"`
+	Blacklist       []string        `json:"blacklist" toml:"blacklist"`
 }
 
 func ParseConfig() Config {
@@ -45,6 +141,58 @@ func ParseConfig() Config {
 			GetPreset: []string{"/Favorites/GetPreset.aspx"},
 			AddPreset: []string{"/Favorites/AddPreset.aspx"},
 		},
+		PlaybackConfig: PlaybackConfig{
+			HlsBandwidth:    128000,
+			DeviceRedirects: false,
+			Transcoding: TranscodingConfig{
+				Enabled: false,
+				Ffmpeg:  "ffmpeg",
+				Bitrate: 128000,
+			},
+			Reconnect: ReconnectConfig{
+				Enabled:   false,
+				Retries:   5,
+				Reresolve: true,
+				Silence:   true,
+			},
+			Tls: TlsConfig{
+				CaFile:             "",
+				InsecureSkipVerify: false,
+				ServerName:         "",
+				ClientCertFile:     "",
+				ClientKeyFile:      "",
+			},
+			TimeShift: TimeShiftConfig{
+				Enabled: false,
+				Minutes: 30,
+				Dir:     "",
+			},
+			HistoryFile:  "history.json",
+			HistorySize:  500,
+			RecentSize:   100,
+			CacheMinutes: 60,
+		},
+		RecordingConfig: RecordingConfig{
+			Enabled:  false,
+			Dir:      "recordings",
+			Schedule: []RecordingScheduleConfig{},
+		},
+		StationsConfig: StationsConfig{
+			File:                  "stations.json",
+			Format:                "",
+			Media:                 []MediaConfig{},
+			Recordings:            false,
+			Podcasts:              []string{},
+			PodcastRefreshMinutes: 60,
+			RadioBrowser: RadioBrowserConfig{
+				Name:         "Radio Browser",
+				Source:       "",
+				CacheFile:    "radio-browser.json",
+				RefreshHours: 24,
+			},
+			Mounts:       []MountConfig{},
+			SmartFolders: true,
+		},
 		Whitelist: []string{"*"},
 		Blacklist: []string{},
 	}
@@ -131,5 +279,178 @@ func ParseConfig() Config {
 		config.DnsConfig.NtpHost = os.Getenv("DNS_NTP_HOST")
 	}
 
+	if len(os.Getenv("PLAYBACK_HLS_BANDWIDTH")) > 0 {
+		if bandwidth, err := strconv.Atoi(os.Getenv("PLAYBACK_HLS_BANDWIDTH")); err != nil {
+			log.Warnf("Invalid PLAYBACK_HLS_BANDWIDTH: %s", err.Error())
+		} else {
+			config.PlaybackConfig.HlsBandwidth = bandwidth
+		}
+	}
+
+	if len(os.Getenv("PLAYBACK_DEVICE_REDIRECTS")) > 0 && strings.ToLower(os.Getenv("PLAYBACK_DEVICE_REDIRECTS")) != "false" {
+		config.PlaybackConfig.DeviceRedirects = true
+	}
+
+	if len(os.Getenv("PLAYBACK_TRANSCODING_ENABLED")) > 0 && strings.ToLower(os.Getenv("PLAYBACK_TRANSCODING_ENABLED")) != "false" {
+		config.PlaybackConfig.Transcoding.Enabled = true
+	}
+
+	if len(os.Getenv("PLAYBACK_TRANSCODING_FFMPEG")) > 0 {
+		config.PlaybackConfig.Transcoding.Ffmpeg = os.Getenv("PLAYBACK_TRANSCODING_FFMPEG")
+	}
+
+	if len(os.Getenv("PLAYBACK_TRANSCODING_BITRATE")) > 0 {
+		if bitrate, err := strconv.Atoi(os.Getenv("PLAYBACK_TRANSCODING_BITRATE")); err != nil {
+			log.Warnf("Invalid PLAYBACK_TRANSCODING_BITRATE: %s", err.Error())
+		} else {
+			config.PlaybackConfig.Transcoding.Bitrate = bitrate
+		}
+	}
+
+	if len(os.Getenv("PLAYBACK_RECONNECT_ENABLED")) > 0 && strings.ToLower(os.Getenv("PLAYBACK_RECONNECT_ENABLED")) != "false" {
+		config.PlaybackConfig.Reconnect.Enabled = true
+	}
+
+	if len(os.Getenv("PLAYBACK_RECONNECT_RETRIES")) > 0 {
+		if retries, err := strconv.Atoi(os.Getenv("PLAYBACK_RECONNECT_RETRIES")); err != nil {
+			log.Warnf("Invalid PLAYBACK_RECONNECT_RETRIES: %s", err.Error())
+		} else {
+			config.PlaybackConfig.Reconnect.Retries = retries
+		}
+	}
+
+	if len(os.Getenv("PLAYBACK_RECONNECT_RERESOLVE")) > 0 {
+		config.PlaybackConfig.Reconnect.Reresolve = strings.ToLower(os.Getenv("PLAYBACK_RECONNECT_RERESOLVE")) != "false"
+	}
+
+	if len(os.Getenv("PLAYBACK_RECONNECT_SILENCE")) > 0 {
+		config.PlaybackConfig.Reconnect.Silence = strings.ToLower(os.Getenv("PLAYBACK_RECONNECT_SILENCE")) != "false"
+	}
+
+	if len(os.Getenv("PLAYBACK_TLS_CA_FILE")) > 0 {
+		config.PlaybackConfig.Tls.CaFile = os.Getenv("PLAYBACK_TLS_CA_FILE")
+	}
+
+	if len(os.Getenv("PLAYBACK_TLS_INSECURE_SKIP_VERIFY")) > 0 && strings.ToLower(os.Getenv("PLAYBACK_TLS_INSECURE_SKIP_VERIFY")) != "false" {
+		config.PlaybackConfig.Tls.InsecureSkipVerify = true
+	}
+
+	if len(os.Getenv("PLAYBACK_TLS_SERVER_NAME")) > 0 {
+		config.PlaybackConfig.Tls.ServerName = os.Getenv("PLAYBACK_TLS_SERVER_NAME")
+	}
+
+	if len(os.Getenv("PLAYBACK_TLS_CLIENT_CERT_FILE")) > 0 {
+		config.PlaybackConfig.Tls.ClientCertFile = os.Getenv("PLAYBACK_TLS_CLIENT_CERT_FILE")
+	}
+
+	if len(os.Getenv("PLAYBACK_TLS_CLIENT_KEY_FILE")) > 0 {
+		config.PlaybackConfig.Tls.ClientKeyFile = os.Getenv("PLAYBACK_TLS_CLIENT_KEY_FILE")
+	}
+
+	if len(os.Getenv("PLAYBACK_TIMESHIFT_ENABLED")) > 0 && strings.ToLower(os.Getenv("PLAYBACK_TIMESHIFT_ENABLED")) != "false" {
+		config.PlaybackConfig.TimeShift.Enabled = true
+	}
+
+	if len(os.Getenv("PLAYBACK_TIMESHIFT_MINUTES")) > 0 {
+		if minutes, err := strconv.Atoi(os.Getenv("PLAYBACK_TIMESHIFT_MINUTES")); err != nil {
+			log.Warnf("Invalid PLAYBACK_TIMESHIFT_MINUTES: %s", err.Error())
+		} else {
+			config.PlaybackConfig.TimeShift.Minutes = minutes
+		}
+	}
+
+	if len(os.Getenv("PLAYBACK_TIMESHIFT_DIR")) > 0 {
+		config.PlaybackConfig.TimeShift.Dir = os.Getenv("PLAYBACK_TIMESHIFT_DIR")
+	}
+
+	if len(os.Getenv("PLAYBACK_HISTORY_FILE")) > 0 {
+		config.PlaybackConfig.HistoryFile = os.Getenv("PLAYBACK_HISTORY_FILE")
+	}
+
+	if len(os.Getenv("PLAYBACK_HISTORY_SIZE")) > 0 {
+		if size, err := strconv.Atoi(os.Getenv("PLAYBACK_HISTORY_SIZE")); err != nil {
+			log.Warnf("Invalid PLAYBACK_HISTORY_SIZE: %s", err.Error())
+		} else if size < 0 {
+			log.Warnf("Invalid PLAYBACK_HISTORY_SIZE: %d is negative", size)
+		} else {
+			config.PlaybackConfig.HistorySize = size
+		}
+	}
+
+	if len(os.Getenv("PLAYBACK_RECENT_SIZE")) > 0 {
+		if size, err := strconv.Atoi(os.Getenv("PLAYBACK_RECENT_SIZE")); err != nil {
+			log.Warnf("Invalid PLAYBACK_RECENT_SIZE: %s", err.Error())
+		} else if size < 0 {
+			log.Warnf("Invalid PLAYBACK_RECENT_SIZE: %d is negative", size)
+		} else {
+			config.PlaybackConfig.RecentSize = size
+		}
+	}
+
+	if len(os.Getenv("PLAYBACK_CACHE_MINUTES")) > 0 {
+		if minutes, err := strconv.Atoi(os.Getenv("PLAYBACK_CACHE_MINUTES")); err != nil {
+			log.Warnf("Invalid PLAYBACK_CACHE_MINUTES: %s", err.Error())
+		} else {
+			config.PlaybackConfig.CacheMinutes = minutes
+		}
+	}
+
+	if len(os.Getenv("RECORDING_ENABLED")) > 0 && strings.ToLower(os.Getenv("RECORDING_ENABLED")) != "false" {
+		config.RecordingConfig.Enabled = true
+	}
+
+	if len(os.Getenv("RECORDING_DIR")) > 0 {
+		config.RecordingConfig.Dir = os.Getenv("RECORDING_DIR")
+	}
+
+	if len(os.Getenv("STATIONS_FILE")) > 0 {
+		config.StationsConfig.File = os.Getenv("STATIONS_FILE")
+	}
+
+	if len(os.Getenv("STATIONS_FORMAT")) > 0 {
+		config.StationsConfig.Format = os.Getenv("STATIONS_FORMAT")
+	}
+
+	if len(os.Getenv("STATIONS_RECORDINGS")) > 0 && strings.ToLower(os.Getenv("STATIONS_RECORDINGS")) != "false" {
+		config.StationsConfig.Recordings = true
+	}
+
+	if len(os.Getenv("STATIONS_SMART_FOLDERS")) > 0 {
+		config.StationsConfig.SmartFolders = strings.ToLower(os.Getenv("STATIONS_SMART_FOLDERS")) != "false"
+	}
+
+	// Urls contain colons - so the feeds are separated by spaces
+	if len(os.Getenv("STATIONS_PODCASTS")) > 0 {
+		config.StationsConfig.Podcasts = strings.Fields(os.Getenv("STATIONS_PODCASTS"))
+	}
+
+	if len(os.Getenv("STATIONS_PODCAST_REFRESH_MINUTES")) > 0 {
+		if minutes, err := strconv.Atoi(os.Getenv("STATIONS_PODCAST_REFRESH_MINUTES")); err != nil {
+			log.Warnf("Invalid STATIONS_PODCAST_REFRESH_MINUTES: %s", err.Error())
+		} else {
+			config.StationsConfig.PodcastRefreshMinutes = minutes
+		}
+	}
+
+	if len(os.Getenv("STATIONS_RADIO_BROWSER_NAME")) > 0 {
+		config.StationsConfig.RadioBrowser.Name = os.Getenv("STATIONS_RADIO_BROWSER_NAME")
+	}
+
+	if len(os.Getenv("STATIONS_RADIO_BROWSER_SOURCE")) > 0 {
+		config.StationsConfig.RadioBrowser.Source = os.Getenv("STATIONS_RADIO_BROWSER_SOURCE")
+	}
+
+	if len(os.Getenv("STATIONS_RADIO_BROWSER_CACHE_FILE")) > 0 {
+		config.StationsConfig.RadioBrowser.CacheFile = os.Getenv("STATIONS_RADIO_BROWSER_CACHE_FILE")
+	}
+
+	if len(os.Getenv("STATIONS_RADIO_BROWSER_REFRESH_HOURS")) > 0 {
+		if hours, err := strconv.Atoi(os.Getenv("STATIONS_RADIO_BROWSER_REFRESH_HOURS")); err != nil {
+			log.Warnf("Invalid STATIONS_RADIO_BROWSER_REFRESH_HOURS: %s", err.Error())
+		} else {
+			config.StationsConfig.RadioBrowser.RefreshHours = hours
+		}
+	}
+
 	return config
 }
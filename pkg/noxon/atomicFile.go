@@ -0,0 +1,35 @@
+package noxon
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Replaces the file at once so readers never see a partially written file. The permissions of an existing file are kept
+// (new files get 0644)
+func writeFileAtomic(name string, data []byte) error {
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(name); err == nil {
+		mode = info.Mode().Perm()
+	}
+	temp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Chmod(mode); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return os.Rename(temp.Name(), name)
+}
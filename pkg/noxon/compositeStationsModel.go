@@ -0,0 +1,209 @@
+package noxon
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A model mounted into the root menu of a CompositeStationsModel
+type Mount struct {
+	// Namespace of the item ids ("<id>/<id of the model>"). Must not contain a "/". The ids of a mount without id are
+	// not namespaced (e.g. to keep the ids of existing presets) - only one mount may omit the id
+	Id string
+	// Title of the top-level dir. The root items of a mount without name are shown at the top level. If the model has
+	// a single root dir its content is shown in the mount dir
+	Name  string
+	Model StationsModel
+}
+
+// The dir of a mount has the id "<id>/"
+func (m Mount) dirId() string {
+
+	return m.Id + "/"
+}
+
+func (m Mount) wrapId(id string) string {
+
+	if len(m.Id) == 0 || len(id) == 0 {
+		return id
+	}
+	return m.Id + "/" + id
+}
+
+// Whether the model of the mount has an item with the id
+func (m Mount) has(id string) bool {
+
+	_, itemId := m.Model.Data(&id, -1)
+	return len(itemId) > 0
+}
+
+// The parent of the items shown in the mount dir
+func (m Mount) contentParent() *string {
+
+	if m.Model.Count(nil) == 1 {
+		if item, id := m.Model.Data(nil, 0); len(id) > 0 {
+			if _, ok := item.(ItemDir); ok {
+				return &id
+			}
+		}
+	}
+	return nil
+}
+
+// Mounts several models into one root menu
+type CompositeStationsModel struct {
+	mounts []Mount
+}
+
+func NewCompositeStationsModel(mounts ...Mount) CompositeStationsModel {
+
+	valid := []Mount{}
+	hasPlainMount := false
+	for _, mount := range mounts {
+		if strings.Contains(mount.Id, "/") {
+			log.Errorf("Ignoring mount '%s' - the id must not contain a '/'", mount.Id)
+			continue
+		} else if len(mount.Id) == 0 && hasPlainMount {
+			log.Errorf("Ignoring mount '%s' - only one mount may omit the id", mount.Name)
+			continue
+		}
+		hasPlainMount = hasPlainMount || len(mount.Id) == 0
+		valid = append(valid, mount)
+	}
+	return CompositeStationsModel{
+		mounts: valid,
+	}
+}
+
+// The mount the item with the id belongs to and the id of the item in the model of the mount (isDir if the id is the
+// id of the mount dir). The ids of the mount without id may contain a "<id>/" of another mount too - so an id is only
+// routed by its prefix if the model of the mount knows it
+func (m CompositeStationsModel) find(id string) (mount Mount, modelId string, isDir bool, ok bool) {
+
+	var plainMount *Mount
+	for i, mount := range m.mounts {
+		if len(mount.Id) == 0 {
+			plainMount = &m.mounts[i]
+		} else if id == mount.dirId() && len(mount.Name) > 0 {
+			return mount, "", true, true
+		}
+	}
+	if plainMount != nil && plainMount.has(id) {
+		return *plainMount, id, false, true
+	}
+	for _, mount := range m.mounts {
+		if modelId, ok := strings.CutPrefix(id, mount.dirId()); ok && len(mount.Id) > 0 && mount.has(modelId) {
+			return mount, modelId, false, true
+		}
+	}
+	if plainMount != nil {
+		if id == plainMount.dirId() && len(plainMount.Name) > 0 {
+			return *plainMount, "", true, true
+		}
+		return *plainMount, id, false, true
+	}
+	return Mount{}, "", false, false
+}
+
+func (m CompositeStationsModel) Data(parentId *string, index int) (Item, string) {
+
+	if parentId == nil {
+		// root
+		for _, mount := range m.mounts {
+			if len(mount.Name) > 0 {
+				if index == 0 {
+					return ItemDir{Title: mount.Name}, mount.dirId()
+				}
+				index--
+			} else if count := mount.Model.Count(nil); index < count {
+				item, id := mount.Model.Data(nil, index)
+				return item, mount.wrapId(id)
+			} else {
+				index -= count
+			}
+		}
+	} else if mount, modelId, isDir, ok := m.find(*parentId); ok {
+		if isDir && index < 0 {
+			return ItemDir{Title: mount.Name}, mount.dirId()
+		} else if isDir {
+			item, id := mount.Model.Data(mount.contentParent(), index)
+			return item, mount.wrapId(id)
+		}
+		item, id := mount.Model.Data(&modelId, index)
+		return item, mount.wrapId(id)
+	}
+	return ItemDir{}, ""
+}
+
+func (m CompositeStationsModel) Count(parentId *string) int {
+
+	if parentId == nil {
+		// root
+		count := 0
+		for _, mount := range m.mounts {
+			if len(mount.Name) > 0 {
+				count++
+			} else {
+				count += mount.Model.Count(nil)
+			}
+		}
+		return count
+	} else if mount, modelId, isDir, ok := m.find(*parentId); ok {
+		if isDir {
+			return mount.Model.Count(mount.contentParent())
+		}
+		return mount.Model.Count(&modelId)
+	}
+	return 0
+}
+
+// The matching stations of every mount that supports searching (in the order of the mounts)
+func (m CompositeStationsModel) Search(query string) []string {
+
+	ids := []string{}
+	for _, mount := range m.mounts {
+		if searcher, ok := mount.Model.(Searcher); ok {
+			for _, id := range searcher.Search(query) {
+				ids = append(ids, mount.wrapId(id))
+			}
+		}
+	}
+	return ids
+}
+
+func (m CompositeStationsModel) TaggedStations(category string) map[string][]string {
+
+	tagged := map[string][]string{}
+	for _, mount := range m.mounts {
+		if taggedModel, ok := mount.Model.(TaggedStationsModel); ok {
+			for tag, ids := range taggedModel.TaggedStations(category) {
+				for _, id := range ids {
+					tagged[tag] = append(tagged[tag], mount.wrapId(id))
+				}
+			}
+		}
+	}
+	return tagged
+}
+
+func (m CompositeStationsModel) ForDevice(mac string) StationsModel {
+
+	mounts := []Mount{}
+	for _, mount := range m.mounts {
+		if deviceModel, ok := mount.Model.(DeviceStationsModel); ok {
+			mount.Model = deviceModel.ForDevice(mac)
+		}
+		mounts = append(mounts, mount)
+	}
+	return CompositeStationsModel{mounts: mounts}
+}
+
+func (m CompositeStationsModel) Played(mac string, stationId string) {
+
+	if mount, modelId, isDir, ok := m.find(stationId); ok && !isDir {
+		if deviceModel, ok := mount.Model.(DeviceStationsModel); ok {
+			deviceModel.Played(mac, modelId)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package noxon
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A cron-like schedule "minute hour day-of-month month day-of-week". Supports *, lists (1,2), ranges (1-5) and steps
+// (*/15, 0-30/10). Sunday is 0 (or 7)
+type CronSchedule struct {
+	minutes     map[int]bool
+	hours       map[int]bool
+	daysOfMonth map[int]bool
+	months      map[int]bool
+	daysOfWeek  map[int]bool
+	// Like cron: if both days are restricted, either has to match
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+func ParseCronSchedule(spec string) (CronSchedule, error) {
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return CronSchedule{}, fmt.Errorf("expected 5 fields in schedule '%s' but got %d", spec, len(fields))
+	}
+	schedule := CronSchedule{
+		anyDayOfMonth: fields[2] == "*",
+		anyDayOfWeek:  fields[4] == "*",
+	}
+	var err error
+	if schedule.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return CronSchedule{}, fmt.Errorf("invalid minute: %w", err)
+	}
+	if schedule.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return CronSchedule{}, fmt.Errorf("invalid hour: %w", err)
+	}
+	if schedule.daysOfMonth, err = parseCronField(fields[2], 1, 31); err != nil {
+		return CronSchedule{}, fmt.Errorf("invalid day of month: %w", err)
+	}
+	if schedule.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return CronSchedule{}, fmt.Errorf("invalid month: %w", err)
+	}
+	if schedule.daysOfWeek, err = parseCronField(fields[4], 0, 7); err != nil {
+		return CronSchedule{}, fmt.Errorf("invalid day of week: %w", err)
+	}
+	if schedule.daysOfWeek[7] {
+		schedule.daysOfWeek[0] = true
+	}
+	return schedule, nil
+}
+
+func parseCronField(field string, low int, high int) (map[int]bool, error) {
+
+	values := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if rangePart, stepPart, ok := strings.Cut(part, "/"); ok {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step '%s'", stepPart)
+			}
+			part = rangePart
+		}
+		first, last := low, high
+		if part != "*" {
+			var err error
+			fromPart, toPart, isRange := strings.Cut(part, "-")
+			if first, err = strconv.Atoi(fromPart); err != nil {
+				return nil, fmt.Errorf("invalid value '%s'", fromPart)
+			}
+			last = first
+			if isRange {
+				if last, err = strconv.Atoi(toPart); err != nil {
+					return nil, fmt.Errorf("invalid value '%s'", toPart)
+				}
+			} else if step > 1 {
+				// 5/10 means every 10th starting at 5
+				last = high
+			}
+		}
+		if first < low || last > high || first > last {
+			return nil, fmt.Errorf("'%s' out of range %d-%d", part, low, high)
+		}
+		for value := first; value <= last; value += step {
+			values[value] = true
+		}
+	}
+	return values, nil
+}
+
+// Matches the minute of t
+func (s CronSchedule) Matches(t time.Time) bool {
+
+	if !s.minutes[t.Minute()] || !s.hours[t.Hour()] || !s.months[int(t.Month())] {
+		return false
+	}
+	dayOfMonth := s.daysOfMonth[t.Day()]
+	dayOfWeek := s.daysOfWeek[int(t.Weekday())]
+	if s.anyDayOfMonth || s.anyDayOfWeek {
+		return dayOfMonth && dayOfWeek
+	}
+	return dayOfMonth || dayOfWeek
+}
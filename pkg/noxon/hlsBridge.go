@@ -0,0 +1,553 @@
+package noxon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const tsPacketSize = 188
+const tsSyncByte = 0x47
+
+// Number of segments we start behind the live edge of a media playlist (like most players do)
+const hlsLiveEdgeSegments = 3
+const hlsMaxPlaylistErrors = 5
+
+const hlsTimeout = 30 * time.Second
+
+type hlsVariant struct {
+	Url       string
+	Bandwidth int
+}
+
+type hlsSegment struct {
+	Url      string
+	Sequence int64
+}
+
+type hlsMediaPlaylist struct {
+	TargetDuration time.Duration
+	MediaSequence  int64 // Sequence number of the first segment
+	Segments       []hlsSegment
+	EndList        bool
+}
+
+// HlsReader bridges a HLS stream to a continuous audio elementary stream (ADTS AAC or MPEG audio) that can be
+// served to the device like an ordinary Icecast stream
+type HlsReader struct {
+	playlistUrl string
+	bandwidth   int
+	client      *http.Client
+	reader      *io.PipeReader
+	writer      *io.PipeWriter
+	cancel      context.CancelFunc
+	startOnce   sync.Once
+	mutex       sync.Mutex
+	contentType string
+}
+
+// Creates a reader for the HLS (master or media) playlist. If the playlist is a master playlist the variant with the
+// bandwidth (bit/s) closest to the given bandwidth is selected
+func NewHlsReader(playlistUrl string, bandwidth int) *HlsReader {
+
+	return NewHlsReaderWithClient(playlistUrl, bandwidth, &http.Client{Timeout: hlsTimeout})
+}
+
+// Like NewHlsReader but the playlists and segments are fetched with the given client
+func NewHlsReaderWithClient(playlistUrl string, bandwidth int, client *http.Client) *HlsReader {
+
+	reader, writer := io.Pipe()
+	return &HlsReader{
+		playlistUrl: playlistUrl,
+		bandwidth:   bandwidth,
+		client:      client,
+		reader:      reader,
+		writer:      writer,
+	}
+}
+
+func (r *HlsReader) Read(p []byte) (int, error) {
+
+	r.startOnce.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		r.cancel = cancel
+		go r.run(ctx)
+	})
+	return r.reader.Read(p)
+}
+
+func (r *HlsReader) Close() error {
+
+	r.startOnce.Do(func() {})
+	if r.cancel != nil {
+		r.cancel()
+	}
+	return r.reader.Close()
+}
+
+// The content type of the elementary stream. Only known after the first successful Read
+func (r *HlsReader) ContentType() string {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.contentType
+}
+
+func (r *HlsReader) setContentType(contentType string) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.contentType) == 0 {
+		r.contentType = contentType
+	}
+}
+
+func (r *HlsReader) run(ctx context.Context) {
+
+	err := r.bridge(ctx)
+	if err == nil || ctx.Err() != nil {
+		r.writer.Close()
+	} else {
+		log.Errorf("HLS bridge for %s failed: %s", r.playlistUrl, err.Error())
+		r.writer.CloseWithError(err)
+	}
+}
+
+func (r *HlsReader) bridge(ctx context.Context) error {
+
+	mediaUrl, err := r.selectMediaPlaylist(ctx)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Bridging HLS media playlist %s", mediaUrl)
+
+	demuxer := newTsDemuxer(r.writer, r.setContentType)
+	lastSequence := int64(-1)
+	lastMediaSequence := int64(-1)
+	playlistErrors := 0
+	for {
+		playlist, err := r.fetchMediaPlaylist(ctx, mediaUrl)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			playlistErrors++
+			if playlistErrors > hlsMaxPlaylistErrors {
+				return err
+			}
+			log.Warnf("Could not fetch HLS media playlist (attempt %d): %s", playlistErrors, err.Error())
+			if !sleepContext(ctx, time.Second) {
+				return nil
+			}
+			continue
+		}
+		playlistErrors = 0
+
+		if playlist.MediaSequence < lastMediaSequence {
+			// The media sequence only decreases if the encoder restarted (or after a discontinuity) - all segments are new
+			log.Infof("HLS media sequence of %s restarted at %d (was %d)", mediaUrl, playlist.MediaSequence, lastMediaSequence)
+			lastSequence = playlist.MediaSequence - 1
+		}
+		lastMediaSequence = playlist.MediaSequence
+
+		segments := playlist.Segments
+		if lastSequence < 0 && !playlist.EndList && len(segments) > hlsLiveEdgeSegments {
+			segments = segments[len(segments)-hlsLiveEdgeSegments:]
+		}
+		newSegments := 0
+		for _, segment := range segments {
+			if segment.Sequence <= lastSequence {
+				continue
+			}
+			if err := r.bridgeSegment(ctx, segment, demuxer); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				if err == io.ErrClosedPipe {
+					// The reader was closed
+					return nil
+				}
+				log.Warnf("Skipping HLS segment %d: %s", segment.Sequence, err.Error())
+			}
+			lastSequence = segment.Sequence
+			newSegments++
+		}
+
+		if playlist.EndList {
+			return nil
+		}
+
+		// Poll again after one target duration - or after half of it if the playlist did not change (see RFC 8216 6.3.4)
+		wait := playlist.TargetDuration
+		if newSegments == 0 {
+			wait = wait / 2
+		}
+		if !sleepContext(ctx, wait) {
+			return nil
+		}
+	}
+}
+
+func (r *HlsReader) bridgeSegment(ctx context.Context, segment hlsSegment, demuxer *tsDemuxer) error {
+
+	data, err := r.fetch(ctx, segment.Url)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 && data[0] == tsSyncByte {
+		return demuxer.Write(data)
+	}
+	// Packed audio segment (raw ADTS/MPEG audio prefixed with an ID3 timestamp tag)
+	data = stripId3(data)
+	r.setContentType(sniffAudioContentType(data))
+	_, err = r.writer.Write(data)
+	return err
+}
+
+func (r *HlsReader) selectMediaPlaylist(ctx context.Context) (string, error) {
+
+	data, err := r.fetch(ctx, r.playlistUrl)
+	if err != nil {
+		return "", err
+	}
+	base, _ := url.Parse(r.playlistUrl)
+	variants := parseHlsMasterPlaylist(data, base)
+	if len(variants) == 0 {
+		// Already a media playlist
+		return r.playlistUrl, nil
+	}
+
+	selected := variants[0]
+	for _, variant := range variants[1:] {
+		if absInt(variant.Bandwidth-r.bandwidth) < absInt(selected.Bandwidth-r.bandwidth) {
+			selected = variant
+		}
+	}
+	log.Debugf("Selected HLS variant with bandwidth %d (wanted %d)", selected.Bandwidth, r.bandwidth)
+	return selected.Url, nil
+}
+
+func (r *HlsReader) fetch(ctx context.Context, hlsUrl string) ([]byte, error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hlsUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status code %d for %s", resp.StatusCode, hlsUrl)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (r *HlsReader) fetchMediaPlaylist(ctx context.Context, mediaUrl string) (hlsMediaPlaylist, error) {
+
+	data, err := r.fetch(ctx, mediaUrl)
+	if err != nil {
+		return hlsMediaPlaylist{}, err
+	}
+	base, _ := url.Parse(mediaUrl)
+	return parseHlsMediaPlaylist(data, base)
+}
+
+// A HLS playlist is a m3u playlist using the #EXT-X- tags
+func isHlsPlaylist(data []byte) bool {
+
+	return bytes.Contains(data, []byte("#EXT-X-TARGETDURATION")) || bytes.Contains(data, []byte("#EXT-X-STREAM-INF"))
+}
+
+func parseHlsMasterPlaylist(data []byte, base *url.URL) (variants []hlsVariant) {
+
+	var pending *hlsVariant
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if attributes, ok := strings.CutPrefix(line, "#EXT-X-STREAM-INF:"); ok {
+			bandwidth, _ := strconv.Atoi(parseHlsAttributes(attributes)["BANDWIDTH"])
+			pending = &hlsVariant{Bandwidth: bandwidth}
+		} else if len(line) > 0 && !strings.HasPrefix(line, "#") && pending != nil {
+			pending.Url = resolveHlsUrl(base, line)
+			variants = append(variants, *pending)
+			pending = nil
+		}
+	}
+	return variants
+}
+
+func parseHlsMediaPlaylist(data []byte, base *url.URL) (playlist hlsMediaPlaylist, err error) {
+
+	playlist.TargetDuration = 10 * time.Second
+	sequence := int64(0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if value, ok := strings.CutPrefix(line, "#EXT-X-TARGETDURATION:"); ok {
+			if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+				playlist.TargetDuration = time.Duration(seconds) * time.Second
+			}
+		} else if value, ok := strings.CutPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"); ok {
+			sequence, _ = strconv.ParseInt(value, 10, 64)
+			playlist.MediaSequence = sequence
+		} else if strings.HasPrefix(line, "#EXT-X-ENDLIST") {
+			playlist.EndList = true
+		} else if value, ok := strings.CutPrefix(line, "#EXT-X-KEY:"); ok {
+			if method := parseHlsAttributes(value)["METHOD"]; method != "NONE" {
+				return playlist, fmt.Errorf("encrypted HLS segments (%s) are not supported", method)
+			}
+		} else if strings.HasPrefix(line, "#EXT-X-MAP:") {
+			return playlist, fmt.Errorf("fragmented mp4 HLS segments are not supported")
+		} else if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			playlist.Segments = append(playlist.Segments, hlsSegment{Url: resolveHlsUrl(base, line), Sequence: sequence})
+			sequence++
+		}
+	}
+	return playlist, nil
+}
+
+// Parses an attribute list like BANDWIDTH=128000,CODECS="mp4a.40.2,mp4a.40.5"
+func parseHlsAttributes(list string) map[string]string {
+
+	attributes := map[string]string{}
+	for len(list) > 0 {
+		key, rest, found := strings.Cut(list, "=")
+		if !found {
+			break
+		}
+		value := ""
+		if strings.HasPrefix(rest, "\"") {
+			if end := strings.Index(rest[1:], "\""); end >= 0 {
+				value = rest[1 : end+1]
+				rest = rest[end+2:]
+			} else {
+				value = rest[1:]
+				rest = ""
+			}
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			rest = "," + rest
+		}
+		attributes[strings.TrimSpace(key)] = value
+		_, list, _ = strings.Cut(rest, ",")
+	}
+	return attributes
+}
+
+func resolveHlsUrl(base *url.URL, reference string) string {
+
+	if ref, err := url.Parse(reference); err == nil && base != nil {
+		return base.ResolveReference(ref).String()
+	}
+	return reference
+}
+
+// tsDemuxer extracts the payload of the first supported audio elementary stream of a MPEG transport stream
+type tsDemuxer struct {
+	writer        io.Writer
+	onContentType func(string)
+	pmtPid        int
+	audioPid      int
+	pending       []byte
+	audio         []byte // The payload of the data passed to Write - written at once instead of packet by packet
+}
+
+func newTsDemuxer(writer io.Writer, onContentType func(string)) *tsDemuxer {
+
+	return &tsDemuxer{
+		writer:        writer,
+		onContentType: onContentType,
+		pmtPid:        -1,
+		audioPid:      -1,
+	}
+}
+
+// Demuxes the data (usually a whole segment) and writes the audio payload of all its packets at once
+func (d *tsDemuxer) Write(data []byte) error {
+
+	data = append(d.pending, data...)
+	d.pending = nil
+	d.audio = d.audio[:0]
+	for len(data) >= tsPacketSize {
+		if data[0] != tsSyncByte {
+			// Lost sync - search for the next sync byte
+			if next := bytes.IndexByte(data[1:], tsSyncByte); next >= 0 {
+				data = data[next+1:]
+				continue
+			}
+			data = nil
+			break
+		}
+		d.packet(data[:tsPacketSize])
+		data = data[tsPacketSize:]
+	}
+	d.pending = append([]byte{}, data...)
+	if len(d.audio) == 0 {
+		return nil
+	}
+	_, err := d.writer.Write(d.audio)
+	return err
+}
+
+func (d *tsDemuxer) packet(packet []byte) {
+
+	payloadStart := packet[1]&0x40 != 0
+	pid := int(packet[1]&0x1f)<<8 | int(packet[2])
+	adaptation := (packet[3] >> 4) & 0x03
+	payload := packet[4:]
+	if adaptation == 0x02 || adaptation == 0x00 {
+		// No payload
+		return
+	} else if adaptation == 0x03 {
+		if int(payload[0])+1 >= len(payload) {
+			return
+		}
+		payload = payload[int(payload[0])+1:]
+	}
+
+	switch {
+	case pid == 0 && payloadStart:
+		d.parsePat(payload)
+	case pid == d.pmtPid && payloadStart:
+		d.parsePmt(payload)
+	case pid == d.audioPid:
+		if payloadStart {
+			// Strip the PES header
+			if len(payload) < 9 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+				return
+			}
+			headerLength := 9 + int(payload[8])
+			if headerLength > len(payload) {
+				return
+			}
+			payload = payload[headerLength:]
+		}
+		d.audio = append(d.audio, payload...)
+	}
+}
+
+// Returns the section of a PSI table (without the pointer field and CRC)
+func tsSection(payload []byte) []byte {
+
+	pointer := int(payload[0])
+	if 1+pointer+3 > len(payload) {
+		return nil
+	}
+	section := payload[1+pointer:]
+	length := int(section[1]&0x0f)<<8 | int(section[2])
+	if 3+length > len(section) || length < 9 {
+		return nil
+	}
+	return section[:3+length-4]
+}
+
+func (d *tsDemuxer) parsePat(payload []byte) {
+
+	section := tsSection(payload)
+	if section == nil || section[0] != 0x00 {
+		return
+	}
+	for programs := section[8:]; len(programs) >= 4; programs = programs[4:] {
+		program := int(programs[0])<<8 | int(programs[1])
+		if program != 0 {
+			d.pmtPid = int(programs[2]&0x1f)<<8 | int(programs[3])
+			return
+		}
+	}
+}
+
+func (d *tsDemuxer) parsePmt(payload []byte) {
+
+	section := tsSection(payload)
+	if section == nil || section[0] != 0x02 || len(section) < 12 {
+		return
+	}
+	programInfoLength := int(section[10]&0x0f)<<8 | int(section[11])
+	if 12+programInfoLength > len(section) {
+		return
+	}
+	for streams := section[12+programInfoLength:]; len(streams) >= 5; {
+		streamType := streams[0]
+		pid := int(streams[1]&0x1f)<<8 | int(streams[2])
+		infoLength := int(streams[3]&0x0f)<<8 | int(streams[4])
+		contentType := ""
+		switch streamType {
+		case 0x03, 0x04:
+			contentType = "audio/mpeg"
+		case 0x0f:
+			contentType = "audio/aac"
+		}
+		if len(contentType) > 0 {
+			if d.audioPid != pid {
+				log.Debugf("Found audio stream (type 0x%02x) in transport stream", streamType)
+			}
+			d.audioPid = pid
+			d.onContentType(contentType)
+			return
+		}
+		if 5+infoLength > len(streams) {
+			return
+		}
+		streams = streams[5+infoLength:]
+	}
+}
+
+// Strips a leading ID3v2 tag
+func stripId3(data []byte) []byte {
+
+	if len(data) >= 10 && bytes.HasPrefix(data, []byte("ID3")) {
+		size := int(data[6]&0x7f)<<21 | int(data[7]&0x7f)<<14 | int(data[8]&0x7f)<<7 | int(data[9]&0x7f)
+		size += 10
+		if data[5]&0x10 != 0 {
+			// Footer present
+			size += 10
+		}
+		if size <= len(data) {
+			return data[size:]
+		}
+	}
+	return data
+}
+
+// Guesses the content type of an audio elementary stream by its first frame header
+func sniffAudioContentType(data []byte) string {
+
+	if len(data) >= 2 && data[0] == 0xff && data[1]&0xe0 == 0xe0 {
+		if data[1]&0x06 == 0x00 {
+			// Layer bits are zero for ADTS
+			return "audio/aac"
+		}
+		return "audio/mpeg"
+	}
+	return ""
+}
+
+func sleepContext(ctx context.Context, duration time.Duration) bool {
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(duration):
+		return true
+	}
+}
+
+func absInt(value int) int {
+
+	if value < 0 {
+		return -value
+	}
+	return value
+}
@@ -0,0 +1,177 @@
+package noxon
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// The interval (in bytes) we insert metadata blocks into the stream of devices that asked for them
+const icyMetaInterval = 16000
+
+// icyReader strips the interleaved ICY metadata blocks from a stream and reports the StreamTitle
+type icyReader struct {
+	source    io.ReadCloser
+	interval  int
+	remaining int
+	onTitle   func(string)
+}
+
+func newIcyReader(source io.ReadCloser, interval int, onTitle func(string)) *icyReader {
+
+	return &icyReader{
+		source:    source,
+		interval:  interval,
+		remaining: interval,
+		onTitle:   onTitle,
+	}
+}
+
+func (r *icyReader) Read(p []byte) (int, error) {
+
+	if r.remaining == 0 {
+		if err := r.readMetadata(); err != nil {
+			return 0, err
+		}
+		r.remaining = r.interval
+	}
+	if len(p) > r.remaining {
+		p = p[:r.remaining]
+	}
+	count, err := r.source.Read(p)
+	r.remaining -= count
+	return count, err
+}
+
+func (r *icyReader) Close() error {
+
+	return r.source.Close()
+}
+
+func (r *icyReader) readMetadata() error {
+
+	length := []byte{0}
+	if _, err := io.ReadFull(r.source, length); err != nil {
+		return err
+	}
+	if length[0] == 0 {
+		// No metadata update
+		return nil
+	}
+	metadata := make([]byte, int(length[0])*16)
+	if _, err := io.ReadFull(r.source, metadata); err != nil {
+		return err
+	}
+	if title, ok := parseStreamTitle(metadata); ok && r.onTitle != nil {
+		r.onTitle(title)
+	}
+	return nil
+}
+
+// Extracts the title from a metadata block like StreamTitle='Artist - Title';StreamUrl='https://example.com';
+func parseStreamTitle(metadata []byte) (string, bool) {
+
+	metadata = bytes.TrimRight(metadata, "\x00")
+	start := bytes.Index(metadata, []byte("StreamTitle='"))
+	if start < 0 {
+		return "", false
+	}
+	value := metadata[start+len("StreamTitle='"):]
+	// The title itself may contain quotes - so we search for the end of the key value pair
+	if end := bytes.Index(value, []byte("';")); end >= 0 {
+		value = value[:end]
+	} else {
+		value = bytes.TrimSuffix(value, []byte("'"))
+	}
+	return strings.TrimSpace(latin1ToUtf8(value)), true
+}
+
+// Most broadcasters send utf-8 but some still use latin-1
+func latin1ToUtf8(value []byte) string {
+
+	if utf8.Valid(value) {
+		return string(value)
+	}
+	runes := make([]rune, len(value))
+	for i, b := range value {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// icyWriter inserts ICY metadata blocks with the current title into the stream
+type icyWriter struct {
+	writer    io.Writer
+	interval  int
+	remaining int
+	title     func() string
+	sentTitle string
+}
+
+func newIcyWriter(writer io.Writer, interval int, title func() string) *icyWriter {
+
+	return &icyWriter{
+		writer:    writer,
+		interval:  interval,
+		remaining: interval,
+		title:     title,
+	}
+}
+
+func (w *icyWriter) Write(p []byte) (int, error) {
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > w.remaining {
+			chunk = chunk[:w.remaining]
+		}
+		count, err := w.writer.Write(chunk)
+		written += count
+		w.remaining -= count
+		if err != nil {
+			return written, err
+		}
+		p = p[count:]
+		if w.remaining == 0 {
+			if _, err := w.writer.Write(w.metadataBlock()); err != nil {
+				return written, err
+			}
+			w.remaining = w.interval
+		}
+	}
+	return written, nil
+}
+
+// Only changed titles are sent - an empty block (a single zero byte) otherwise
+func (w *icyWriter) metadataBlock() []byte {
+
+	title := w.title()
+	if title == w.sentTitle {
+		return []byte{0}
+	}
+	w.sentTitle = title
+	metadata := []byte("StreamTitle='" + icyTitle(title, 255*16-len("StreamTitle='';")) + "';")
+	// The length byte counts blocks of 16 bytes
+	blocks := (len(metadata) + 15) / 16
+	block := make([]byte, 1+blocks*16)
+	block[0] = byte(blocks)
+	copy(block[1:], metadata)
+	return block
+}
+
+// ICY metadata has no escaping: a "';" would end the title early and a zero byte is taken as padding. The title is cut
+// to maxLength bytes (at a character boundary)
+func icyTitle(title string, maxLength int) string {
+
+	title = strings.ReplaceAll(title, "\x00", "")
+	for strings.Contains(title, "';") {
+		title = strings.ReplaceAll(title, "';", "'")
+	}
+	for len(title) > maxLength {
+		_, size := utf8.DecodeLastRuneInString(title)
+		title = title[:len(title)-size]
+	}
+	return title
+}
@@ -0,0 +1,129 @@
+package noxon
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// An entry of the history file. The device is identified by the hash of its mac (as sent by the device)
+type playbackHistoryEntry struct {
+	Mac       string        `json:"mac"`
+	StationId string        `json:"stationId"`
+	StartTime time.Time     `json:"startTime"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// The history file is written at most once per delay - the playbacks often stop in bursts (e.g. while zapping)
+const playbackHistoryWriteDelay = 2 * time.Second
+
+// Persists the finished playbacks of every device in a json file. Only the latest size playbacks per device are kept
+type JsonPlaybackHistory struct {
+	mutex      sync.Mutex
+	writeMutex sync.Mutex // keeps the writes in order without blocking the readers
+	file       string
+	size       int
+	entries    map[string][]playbackHistoryEntry // by mac - the oldest first
+	pending    *time.Timer                       // The scheduled write - nil if the file is up to date
+}
+
+func NewJsonPlaybackHistory(file string, size int) *JsonPlaybackHistory {
+
+	if size < 0 {
+		log.Warnf("Invalid playback history size %d - no history is kept", size)
+		size = 0
+	}
+	history := &JsonPlaybackHistory{
+		mutex:   sync.Mutex{},
+		file:    file,
+		size:    size,
+		entries: map[string][]playbackHistoryEntry{},
+	}
+
+	if dat, err := os.ReadFile(file); err != nil {
+		log.Warnf("Could not read playback history file - will create one if needed: %s", err.Error())
+	} else if len(dat) > 0 {
+		entries := []playbackHistoryEntry{}
+		if err := json.Unmarshal(dat, &entries); err != nil {
+			log.Errorf("Could not unmarshal playback history: %s", err.Error())
+		}
+		for _, entry := range entries {
+			history.add(entry)
+		}
+	}
+	return history
+}
+
+func (h *JsonPlaybackHistory) add(entry playbackHistoryEntry) {
+
+	entries := append(h.entries[entry.Mac], entry)
+	if len(entries) > h.size {
+		entries = slices.Clone(entries[len(entries)-h.size:])
+	}
+	h.entries[entry.Mac] = entries
+}
+
+// Adds the playback - the file is written with a delay (see Flush)
+func (h *JsonPlaybackHistory) Add(entry HistoryEntry) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.add(playbackHistoryEntry{
+		Mac:       entry.Mac,
+		StationId: entry.StationId,
+		StartTime: entry.StartTime,
+		Duration:  entry.Duration,
+	})
+	if h.pending == nil {
+		h.pending = time.AfterFunc(playbackHistoryWriteDelay, h.Flush)
+	}
+}
+
+// Writes the playbacks added since the last write to the file right away
+func (h *JsonPlaybackHistory) Flush() {
+
+	h.writeMutex.Lock()
+	defer h.writeMutex.Unlock()
+	h.mutex.Lock()
+	if h.pending == nil {
+		h.mutex.Unlock()
+		return
+	}
+	h.pending.Stop()
+	h.pending = nil
+
+	entries := []playbackHistoryEntry{}
+	for _, deviceEntries := range h.entries {
+		entries = append(entries, deviceEntries...)
+	}
+	h.mutex.Unlock()
+	slices.SortFunc(entries, func(a, b playbackHistoryEntry) int {
+		return a.StartTime.Compare(b.StartTime)
+	})
+	if dat, err := json.Marshal(entries); err != nil {
+		log.Errorf("Could not marshal playback history: %s", err.Error())
+	} else if err := writeFileAtomic(h.file, dat); err != nil {
+		log.Errorf("Could not write playback history file: %s", err.Error())
+	}
+}
+
+func (h *JsonPlaybackHistory) Device(mac string) []HistoryEntry {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	history := []HistoryEntry{}
+	for _, entry := range h.entries[mac] {
+		history = append(history, HistoryEntry{
+			Mac:       entry.Mac,
+			StationId: entry.StationId,
+			StartTime: entry.StartTime,
+			Duration:  entry.Duration,
+		})
+	}
+	slices.Reverse(history)
+	return history
+}
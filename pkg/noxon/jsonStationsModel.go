@@ -1,21 +1,43 @@
 package noxon
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// A mirror of the station url. Mirrors with a lower priority are tried first (the higher bitrate wins on equal priority)
+type AlternativeUrl struct {
+	Url      string `json:"url"`
+	Priority int    `json:"priority"`
+	Bitrate  int    `json:"bitrate"`
+}
+
 type Entry struct {
-	Id                 string
-	DirName            string   `json:"dirName"`
-	StationName        string   `json:"stationName"`
-	StationDescription string   `json:"stationDescription"`
-	StationUrl         string   `json:"stationUrl"`
-	Children           []*Entry `json:"children"`
+	Id                 string           `json:"id"` // A hash of the names and the url if empty
+	DirName            string           `json:"dirName"`
+	StationName        string           `json:"stationName"`
+	StationDescription string           `json:"stationDescription"`
+	StationUrl         string           `json:"stationUrl"`
+	AlternativeUrls    []AlternativeUrl `json:"alternativeUrls"`
+	Transcode          string           `json:"transcode"`
+	Bitrate            int              `json:"bitrate"` // bit/s - selects the variant of HLS streams
+	Tls                *TlsOptions      `json:"tls"`
+	Tags               []string         `json:"tags"`     // e.g. news, jazz, kids (see SmartFoldersStationsModel)
+	Language           string           `json:"language"` // e.g. english
+	Country            string           `json:"country"`  // e.g. Germany
+	Children           []*Entry         `json:"children"`
 }
 
 func (e *Entry) isDir() bool {
@@ -26,8 +48,46 @@ func (e *Entry) isStation() bool {
 	return len(e.StationName) > 0
 }
 
+// The mirror urls in the order they should be tried
+func (e *Entry) alternativeUrls() []string {
+
+	alternatives := append([]AlternativeUrl{}, e.AlternativeUrls...)
+	sort.SliceStable(alternatives, func(i, j int) bool {
+		if alternatives[i].Priority != alternatives[j].Priority {
+			return alternatives[i].Priority < alternatives[j].Priority
+		}
+		return alternatives[i].Bitrate > alternatives[j].Bitrate
+	})
+	urls := []string{}
+	for _, alternative := range alternatives {
+		if len(alternative.Url) > 0 {
+			urls = append(urls, alternative.Url)
+		}
+	}
+	return urls
+}
+
+// The state is shared by all copies of the model so a reload is visible everywhere
+type jsonModelState struct {
+	mutex    sync.RWMutex
+	data     []*Entry
+	entries  map[string]*Entry // by id
+	stop     chan struct{}     // Closed to stop watching the stations file (see Close)
+	stopOnce sync.Once
+}
+
+func newJsonModelState() *jsonModelState {
+
+	return &jsonModelState{
+		mutex:   sync.RWMutex{},
+		data:    []*Entry{},
+		entries: map[string]*Entry{},
+		stop:    make(chan struct{}),
+	}
+}
+
 type JsonModel struct {
-	data []*Entry
+	state *jsonModelState
 }
 
 // Only used for debugging
@@ -48,54 +108,259 @@ func NewRandomJsonModel() JsonModel {
 
 func NewJsonModelFromJson(jsonData []byte) (ret JsonModel) {
 
+	ret.state = newJsonModelState()
+	if err := ret.load(jsonData, false); err != nil {
+		log.Errorf("Could not parse stations: %s", err.Error())
+	}
+	return ret
+}
+
+// Reloads the file whenever it changed (polled every pollInterval) until the model is closed. An invalid file is ignored
+// and the last valid stations are kept. The format is detected by the extension of the file
+func NewJsonModelFromFile(file string, pollInterval time.Duration) (ret JsonModel) {
+
+	return NewJsonModelFromFileWithFormat(file, DetectStationsFormat(file), pollInterval)
+}
+
+// Like NewJsonModelFromFile but with an explicit format (see ImportStations). Included files are watched as well
+func NewJsonModelFromFileWithFormat(file string, format string, pollInterval time.Duration) (ret JsonModel) {
+
+	ret.state = newJsonModelState()
+	files, err := ret.loadFile(file, format)
+	if err != nil {
+		log.Errorf("Could not read stations file: %s", err.Error())
+	}
+	if pollInterval > 0 {
+		go func() {
+			for {
+				select {
+				case <-ret.state.stop:
+					return
+				case <-time.After(pollInterval):
+				}
+				if changed := modificationTimes(files); !reflect.DeepEqual(changed, files) {
+					log.Infof("Stations file %s changed - reloading", file)
+					if files, err = ret.loadFile(file, format); err != nil {
+						log.Errorf("Keeping the current stations - could not reload stations file: %s", err.Error())
+					}
+				}
+			}
+		}()
+	}
+	return ret
+}
+
+// Stops watching the stations file (see NewJsonModelFromFile). The stations loaded so far are kept
+func (m JsonModel) Close() {
+
+	m.state.stopOnce.Do(func() { close(m.state.stop) })
+}
+
+func NewJsonStationsModel() (ret JsonModel) {
+
+	return NewJsonModelFromFile("stations.json", 2*time.Second)
+}
+
+// The current modification times of the files (zero for missing files)
+func modificationTimes(files map[string]time.Time) map[string]time.Time {
+
+	current := map[string]time.Time{}
+	for file := range files {
+		current[file] = time.Time{}
+		if info, err := os.Stat(file); err == nil {
+			current[file] = info.ModTime()
+		}
+	}
+	return current
+}
+
+// Returns the modification times of the loaded files (with the included files)
+func (m JsonModel) loadFile(file string, format string) (map[string]time.Time, error) {
+
+	if format == StationsFormatJson {
+		// keep the original json so the validation reports the positions in the file
+		b, err := os.ReadFile(file)
+		files := modificationTimes(map[string]time.Time{file: {}})
+		if err != nil {
+			return files, err
+		}
+		return files, m.load(b, false)
+	}
+
+	b, loaded, err := ImportStationsFile(file, format)
+	files := map[string]time.Time{}
+	for _, loadedFile := range append(loaded, file) {
+		if absolute, err := filepath.Abs(loadedFile); err == nil {
+			files[absolute] = time.Time{}
+		}
+	}
+	files = modificationTimes(files)
+	if err != nil {
+		return files, fmt.Errorf("could not import %s file: %w", format, err)
+	}
+	return files, m.load(b, true)
+}
+
+// Parses and validates the stations and swaps them in. The positions of the validation errors are omitted for
+// imported files because they refer to the converted json
+func (m JsonModel) load(jsonData []byte, imported bool) error {
+
+	validationErrors := ValidateStations(jsonData)
+	if imported {
+		for i := range validationErrors {
+			validationErrors[i].Line, validationErrors[i].Column = 0, 0
+		}
+	}
+	for _, warning := range validationErrors {
+		if warning.Warning {
+			log.Warnf("Stations: %s", warning.Error())
+		}
+	}
+	if errs := validationErrors.FileErrors(); len(errs) > 0 {
+		for _, err := range errs {
+			log.Errorf("Stations: %s", err.Error())
+		}
+		return fmt.Errorf("invalid stations file: %w", errs[0])
+	}
+	invalid := map[string]bool{}
+	for _, err := range validationErrors.Errors() {
+		log.Errorf("Stations: %s - skipping the entry", err.Error())
+		invalid[err.entry] = true
+	}
+	jsonData, err := withoutEntries(jsonData, invalid, "")
+	if err != nil {
+		return err
+	}
 	data := []*Entry{}
-	json.Unmarshal(jsonData, &data)
+	if err := json.Unmarshal(jsonData, &data); err != nil {
+		return err
+	}
+	withoutInvalidAlternativeUrls(data)
+	assignStableIds(data)
 
-	// index the model
-	index := 0
-	var indexer func(entries []*Entry)
-	indexer = func(entries []*Entry) {
-		for _, entry := range entries {
-			entry.Id = fmt.Sprint(index)
-			index++
+	// index the model - the first entry wins if ids are duplicated (like a depth-first search)
+	entries := map[string]*Entry{}
+	var indexer func(children []*Entry)
+	indexer = func(children []*Entry) {
+		for _, entry := range children {
+			if _, ok := entries[entry.Id]; !ok {
+				entries[entry.Id] = entry
+			}
 			indexer(entry.Children)
 		}
 	}
 	indexer(data)
-	ret.data = data
-	return ret
+
+	m.state.mutex.Lock()
+	defer m.state.mutex.Unlock()
+	m.state.data = data
+	m.state.entries = entries
+	return nil
 }
 
-func NewJsonStationsModel() (ret JsonModel) {
+// Removes the invalid entries (identified by their indices and the ones of their parents like "0/2") from a list of
+// entries. The children of stations are removed as well, they are ignored anyway
+func withoutEntries(list []byte, invalid map[string]bool, parent string) ([]byte, error) {
 
-	if jsonFile, err := os.Open("stations.json"); err != nil {
-		log.Errorf("Could not read stations file: %s", err.Error())
-	} else {
-		defer jsonFile.Close()
-		b, _ := ioutil.ReadAll(jsonFile)
-		ret = NewJsonModelFromJson(b)
+	raw := []json.RawMessage{}
+	if err := json.Unmarshal(list, &raw); err != nil {
+		return nil, err
 	}
-	return ret
+	kept := []map[string]json.RawMessage{}
+	for i, rawEntry := range raw {
+		index := strings.TrimPrefix(parent+"/"+strconv.Itoa(i), "/")
+		if invalid[index] {
+			continue
+		}
+		entry := map[string]json.RawMessage{}
+		if err := json.Unmarshal(rawEntry, &entry); err != nil {
+			return nil, err
+		}
+		dirName := ""
+		if err := json.Unmarshal(entry["dirName"], &dirName); len(entry["dirName"]) > 0 && err != nil {
+			return nil, err
+		}
+		if children, ok := entry["children"]; ok && len(dirName) == 0 {
+			delete(entry, "children")
+		} else if ok && string(children) != "null" {
+			pruned, err := withoutEntries(children, invalid, index)
+			if err != nil {
+				return nil, err
+			}
+			entry["children"] = pruned
+		}
+		kept = append(kept, entry)
+	}
+	return json.Marshal(kept)
 }
 
-// TODO: Very unperformant recursive search - index the model in a map structure
-func (m JsonModel) findEntry(id string) *Entry {
+func withoutInvalidAlternativeUrls(entries []*Entry) {
 
-	var search func(entries []*Entry) *Entry
-	search = func(entries []*Entry) *Entry {
+	for _, entry := range entries {
+		alternatives := entry.AlternativeUrls[:0]
+		for _, alternative := range entry.AlternativeUrls {
+			if validateStationUrl(alternative.Url) == nil {
+				alternatives = append(alternatives, alternative)
+			}
+		}
+		entry.AlternativeUrls = alternatives
+		withoutInvalidAlternativeUrls(entry.Children)
+	}
+}
+
+// Identifies an entry by the names of its parents, its name and its url
+func (e *Entry) key(parentKey string) string {
+
+	return parentKey + "/" + e.DirName + "|" + e.StationName + "|" + e.StationUrl
+}
+
+// Entries without an explicit id get a hash of their key. Entries with the same key get a numbered suffix
+func assignStableIds(entries []*Entry) {
+
+	occurrences := map[string]int{}
+	var indexer func(entries []*Entry, parentKey string)
+	indexer = func(entries []*Entry, parentKey string) {
 		for _, entry := range entries {
-			if entry != nil {
-				if entry.Id == id {
-					return entry
-				}
-				if child := search(entry.Children); child != nil {
-					return child
+			key := entry.key(parentKey)
+			if len(entry.Id) == 0 {
+				hash := sha1.Sum([]byte(key))
+				entry.Id = hex.EncodeToString(hash[:6])
+				if occurrences[key] > 0 {
+					entry.Id = fmt.Sprintf("%s-%d", entry.Id, occurrences[key])
 				}
+				occurrences[key]++
 			}
+			indexer(entry.Children, key)
 		}
-		return nil
 	}
-	return search(m.data)
+	indexer(entries, "")
+}
+
+// Maps the positional ids of former versions (a depth-first counter) to the stable ids of the stations
+func MigratePositionalIds(jsonData []byte) (map[string]string, error) {
+
+	data := []*Entry{}
+	if err := json.Unmarshal(jsonData, &data); err != nil {
+		return nil, err
+	}
+	assignStableIds(data)
+	ids := map[string]string{}
+	index := 0
+	var indexer func(entries []*Entry)
+	indexer = func(entries []*Entry) {
+		for _, entry := range entries {
+			ids[fmt.Sprint(index)] = entry.Id
+			index++
+			indexer(entry.Children)
+		}
+	}
+	indexer(data)
+	return ids, nil
+}
+
+func (m JsonModel) findEntry(id string) *Entry {
+
+	return m.state.entries[id]
 }
 
 func (m JsonModel) entryToItem(entry *Entry) (Item, string) {
@@ -106,12 +371,19 @@ func (m JsonModel) entryToItem(entry *Entry) (Item, string) {
 				Title: entry.DirName,
 			}, entry.Id
 		} else if entry.isStation() {
-			return ItemStation{
+			item := ItemStation{
 				StationName:        entry.StationName,
 				StationUrl:         entry.StationUrl,
 				StationDescription: entry.StationDescription,
 				StationMime:        "MP3",
-			}, entry.Id
+				Transcode:          entry.Transcode,
+				AlternativeUrls:    entry.alternativeUrls(),
+				Tls:                entry.Tls,
+			}
+			if entry.Bitrate > 0 {
+				item.StationBandWidth = fmt.Sprint(entry.Bitrate / 1000)
+			}
+			return item, entry.Id
 		}
 	}
 	return ItemDir{}, ""
@@ -119,16 +391,20 @@ func (m JsonModel) entryToItem(entry *Entry) (Item, string) {
 
 func (m JsonModel) Data(parentId *string, index int) (Item, string) {
 
+	m.state.mutex.RLock()
+	defer m.state.mutex.RUnlock()
 	if parentId == nil {
 		// root
-		return m.entryToItem(m.data[index])
+		if index >= 0 && index < len(m.state.data) {
+			return m.entryToItem(m.state.data[index])
+		}
 	} else {
 		if index >= 0 {
 			// children
-			if entry := m.findEntry(*parentId); entry != nil {
+			if entry := m.findEntry(*parentId); entry != nil && index < len(entry.Children) {
 				return m.entryToItem(entry.Children[index])
 			} else {
-				log.Warnf("Could not find Item for parent '%s' with index %d", parentId, index)
+				log.Warnf("Could not find Item for parent '%s' with index %d", *parentId, index)
 			}
 		} else {
 			// the item with id
@@ -140,9 +416,11 @@ func (m JsonModel) Data(parentId *string, index int) (Item, string) {
 
 func (m JsonModel) Count(parentId *string) int {
 
+	m.state.mutex.RLock()
+	defer m.state.mutex.RUnlock()
 	if parentId == nil {
 		// root
-		return len(m.data)
+		return len(m.state.data)
 	} else {
 		// children
 		if entry := m.findEntry(*parentId); entry != nil {
@@ -151,3 +429,67 @@ func (m JsonModel) Count(parentId *string) int {
 	}
 	return 0
 }
+
+// The stations matching the query by name, description or the names of their dirs
+func (m JsonModel) Search(query string) []string {
+
+	m.state.mutex.RLock()
+	defer m.state.mutex.RUnlock()
+	words := searchWords(query)
+	ids := []string{}
+	var search func(entries []*Entry, dirs []string)
+	search = func(entries []*Entry, dirs []string) {
+		for _, entry := range entries {
+			if entry == nil {
+				continue
+			}
+			if entry.isDir() {
+				search(entry.Children, append(dirs, entry.DirName))
+			} else if entry.isStation() && matchesQuery(words, append(dirs, entry.StationName, entry.StationDescription)...) {
+				ids = append(ids, entry.Id)
+			}
+		}
+	}
+	search(m.state.data, []string{})
+	return ids
+}
+
+// The ids of the stations by their tags, languages or countries
+func (m JsonModel) TaggedStations(category string) map[string][]string {
+
+	m.state.mutex.RLock()
+	defer m.state.mutex.RUnlock()
+	tagged := map[string][]string{}
+	spellings := map[string]string{} // tags that only differ in case are merged (the first spelling wins)
+	var collect func(entries []*Entry)
+	collect = func(entries []*Entry) {
+		for _, entry := range entries {
+			if entry == nil {
+				continue
+			} else if entry.isDir() {
+				collect(entry.Children)
+				continue
+			} else if !entry.isStation() {
+				continue
+			}
+			tags := entry.Tags
+			switch category {
+			case StationTagCategoryLanguage:
+				tags = []string{entry.Language}
+			case StationTagCategoryCountry:
+				tags = []string{entry.Country}
+			}
+			for _, tag := range tags {
+				if tag = strings.TrimSpace(tag); len(tag) > 0 {
+					if spelling, ok := spellings[strings.ToLower(tag)]; ok {
+						tag = spelling
+					}
+					spellings[strings.ToLower(tag)] = tag
+					tagged[tag] = append(tagged[tag], entry.Id)
+				}
+			}
+		}
+	}
+	collect(m.state.data)
+	return tagged
+}
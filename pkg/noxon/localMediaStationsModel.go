@@ -0,0 +1,297 @@
+package noxon
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// Ids of local media are "media:<name>:<path relative to the directory>"
+const localMediaIdPrefix = "media:"
+
+// File types the device is able to play by extension - the formats the recorder writes (see recordingExtensions) are
+// listed so the recordings can be played
+var localMediaContentTypes = map[string]string{
+	".mp3":   "audio/mpeg",
+	".aac":   "audio/aac",
+	".ogg":   "audio/ogg",
+	".flac":  "audio/flac",
+	".audio": "application/octet-stream", // A recording of a stream of unknown type
+}
+
+// Serves the audio files of a directory tree. The root menu contains a single dir (named like the model) with the
+// content of the directory
+type LocalMediaStationsModel struct {
+	name  string
+	dir   string
+	cache *localMediaCache // Shared by the copies of the model
+}
+
+// The listings of the dirs - a listing is read again when the modification time of its dir changes
+type localMediaCache struct {
+	mutex sync.Mutex
+	dirs  map[string]localMediaDir // by relative path
+}
+
+type localMediaDir struct {
+	modTime  time.Time
+	children []localMediaEntry
+}
+
+type localMediaEntry struct {
+	name  string
+	isDir bool
+}
+
+func NewLocalMediaStationsModel(name string, dir string) LocalMediaStationsModel {
+
+	return LocalMediaStationsModel{
+		name:  name,
+		dir:   dir,
+		cache: &localMediaCache{dirs: map[string]localMediaDir{}},
+	}
+}
+
+func (m LocalMediaStationsModel) rootId() string {
+
+	return localMediaIdPrefix + m.name + ":"
+}
+
+// Returns the path relative to the directory (empty for the directory itself)
+func (m LocalMediaStationsModel) relativePath(id string) (string, bool) {
+
+	if !strings.HasPrefix(id, m.rootId()) {
+		return "", false
+	}
+	relativePath := strings.TrimPrefix(id, m.rootId())
+	if len(relativePath) == 0 {
+		return "", true
+	}
+	// Never leave the directory
+	if cleaned := path.Clean("/" + relativePath); cleaned[1:] != relativePath {
+		return "", false
+	}
+	return relativePath, true
+}
+
+// The file of the relative path - unless a symlink points outside of the directory
+func (m LocalMediaStationsModel) file(relativePath string) (string, bool) {
+
+	file := filepath.Join(m.dir, filepath.FromSlash(relativePath))
+	root, err := filepath.EvalSymlinks(m.dir)
+	if err != nil {
+		return "", false
+	}
+	resolved, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return "", false
+	}
+	if relative, err := filepath.Rel(root, resolved); err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		log.Warnf("Ignoring media file '%s' outside of the media dir", file)
+		return "", false
+	}
+	return file, true
+}
+
+// The sub dirs and playable files of a dir - dirs first
+func (m LocalMediaStationsModel) children(relativePath string) []localMediaEntry {
+
+	dir, ok := m.file(relativePath)
+	if !ok {
+		return nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		log.Warnf("Could not read media dir: %s", err.Error())
+		return nil
+	}
+	m.cache.mutex.Lock()
+	cached, ok := m.cache.dirs[relativePath]
+	m.cache.mutex.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.children
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Warnf("Could not read media dir: %s", err.Error())
+		return nil
+	}
+	children := []localMediaEntry{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		isDir := entry.IsDir()
+		if entry.Type()&os.ModeSymlink != 0 {
+			// the target decides - and has to be inside of the directory
+			file, ok := m.file(path.Join(relativePath, entry.Name()))
+			if !ok {
+				continue
+			}
+			target, err := os.Stat(file)
+			if err != nil {
+				continue
+			}
+			isDir = target.IsDir()
+		}
+		if isDir || isLocalMediaFile(entry.Name()) {
+			children = append(children, localMediaEntry{name: entry.Name(), isDir: isDir})
+		}
+	}
+	sort.SliceStable(children, func(i, j int) bool {
+		return children[i].isDir && !children[j].isDir
+	})
+	m.cache.mutex.Lock()
+	m.cache.dirs[relativePath] = localMediaDir{modTime: info.ModTime(), children: children}
+	m.cache.mutex.Unlock()
+	return children
+}
+
+func isLocalMediaFile(name string) bool {
+
+	_, ok := localMediaContentTypes[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+func (m LocalMediaStationsModel) item(relativePath string) (Item, string) {
+
+	if len(relativePath) == 0 {
+		return ItemDir{Title: m.name}, m.rootId()
+	}
+	file, ok := m.file(relativePath)
+	if !ok {
+		return ItemDir{}, ""
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return ItemDir{}, ""
+	}
+	if info.IsDir() {
+		return ItemDir{Title: info.Name()}, m.rootId() + relativePath
+	}
+	if !isLocalMediaFile(info.Name()) {
+		return ItemDir{}, ""
+	}
+	return ItemStation{
+		StationName:        strings.TrimSuffix(info.Name(), filepath.Ext(info.Name())),
+		StationDescription: m.name,
+		StationMime:        "MP3",
+		MediaFile:          file,
+		Finite:             true,
+	}, m.rootId() + relativePath
+}
+
+func (m LocalMediaStationsModel) Data(parentId *string, index int) (Item, string) {
+
+	if parentId == nil {
+		// root
+		if index == 0 {
+			return m.item("")
+		}
+	} else if relativePath, ok := m.relativePath(*parentId); ok {
+		if index >= 0 {
+			// children
+			if children := m.children(relativePath); index < len(children) {
+				return m.item(path.Join(relativePath, children[index].name))
+			}
+			log.Warnf("Could not find Item for parent '%s' with index %d", *parentId, index)
+		} else {
+			// the item with id
+			return m.item(relativePath)
+		}
+	}
+	return ItemDir{}, ""
+}
+
+func (m LocalMediaStationsModel) Count(parentId *string) int {
+
+	if parentId == nil {
+		// root
+		return 1
+	} else if relativePath, ok := m.relativePath(*parentId); ok {
+		return len(m.children(relativePath))
+	}
+	return 0
+}
+
+// The local file of the station (if it is not a stream)
+func (n *NoxonServer) mediaFile(stationId string) (string, bool) {
+
+	item, itemId := n.settings.StationsModel.Data(&stationId, -1)
+	if station, ok := item.(ItemStation); ok && len(itemId) > 0 && len(station.MediaFile) > 0 {
+		return station.MediaFile, true
+	}
+	return "", false
+}
+
+// Serves a local file. Supports Range requests so the device can seek
+func (n *NoxonServer) serveMediaFile(c *gin.Context, stationId string, mediaFile string) {
+
+	device := extractDeviceInfo(c)
+	log := log.WithField("device", device)
+
+	file, err := os.Open(mediaFile)
+	if err != nil {
+		log.Errorf("Could not open media file: %s", err.Error())
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	// The device seeks with Range requests - only the request from the start of the file is a new playback
+	if rangeHeader := c.GetHeader("Range"); len(rangeHeader) == 0 || strings.HasPrefix(strings.ReplaceAll(rangeHeader, " ", ""), "bytes=0-") {
+		startTime := time.Now()
+		n.settings.PlaybackManager.StartPlayback(device.Mac, Playback{
+			StationId: stationId,
+			StreamUrl: (&url.URL{Scheme: "file", Path: filepath.ToSlash(mediaFile)}).String(),
+			Title:     strings.TrimSuffix(info.Name(), filepath.Ext(info.Name())),
+			StartTime: startTime,
+		})
+		defer n.settings.PlaybackManager.StopPlayback(device.Mac, startTime)
+	}
+
+	log.Infof("Starting playback of media file: %s", mediaFile)
+	c.Header("Content-Type", localMediaContentTypes[strings.ToLower(filepath.Ext(mediaFile))])
+	http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), file)
+}
+
+// The files matching the query by name or the names of their dirs. Symlinked dirs are searched once
+func (m LocalMediaStationsModel) Search(query string) []string {
+
+	words := searchWords(query)
+	ids := []string{}
+	searched := map[string]bool{}
+	var search func(relativePath string)
+	search = func(relativePath string) {
+		dir, err := filepath.EvalSymlinks(filepath.Join(m.dir, filepath.FromSlash(relativePath)))
+		if err != nil || searched[dir] {
+			return
+		}
+		searched[dir] = true
+		for _, child := range m.children(relativePath) {
+			childPath := path.Join(relativePath, child.name)
+			if child.isDir {
+				search(childPath)
+			} else if matchesQuery(words, strings.TrimSuffix(childPath, path.Ext(childPath))) {
+				ids = append(ids, m.rootId()+childPath)
+			}
+		}
+	}
+	search("")
+	return ids
+}
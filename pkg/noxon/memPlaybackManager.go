@@ -0,0 +1,201 @@
+package noxon
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Keeps the playback state in memory
+type MemPlaybackManager struct {
+	mutex          sync.Mutex
+	stationTtl     time.Duration
+	historySize    int
+	deviceStations map[string]Station  // Maps mac+stationId to the resolved station
+	mirrors        map[string]string   // Maps stationIds to the station url that worked last time
+	playbacks      map[string]Playback // Maps device macs to the current playback
+	history        []HistoryEntry      // Finished playbacks - the oldest first
+	deviceHistory  PlaybackHistory     // Optional
+}
+
+// Resolved stations expire after stationTtl, only the latest historySize playbacks are kept in the history
+func NewMemPlaybackManager(stationTtl time.Duration, historySize int) *MemPlaybackManager {
+
+	return NewMemPlaybackManagerWithHistory(stationTtl, historySize, nil)
+}
+
+// Like NewMemPlaybackManager but every finished playback is added to the deviceHistory too
+func NewMemPlaybackManagerWithHistory(stationTtl time.Duration, historySize int, deviceHistory PlaybackHistory) *MemPlaybackManager {
+
+	if historySize < 0 {
+		log.Warnf("Invalid history size %d - no history is kept", historySize)
+		historySize = 0
+	}
+	return &MemPlaybackManager{
+		mutex:          sync.Mutex{},
+		stationTtl:     stationTtl,
+		historySize:    historySize,
+		deviceStations: map[string]Station{},
+		mirrors:        map[string]string{},
+		playbacks:      map[string]Playback{},
+		history:        []HistoryEntry{},
+		deviceHistory:  deviceHistory,
+	}
+}
+
+func (m *MemPlaybackManager) Station(mac string, stationId string) (Station, bool) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	station, ok := m.deviceStations[mac+stationId]
+	if ok && m.isExpired(station) {
+		delete(m.deviceStations, mac+stationId)
+		return Station{}, false
+	}
+	return station, ok
+}
+
+func (m *MemPlaybackManager) SetStation(mac string, stationId string, station Station) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// Get rid of the stations nobody asked for in a while
+	for key, deviceStation := range m.deviceStations {
+		if m.isExpired(deviceStation) {
+			delete(m.deviceStations, key)
+		}
+	}
+	m.deviceStations[mac+stationId] = station
+}
+
+func (m *MemPlaybackManager) RemoveStation(mac string, stationId string) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.deviceStations, mac+stationId)
+}
+
+func (m *MemPlaybackManager) Mirror(stationId string) string {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.mirrors[stationId]
+}
+
+func (m *MemPlaybackManager) SetMirror(stationId string, stationUrl string) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.mirrors[stationId] = stationUrl
+}
+
+func (m *MemPlaybackManager) isExpired(station Station) bool {
+
+	return station.LastUpdate.Before(time.Now().Add(-m.stationTtl))
+}
+
+func (m *MemPlaybackManager) StartPlayback(mac string, playback Playback) {
+
+	m.mutex.Lock()
+	previous, ok := m.playbacks[mac]
+	m.playbacks[mac] = playback
+	m.mutex.Unlock()
+	if ok {
+		m.addHistory(mac, previous)
+	}
+}
+
+func (m *MemPlaybackManager) UpdateTitle(mac string, startTime time.Time, title string) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if playback, ok := m.playbacks[mac]; ok && playback.StartTime.Equal(startTime) {
+		playback.Title = title
+		m.playbacks[mac] = playback
+	}
+}
+
+func (m *MemPlaybackManager) StopPlayback(mac string, startTime time.Time) {
+
+	m.mutex.Lock()
+	playback, ok := m.playbacks[mac]
+	ok = ok && (startTime.IsZero() || playback.StartTime.Equal(startTime))
+	if ok {
+		delete(m.playbacks, mac)
+	}
+	m.mutex.Unlock()
+	if ok {
+		m.addHistory(mac, playback)
+	}
+}
+
+// The deviceHistory is written outside the lock - persisting it must not block the playbacks
+func (m *MemPlaybackManager) addHistory(mac string, playback Playback) {
+
+	entry := HistoryEntry{
+		Mac:       mac,
+		StationId: playback.StationId,
+		StreamUrl: playback.StreamUrl,
+		Title:     playback.Title,
+		StartTime: playback.StartTime,
+		Duration:  time.Since(playback.StartTime),
+	}
+	m.mutex.Lock()
+	m.history = append(m.history, entry)
+	if len(m.history) > m.historySize {
+		m.history = slices.Clone(m.history[len(m.history)-m.historySize:])
+	}
+	m.mutex.Unlock()
+	if m.deviceHistory != nil {
+		m.deviceHistory.Add(entry)
+	}
+}
+
+func (m *MemPlaybackManager) Playback(mac string) (Playback, bool) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	playback, ok := m.playbacks[mac]
+	return playback, ok
+}
+
+func (m *MemPlaybackManager) Playbacks() []Playback {
+
+	m.mutex.Lock()
+	playbacks := []Playback{}
+	for _, playback := range m.playbacks {
+		playbacks = append(playbacks, playback)
+	}
+	m.mutex.Unlock()
+
+	slices.SortFunc(playbacks, func(a, b Playback) int {
+		return b.StartTime.Compare(a.StartTime)
+	})
+	return playbacks
+}
+
+func (m *MemPlaybackManager) History() []HistoryEntry {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	history := slices.Clone(m.history)
+	slices.Reverse(history)
+	return history
+}
+
+// Without a PlaybackHistory only the playbacks of the (bounded) history are returned
+func (m *MemPlaybackManager) DeviceHistory(mac string) []HistoryEntry {
+
+	if m.deviceHistory != nil {
+		return m.deviceHistory.Device(mac)
+	}
+	history := []HistoryEntry{}
+	for _, entry := range m.History() {
+		if entry.Mac == mac {
+			history = append(history, entry)
+		}
+	}
+	return history
+}
@@ -0,0 +1,167 @@
+package noxon
+
+import (
+	"time"
+)
+
+// Bitrates (kbit/s) of MPEG audio layer III by bitrate index
+var mp3Bitrates = map[bool][]int{
+	true:  {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}, // MPEG-1
+	false: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},     // MPEG-2 and MPEG-2.5
+}
+
+var mp3SampleRates = []int{44100, 48000, 32000}
+
+// The header of a MPEG audio layer III frame
+type mp3FrameHeader [4]byte
+
+// Only layer III frames with a fixed bitrate are accepted
+func parseMp3FrameHeader(data []byte) (mp3FrameHeader, bool) {
+
+	header := mp3FrameHeader{}
+	if len(data) < len(header) {
+		return header, false
+	}
+	copy(header[:], data)
+	sync := header[0] == 0xff && header[1]&0xe0 == 0xe0
+	layer3 := (header[1]>>1)&0x03 == 0x01
+	version := (header[1] >> 3) & 0x03
+	bitrateIndex := header[2] >> 4
+	sampleRateIndex := (header[2] >> 2) & 0x03
+	if !sync || !layer3 || version == 0x01 || bitrateIndex == 0 || bitrateIndex == 0x0f || sampleRateIndex == 0x03 {
+		return header, false
+	}
+	return header, true
+}
+
+func (h mp3FrameHeader) isMpeg1() bool {
+
+	return (h[1]>>3)&0x03 == 0x03
+}
+
+func (h mp3FrameHeader) sampleRate() int {
+
+	sampleRate := mp3SampleRates[(h[2]>>2)&0x03]
+	switch (h[1] >> 3) & 0x03 {
+	case 0x02:
+		// MPEG-2
+		return sampleRate / 2
+	case 0x00:
+		// MPEG-2.5
+		return sampleRate / 4
+	}
+	return sampleRate
+}
+
+// The size of the frame including the header
+func (h mp3FrameHeader) size() int {
+
+	bitrate := mp3Bitrates[h.isMpeg1()][h[2]>>4] * 1000
+	padding := int((h[2] >> 1) & 0x01)
+	if h.isMpeg1() {
+		return 144*bitrate/h.sampleRate() + padding
+	}
+	return 72*bitrate/h.sampleRate() + padding
+}
+
+func (h mp3FrameHeader) duration() time.Duration {
+
+	samples := 576
+	if h.isMpeg1() {
+		samples = 1152
+	}
+	return time.Duration(samples) * time.Second / time.Duration(h.sampleRate())
+}
+
+// A frame in the same format (version, bitrate, sample rate and channel mode) without any audio data. It has no CRC and
+// no padding, the side info and main data are all zero
+func (h mp3FrameHeader) silentFrame() []byte {
+
+	silent := h
+	silent[1] |= 0x01
+	silent[2] &^= 0x02
+	frame := make([]byte, silent.size())
+	copy(frame, silent[:])
+	return frame
+}
+
+// Splits a mp3 stream at frame boundaries so silence can be inserted between the frames. Data that doesn't look like
+// mp3 frames (e.g. an ID3 tag or a stream that isn't mp3 at all) is passed on as it is
+type mp3Framer struct {
+	pending []byte          // the incomplete frame at the end of the data
+	last    *mp3FrameHeader // the header of the last complete frame - nil if the framer lost the sync
+}
+
+// Returns the data up to the end of the last complete frame. The rest is kept until more data arrives
+func (f *mp3Framer) frames(data []byte) []byte {
+
+	data = append(f.pending, data...)
+	f.pending = nil
+	end := 0
+	if f.last == nil {
+		// find the next frame
+		end = f.sync(data)
+	}
+	for end < len(data) {
+		header, ok := parseMp3FrameHeader(data[end:])
+		if !ok && len(data)-end < len(header) {
+			break
+		} else if !ok {
+			// lost the sync - try again in the rest of the data
+			f.last = nil
+			end += f.sync(data[end:])
+			continue
+		} else if end+header.size() > len(data) {
+			break
+		}
+		end += header.size()
+		f.last = &header
+	}
+	f.pending = append([]byte{}, data[end:]...)
+	return data[:end]
+}
+
+// The offset of the first frame that is followed by another one (or the end of the data). The end of the data if
+// there is none
+func (f *mp3Framer) sync(data []byte) int {
+
+	for offset := 0; offset < len(data); offset++ {
+		header, ok := parseMp3FrameHeader(data[offset:])
+		if !ok {
+			if len(data)-offset < len(header) {
+				// the header might continue in the next data
+				return offset
+			}
+			continue
+		}
+		next := offset + header.size()
+		if next+len(header) > len(data) {
+			return offset
+		} else if _, ok := parseMp3FrameHeader(data[next:]); ok {
+			return offset
+		}
+	}
+	return len(data)
+}
+
+// Silent frames covering at least the duration in the format of the last frame. Nothing if the format is unknown
+func (f *mp3Framer) silence(duration time.Duration) []byte {
+
+	if f.last == nil {
+		return nil
+	}
+	frame := f.last.silentFrame()
+	silence := []byte{}
+	for covered := time.Duration(0); covered < duration; covered += f.last.duration() {
+		silence = append(silence, frame...)
+	}
+	return silence
+}
+
+// The incomplete data at the end of the stream
+func (f *mp3Framer) flush() []byte {
+
+	pending := f.pending
+	f.pending = nil
+	return pending
+}
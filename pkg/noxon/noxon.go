@@ -6,12 +6,13 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	b64 "encoding/base64"
 
@@ -31,6 +32,10 @@ const normalizedLoginEndpoint = "/login"
 const playbackEndpoint = "/playback"
 const healthEndpoint = "/health"
 const statusEndpoint = "/status"
+const nowPlayingEndpoint = "/api/playback"
+const playbackHistoryEndpoint = "/api/playback/history"
+const timeShiftEndpoint = "/api/timeshift"
+const recordingsEndpoint = "/api/recordings"
 const staticEndpoint = "/static"
 
 type ListOfItems struct {
@@ -58,15 +63,20 @@ type ItemDir struct {
 }
 
 type ItemStation struct {
-	XMLName            xml.Name `xml:"Item"`
-	ItemType           string   `xml:"ItemType"`
-	StationId          string   `xml:"StationId"` // Limit 32 Byte?
-	StationName        string   `xml:"StationName"`
-	StationUrl         string   `xml:"StationUrl"`
-	StationDescription string   `xml:"StationDesc"`
-	StationFormat      string   `xml:"StationFormat"`    // Public
-	StationBandWidth   string   `xml:"StationBandWidth"` // 128
-	StationMime        string   `xml:"StationMime"`      // MP3
+	XMLName            xml.Name    `xml:"Item"`
+	ItemType           string      `xml:"ItemType"`
+	StationId          string      `xml:"StationId"` // Limit 32 Byte?
+	StationName        string      `xml:"StationName"`
+	StationUrl         string      `xml:"StationUrl"`
+	StationDescription string      `xml:"StationDesc"`
+	StationFormat      string      `xml:"StationFormat"`    // Public
+	StationBandWidth   string      `xml:"StationBandWidth"` // 128
+	StationMime        string      `xml:"StationMime"`      // MP3
+	Transcode          string      `xml:"-"`                // One of TranscodeAuto, TranscodeAlways, TranscodeNever
+	AlternativeUrls    []string    `xml:"-"`                // Mirrors that are tried in order if the StationUrl fails
+	Tls                *TlsOptions `xml:"-"`                // Overrules the global TLS options
+	MediaFile          string      `xml:"-"`                // A local file that is served instead of a stream
+	Finite             bool        `xml:"-"`                // A file with an end (like a podcast episode) - not reconnected once it ended
 }
 
 type Redirect struct {
@@ -112,15 +122,70 @@ type StationsModel interface {
 	Count(parentId *string) int
 }
 
+// Optional interface of a StationsModel that shows every device its own view
+type DeviceStationsModel interface {
+	ForDevice(mac string) StationsModel
+	// Invoked when the device starts playing the station
+	Played(mac string, stationId string)
+}
+
+// Optional interface of a StationsModel that supports the free-text search of the device
+type Searcher interface {
+	// The ids of the stations matching the query (see matchesQuery)
+	Search(query string) []string
+}
+
+// Optional interface of a StationsModel with tagged stations (see SmartFoldersStationsModel)
+type TaggedStationsModel interface {
+	// The ids of the stations by tag. The category is one of the StationTagCategory constants
+	TaggedStations(category string) map[string][]string
+}
+
 type PresetModel interface {
 	WritePreset(presetKey string, stationId string) error
 	GetPreset(presetKey string) string
 }
 
+// The PlaybackManager keeps track of what the devices are playing
+type PlaybackManager interface {
+	// The resolved station (stream url) a device played last. Expired stations are not returned
+	Station(mac string, stationId string) (Station, bool)
+	SetStation(mac string, stationId string, station Station)
+	RemoveStation(mac string, stationId string)
+	// The station url or mirror of the station that worked last time (for all devices). Survives RemoveStation and the
+	// expiry of the stations
+	Mirror(stationId string) string
+	SetMirror(stationId string, stationUrl string)
+	StartPlayback(mac string, playback Playback)
+	// Only updates the playback that started at startTime
+	UpdateTitle(mac string, startTime time.Time, title string)
+	// Stops the playback that started at startTime (any playback of the device if startTime is zero)
+	StopPlayback(mac string, startTime time.Time)
+	Playback(mac string) (Playback, bool)
+	// Active playbacks - the latest first
+	Playbacks() []Playback
+	// Finished playbacks - the latest first
+	History() []HistoryEntry
+	// Finished playbacks of the device - the latest first
+	DeviceHistory(mac string) []HistoryEntry
+}
+
+// Keeps the finished playbacks of every device (e.g. across restarts)
+type PlaybackHistory interface {
+	Add(entry HistoryEntry)
+	// The latest first
+	Device(mac string) []HistoryEntry
+}
+
 type NoxonServer struct {
 	engine      *gin.Engine
 	settings    NoxonServerSettings
 	presetMutex sync.Mutex
+	hub         *streamHub
+	transports  *upstreamTransports
+	timeShifts  *timeShifts
+	recorder    *recorder
+	routesOnce  sync.Once
 }
 
 type encryptedToken struct {
@@ -134,6 +199,10 @@ func NewNoxonServer(settings NoxonServerSettings) *NoxonServer {
 		engine:      gin.New(),
 		settings:    settings,
 		presetMutex: sync.Mutex{},
+		hub:         newStreamHub(settings.PlaybackManager),
+		transports:  newUpstreamTransports(),
+		timeShifts:  newTimeShifts(settings.TimeShift),
+		recorder:    newRecorder(),
 	}
 }
 
@@ -172,12 +241,41 @@ func min(one int, two int) int {
 	return two
 }
 
+// The gin context key of the stations model of the request
+const stationsModelKey = "noxon.stationsModel"
+
+// The stations model as seen by the device. It is built once per request so all items of a response are consistent
+// (e.g. the "Resume" station of the time-shift might appear or vanish in the meantime)
+func (n *NoxonServer) stationsModel(c *gin.Context) StationsModel {
+
+	if model, ok := c.Get(stationsModelKey); ok {
+		return model.(StationsModel)
+	}
+	model := n.deviceStationsModel(c)
+	c.Set(stationsModelKey, model)
+	return model
+}
+
+func (n *NoxonServer) deviceStationsModel(c *gin.Context) StationsModel {
+
+	device := extractDeviceInfo(c)
+	model := n.settings.StationsModel
+	if deviceModel, ok := model.(DeviceStationsModel); ok {
+		model = deviceModel.ForDevice(device.Mac)
+	}
+	if n.settings.TimeShift.Enabled {
+		model = n.timeShiftModel(device.Mac, model)
+	}
+	return model
+}
+
 func (n *NoxonServer) CollectFromModel(c *gin.Context, parent *string, start int, end int) (ret []Item) {
 
-	count := n.settings.StationsModel.Count(parent)
+	model := n.stationsModel(c)
+	count := model.Count(parent)
 	trueEnd := min(end+1, count)
 	for i := start; i < trueEnd; i++ {
-		item, id := n.settings.StationsModel.Data(parent, i)
+		item, id := model.Data(parent, i)
 		if len(id) == 0 {
 			log.Warn("Got invalid Item id")
 		}
@@ -233,18 +331,14 @@ func (n *NoxonServer) authMiddleware(c *gin.Context) {
 func (n *NoxonServer) handleLoginEndpoint(c *gin.Context) {
 
 	log := log.WithField("device", extractDeviceInfo(c))
-	firstItem, _ := strconv.Atoi(c.DefaultQuery("startitems", "1"))
-	lastItem, _ := strconv.Atoi(c.DefaultQuery("enditems", fmt.Sprintf("%d", firstItem+99)))
-	// Those crazy noxon people start count with 1 - we correct that
-	firstItem--
-	lastItem--
+	firstItem, lastItem := requestedItems(c)
 	if token := c.Query("token"); len(token) > 0 {
 		log.Debug("Login request")
 		c.XML(http.StatusOK, encryptedToken{Token: macObfuscate})
 	} else if gofile := c.Query("gofile"); gofile == "" {
 		// Request the root menu (No pagination is happening here)
 		log.Debug("Root menu request")
-		rootItemsCount := n.settings.StationsModel.Count(nil)
+		rootItemsCount := n.stationsModel(c).Count(nil)
 		if rootItemsCount > 0 {
 			ItemList := ListOfItems{
 				ItemCount: rootItemsCount,
@@ -265,7 +359,7 @@ func (n *NoxonServer) handleLoginEndpoint(c *gin.Context) {
 		} else {
 			itemIdString := itemIdString
 			ItemList := ListOfItems{
-				ItemCount: n.settings.StationsModel.Count(&itemIdString),
+				ItemCount: n.stationsModel(c).Count(&itemIdString),
 				Items:     n.CollectFromModel(c, &itemIdString, firstItem, lastItem),
 			}
 			writeXmlResponse(c, ItemList)
@@ -275,21 +369,25 @@ func (n *NoxonServer) handleLoginEndpoint(c *gin.Context) {
 	}
 }
 
-// It seems like the device only requests stations here (not dirs)
+// The range of items the device requested (the index of the first and last item)
+func requestedItems(c *gin.Context) (int, int) {
+
+	firstItem, _ := strconv.Atoi(c.DefaultQuery("startitems", "1"))
+	lastItem, _ := strconv.Atoi(c.DefaultQuery("enditems", fmt.Sprintf("%d", firstItem+99)))
+	// Those crazy noxon people start count with 1 - we correct that
+	return firstItem - 1, lastItem - 1
+}
+
+// The device requests stations here (not dirs) - either by id or by the text the user entered
 // Thats handy because dirs need an absolute url pointing to the login endpoint (and we don't know the devices login endpoint)
 func (n *NoxonServer) handleSearchEndpoint(c *gin.Context) {
 
 	log := log.WithField("device", extractDeviceInfo(c))
-	if searchId := c.Query("Search"); searchId != "" {
-		itemId, err := b64.URLEncoding.DecodeString(searchId)
-		itemIdString := string(itemId)
-		log.Debugf("Search request for itemId %s", itemIdString)
-		if err != nil {
-			log.Errorf("Could not decode itemId: %s", err.Error())
-			c.AbortWithStatus(http.StatusBadRequest)
-		} else {
-			stationItem, stationItemId := n.settings.StationsModel.Data(&itemIdString, -1)
-			if len(stationItemId) > 0 {
+	if query := c.Query("Search"); query != "" {
+		model := n.stationsModel(c)
+		if itemIdString, ok := decodeSearchId(query); ok {
+			if stationItem, stationItemId := model.Data(&itemIdString, -1); len(stationItemId) > 0 {
+				log.Debugf("Search request for itemId %s", itemIdString)
 				if _, ok := stationItem.(ItemStation); ok {
 					ItemList := ListOfItems{
 						ItemCount: -1,
@@ -300,23 +398,67 @@ func (n *NoxonServer) handleSearchEndpoint(c *gin.Context) {
 					log.Errorf("The requested item is not a station (id: %s) - did the model change?", itemIdString)
 					c.AbortWithStatus(http.StatusNotFound)
 				}
-			} else {
-				log.Errorf("A non existing item (id: %s) was requested", itemIdString)
-				c.AbortWithStatus(http.StatusNotFound)
+				return
 			}
 		}
+		// Not the id of an item - so it is a text the user entered (searched as entered, never decoded)
+		n.searchStations(c, model, query)
 	} else {
 		c.AbortWithStatus(http.StatusNotFound)
 	}
 }
 
+// The id of an item if the query is the StationId of an item (see ItemStation.build). Only the exact encoding we hand
+// out counts - a text like "jazz" is valid base64 too but doesn't decode to UTF-8
+func decodeSearchId(query string) (string, bool) {
+
+	itemId, err := b64.URLEncoding.DecodeString(query)
+	if err != nil || !utf8.Valid(itemId) || b64.URLEncoding.EncodeToString(itemId) != query {
+		return "", false
+	}
+	return string(itemId), true
+}
+
+// Lists the stations matching the query (paginated like the submenus)
+func (n *NoxonServer) searchStations(c *gin.Context, model StationsModel, query string) {
+
+	log := log.WithField("device", extractDeviceInfo(c))
+	firstItem, lastItem := requestedItems(c)
+	log.Debugf("Text search for '%s' (%d - %d)", query, firstItem, lastItem)
+	searcher, ok := model.(Searcher)
+	if !ok {
+		writeMessageResponse(c, "Search is not supported")
+		return
+	}
+	ids := searcher.Search(query)
+	if len(ids) == 0 {
+		writeMessageResponse(c, "No stations found")
+		return
+	}
+	if firstItem < 0 {
+		firstItem = 0
+	}
+	items := []Item{}
+	for i := firstItem; i <= lastItem && i < len(ids); i++ {
+		item, id := model.Data(&ids[i], -1)
+		if len(id) == 0 {
+			log.Warn("Got invalid Item id")
+			continue
+		}
+		items = append(items, item.build(c, id))
+	}
+	ItemList := ListOfItems{
+		ItemCount: len(ids),
+		Items:     items,
+	}
+	writeXmlResponse(c, ItemList)
+}
+
 func (n *NoxonServer) handleAddPresetEndpoint(c *gin.Context) {
 
 	device := extractDeviceInfo(c)
 	log := log.WithField("device", device)
-	mutex.Lock()
-	currentPlayback, hasCurrentPlayback := playbackTracker[device.Mac]
-	mutex.Unlock()
+	currentPlayback, hasCurrentPlayback := n.settings.PlaybackManager.Playback(device.Mac)
 	if presetIndex := c.Query("id"); presetIndex != "" && hasCurrentPlayback {
 
 		log.Infof("Saving stationId %s to preset %s", currentPlayback.StationId, presetIndex)
@@ -345,7 +487,7 @@ func (n *NoxonServer) handleGetPresetEndpoint(c *gin.Context) {
 		stationId := n.settings.PresetsModel.GetPreset(device.Mac + "-" + presetIndex)
 		n.presetMutex.Unlock()
 
-		stationItem, stationItemId := n.settings.StationsModel.Data(&stationId, -1)
+		stationItem, stationItemId := n.stationsModel(c).Data(&stationId, -1)
 		if len(stationItemId) > 0 {
 			ItemList := ListOfItems{
 				ItemCount: -1,
@@ -361,20 +503,41 @@ func (n *NoxonServer) handleGetPresetEndpoint(c *gin.Context) {
 }
 
 type Station struct {
-	StreamUrl  string
-	LastUpdate time.Time
+	StationUrl  string // The station url (or mirror) the stream was resolved from
+	StreamUrl   string
+	Hls         bool
+	Finite      bool // The stream ends on its own (see ItemStation)
+	ContentType string
+	Transcode   string
+	Bandwidth   int // The preferred bandwidth (bit/s) of HLS streams - 0 for the HlsBandwidth setting
+	Tls         TlsOptions
+	LastUpdate  time.Time
+}
+
+// The bandwidth (bit/s) the station declares in StationBandWidth (kbit/s) - 0 if unknown
+func stationBandwidth(item ItemStation) int {
+
+	if bandwidth, err := strconv.Atoi(strings.TrimSpace(item.StationBandWidth)); err == nil && bandwidth > 0 {
+		return bandwidth * 1000
+	}
+	return 0
 }
 
 type Playback struct {
-	StreamUrl string
-	StationId string
-	StartTime time.Time
+	StreamUrl string    `json:"streamUrl"`
+	StationId string    `json:"stationId"`
+	Title     string    `json:"title"` // The StreamTitle of the ICY metadata (if provided by the broadcaster)
+	StartTime time.Time `json:"startTime"`
 }
 
-var mutex = sync.Mutex{}
-var deviceStations = map[string]Station{}   // Maps mac+stationId to stream url's. We need this because the stream url (from the model) might be redirected (and then differs from the model)
-var playbackTracker = map[string]Playback{} // Maps Device macs with the current playback
-var proxyHistory = map[string]string{}      // History of all proxy reqests
+type HistoryEntry struct {
+	Mac       string        `json:"mac"`
+	StationId string        `json:"stationId"`
+	StreamUrl string        `json:"streamUrl"`
+	Title     string        `json:"title"` // The last StreamTitle
+	StartTime time.Time     `json:"startTime"`
+	Duration  time.Duration `json:"duration"`
+}
 
 func (n *NoxonServer) handlePlaybackEndpoint(c *gin.Context) {
 
@@ -388,91 +551,79 @@ func (n *NoxonServer) handlePlaybackEndpoint(c *gin.Context) {
 		if err != nil {
 			log.Errorf("Could not decode stationId: %s", err.Error())
 			c.AbortWithStatus(http.StatusBadRequest)
+		} else if strings.HasPrefix(stationIdString, timeShiftIdPrefix) {
+			n.serveTimeShift(c, strings.TrimPrefix(stationIdString, timeShiftIdPrefix))
+		} else if mediaFile, ok := n.mediaFile(stationIdString); ok {
+			n.serveMediaFile(c, stationIdString, mediaFile)
 		} else {
-			deviceStationKey := device.Mac + stationIdString
-			mutex.Lock()
-			deviceStation, hasDeviceStation := deviceStations[deviceStationKey]
-			reloadDeviceStation := !hasDeviceStation
-			// reload the playback url of the station IF the url already exists AND IF it is older than one hour
-			if hasDeviceStation && deviceStation.LastUpdate.Before(time.Now().Add(-time.Hour)) {
-				reloadDeviceStation = true
-			}
-			mutex.Unlock()
-			if reloadDeviceStation {
-				// request the original url from the model
-				stationItem, stationItemId := n.settings.StationsModel.Data(&stationIdString, -1)
-				if station, ok := stationItem.(ItemStation); ok && len(stationItemId) > 0 {
-					deviceStation = Station{
-						StreamUrl:  station.StationUrl,
-						LastUpdate: time.Now(),
+			// We cache the stream url because it might be redirected (and then differs from the model). The cache
+			// expires so the url gets reloaded from time to time
+			playbacks := n.settings.PlaybackManager
+			failedUrls := []string{}
+			for {
+				deviceStation, hasDeviceStation := playbacks.Station(device.Mac, stationIdString)
+				if !hasDeviceStation {
+					// request the original url from the model
+					// start with the mirror that worked last time and skip the ones that failed in this request
+					station, resolved, err := n.resolveStation(n.stationsModel(c), stationIdString, playbacks.Mirror(stationIdString), failedUrls...)
+					if err != nil && len(failedUrls) > 0 {
+						log.Errorf("No mirror of the station left: %s", err.Error())
+						c.AbortWithStatus(http.StatusBadGateway)
+						return
+					} else if err != nil {
+						log.Errorf("Could not resolve station: %s", err.Error())
+						c.AbortWithStatus(http.StatusNotFound)
+						return
+					}
+					deviceStation = station
+					if resolved {
+						playbacks.SetStation(device.Mac, stationIdString, deviceStation)
+						playbacks.SetMirror(stationIdString, deviceStation.StationUrl)
 					}
-					mutex.Lock()
-					deviceStations[deviceStationKey] = deviceStation
-					mutex.Unlock()
-				} else {
-					log.Errorf("A non existing item (id: %s) was requested", stationItemId)
-					c.AbortWithStatus(http.StatusNotFound)
-					return
 				}
-			}
 
-			if remote, err := url.Parse(deviceStation.StreamUrl); err != nil || len(deviceStation.StreamUrl) == 0 {
-				log.Errorf("Could not parse streamUrl: %s (%v)", deviceStation.StreamUrl, err)
-				c.AbortWithStatus(http.StatusInternalServerError)
-			} else {
-				proxy := httputil.NewSingleHostReverseProxy(remote)
-				proxy.Director = func(req *http.Request) {
-					req.Header = c.Request.Header
-					req.Host = remote.Host
-					req.URL = remote
+				if _, err := url.Parse(deviceStation.StreamUrl); err != nil || len(deviceStation.StreamUrl) == 0 {
+					log.Errorf("Could not parse streamUrl: %s (%v)", deviceStation.StreamUrl, err)
+					c.AbortWithStatus(http.StatusInternalServerError)
+					return
 				}
-				proxy.ModifyResponse = func(r *http.Response) error {
-					if r.StatusCode == http.StatusMovedPermanently || r.StatusCode == http.StatusFound || r.StatusCode == http.StatusPermanentRedirect || r.StatusCode == http.StatusTemporaryRedirect {
-						log.Info("Got redirect request")
-						if newStreamUrl := r.Header["Location"]; len(newStreamUrl) > 0 {
-							return &Redirect{
-								Location: newStreamUrl[0],
-							}
-						} else {
-							return fmt.Errorf("missing new redirect location")
-						}
-					}
-					return nil
+				forwardRedirect := func(redirect *Redirect) {
+					log.Infof("Forwarding redirect to new location %s", redirect.Location)
+					playbacks.SetStation(device.Mac, stationIdString, Station{
+						StationUrl: deviceStation.StationUrl,
+						StreamUrl:  redirect.Location,
+						Transcode:  deviceStation.Transcode,
+						Bandwidth:  deviceStation.Bandwidth,
+						Tls:        deviceStation.Tls,
+						LastUpdate: time.Now(),
+					})
+					c.Redirect(http.StatusFound, buildPlaybackUrl(c, stationIdString))
 				}
-				proxy.ErrorHandler = func(rw http.ResponseWriter, r *http.Request, err error) {
-
-					if redirect, ok := err.(*Redirect); ok {
-						log.Infof("Forwarding redirect to new location %s", redirect.Location)
-						mutex.Lock()
-						deviceStations[deviceStationKey] = Station{
-							StreamUrl:  redirect.Location,
-							LastUpdate: time.Now(),
-						}
-						mutex.Unlock()
-						http.Redirect(rw, r, buildPlaybackUrl(c, stationIdString), http.StatusFound)
-					} else {
-						log.Errorf("Proxy error: %s", err.Error())
-						rw.WriteHeader(http.StatusBadGateway)
-					}
+				updateStreamUrl := func(streamUrl string) {
+					log.Infof("Stream url %s moved to %s", deviceStation.StreamUrl, streamUrl)
+					movedStation := deviceStation
+					movedStation.StreamUrl = streamUrl
+					movedStation.LastUpdate = time.Now()
+					playbacks.SetStation(device.Mac, stationIdString, movedStation)
 				}
 
-				mutex.Lock()
-				// Device starts playback
-				playbackTracker[device.Mac] = Playback{
-					StationId: stationIdString,
-					StreamUrl: deviceStation.StreamUrl,
-					StartTime: time.Now(),
+				played := func() {
+					// only stations that could be opened are remembered
+					if model, ok := n.settings.StationsModel.(DeviceStationsModel); ok {
+						model.Played(device.Mac, stationIdString)
+					}
 				}
-				proxyHistory[remote.String()] = device.Mac
-				mutex.Unlock()
 
-				log.Infof("Starting proxy for target url: %s", remote.String())
-				proxy.ServeHTTP(c.Writer, c.Request)
-
-				mutex.Lock()
-				// Device stops playback
-				delete(playbackTracker, device.Mac)
-				mutex.Unlock()
+				log.Infof("Starting playback of stream url: %s", deviceStation.StreamUrl)
+				if err := n.serveStream(c, stationIdString, deviceStation, forwardRedirect, updateStreamUrl, played); err == nil {
+					return
+				}
+				// resolve the station again and fall over to the next mirror. A cached stream url might just be
+				// outdated - the station url is only skipped if it failed right after resolving it
+				playbacks.RemoveStation(device.Mac, stationIdString)
+				if !hasDeviceStation {
+					failedUrls = append(failedUrls, deviceStation.StationUrl)
+				}
 			}
 		}
 	} else {
@@ -480,31 +631,99 @@ func (n *NoxonServer) handlePlaybackEndpoint(c *gin.Context) {
 	}
 }
 
-func (n *NoxonServer) handleStatusEndpoint(c *gin.Context) {
+// Requests the station url from the model (of the device) and resolves playlists. The mirrors of the station are tried in order if the
+// station url is not reachable or doesn't serve audio - starting with preferredUrl if it is still one of them. The
+// failedUrls are skipped. If no stream could be resolved the station url is used as it is (resolved is false then)
+func (n *NoxonServer) resolveStation(model StationsModel, stationId string, preferredUrl string, failedUrls ...string) (station Station, resolved bool, err error) {
 
-	sortedPlaybackTracker := []Playback{}
-	for _, p := range playbackTracker {
-		sortedPlaybackTracker = append(sortedPlaybackTracker, p)
+	stationItem, stationItemId := model.Data(&stationId, -1)
+	item, ok := stationItem.(ItemStation)
+	if !ok || len(stationItemId) == 0 {
+		return station, false, fmt.Errorf("a non existing item (id: %s) was requested", stationId)
 	}
 
-	slices.SortFunc(sortedPlaybackTracker,
-		func(a, b Playback) int {
-			return b.StartTime.Compare(a.StartTime)
-		})
+	tlsOptions := n.settings.Tls.merge(item.Tls)
+	if _, err := n.transports.get(tlsOptions); err != nil {
+		return station, false, fmt.Errorf("invalid TLS options: %w", err)
+	}
 
-	sortedProxyHistory := []string{}
-	for url, _ := range proxyHistory {
-		sortedProxyHistory = append(sortedProxyHistory, url)
+	stationUrls := []string{}
+	for _, stationUrl := range append([]string{item.StationUrl}, item.AlternativeUrls...) {
+		if !slices.Contains(failedUrls, stationUrl) {
+			stationUrls = append(stationUrls, stationUrl)
+		}
+	}
+	if len(stationUrls) == 0 {
+		return station, false, fmt.Errorf("all urls of station %s failed", stationId)
+	}
+	for i, stationUrl := range stationUrls {
+		if i > 0 && stationUrl == preferredUrl {
+			stationUrls = append([]string{stationUrl}, append(stationUrls[:i:i], stationUrls[i+1:]...)...)
+			break
+		}
 	}
 
-	slices.Sort(sortedProxyHistory)
+	for _, stationUrl := range stationUrls {
+		urlTlsOptions := tlsOptions.forUrl(stationUrl)
+		client, err := n.upstreamClient(urlTlsOptions, playlistTimeout, true)
+		if err != nil {
+			return station, false, fmt.Errorf("invalid TLS options: %w", err)
+		}
+		// the station url might point to a playlist (m3u, pls, ...) instead of a stream
+		if stream, err := resolvePlaylistUrl(stationUrl, client); err != nil {
+			log.Warnf("Could not resolve stream of station url %s: %s", stationUrl, err.Error())
+		} else {
+			if stream.Url != stationUrl {
+				log.Infof("Resolved playlist %s to stream url %s", stationUrl, stream.Url)
+			}
+			return Station{
+				StationUrl:  stationUrl,
+				StreamUrl:   stream.Url,
+				Hls:         stream.Hls,
+				Finite:      item.Finite,
+				ContentType: stream.ContentType,
+				Transcode:   item.Transcode,
+				Bandwidth:   stationBandwidth(item),
+				Tls:         urlTlsOptions,
+				LastUpdate:  time.Now(),
+			}, true, nil
+		}
+	}
+	if slices.Contains(failedUrls, item.StationUrl) {
+		return station, false, fmt.Errorf("no other url of station %s is reachable", stationId)
+	}
+	return Station{
+		StationUrl: item.StationUrl,
+		StreamUrl:  item.StationUrl,
+		Finite:     item.Finite,
+		Transcode:  item.Transcode,
+		Bandwidth:  stationBandwidth(item),
+		Tls:        tlsOptions.forUrl(item.StationUrl),
+		LastUpdate: time.Now(),
+	}, false, nil
+}
+
+func isRedirect(statusCode int) bool {
+
+	return statusCode == http.StatusMovedPermanently || statusCode == http.StatusFound || statusCode == http.StatusSeeOther || statusCode == http.StatusPermanentRedirect || statusCode == http.StatusTemporaryRedirect
+}
+
+func (n *NoxonServer) handleStatusEndpoint(c *gin.Context) {
 
-	mutex.Lock()
 	c.HTML(http.StatusOK, "status.html", gin.H{
-		"playbackTracker": sortedPlaybackTracker,
-		"proxyHistory":    sortedProxyHistory,
+		"playbackTracker": n.settings.PlaybackManager.Playbacks(),
+		"history":         n.settings.PlaybackManager.History(),
 	})
-	mutex.Unlock()
+}
+
+func (n *NoxonServer) handleNowPlayingEndpoint(c *gin.Context) {
+
+	c.JSON(http.StatusOK, n.settings.PlaybackManager.Playbacks())
+}
+
+func (n *NoxonServer) handlePlaybackHistoryEndpoint(c *gin.Context) {
+
+	c.JSON(http.StatusOK, n.settings.PlaybackManager.History())
 }
 
 func (n *NoxonServer) handleHealthEndpoint(c *gin.Context) {
@@ -528,10 +747,8 @@ func (n *NoxonServer) handleRecovery(c *gin.Context, err any) {
 
 	device := extractDeviceInfo(c)
 	if err != nil && err == http.ErrAbortHandler {
-		mutex.Lock()
 		// Device stops playback
-		delete(playbackTracker, device.Mac)
-		mutex.Unlock()
+		n.settings.PlaybackManager.StopPlayback(device.Mac, time.Time{})
 	}
 }
 
@@ -559,9 +776,15 @@ func writeXmlResponse(c *gin.Context, xmlStruct any) {
 	}
 }
 
-func (n *NoxonServer) StartAndServe() {
+// The handler of all endpoints. StartAndServe serves it on port 80 - tests can use it without a listening server
+func (n *NoxonServer) Handler() http.Handler {
+
+	n.routesOnce.Do(n.setupRoutes)
+	return n.engine
+}
+
+func (n *NoxonServer) setupRoutes() {
 
-	log.Infof("Starting noxon server")
 	n.engine.SetHTMLTemplate(template.Must(template.New("").ParseFS(embeddedTemplates, "*")))
 	n.engine.StaticFS(staticEndpoint, http.FS(embeddedStatic))
 	n.engine.Use(ginlogrus.Logger(log.WithFields(log.Fields{})))
@@ -583,6 +806,25 @@ func (n *NoxonServer) StartAndServe() {
 	n.engine.GET(playbackEndpoint, n.handlePlaybackEndpoint)
 	n.engine.GET(healthEndpoint, n.handleHealthEndpoint)
 	n.engine.GET(statusEndpoint, n.handleStatusEndpoint)
+	n.engine.GET(nowPlayingEndpoint, n.handleNowPlayingEndpoint)
+	n.engine.GET(playbackHistoryEndpoint, n.handlePlaybackHistoryEndpoint)
+	n.engine.GET(timeShiftEndpoint, n.handleTimeShiftEndpoint)
+	if n.settings.Recording.Enabled {
+		n.engine.GET(recordingsEndpoint, n.handleListRecordingsEndpoint)
+		n.engine.POST(recordingsEndpoint, n.handleStartRecordingEndpoint)
+		n.engine.GET(recordingsEndpoint+"/:name", n.handleDownloadRecordingEndpoint)
+		n.engine.POST(recordingsEndpoint+"/:name/stop", n.handleStopRecordingEndpoint)
+		n.engine.DELETE(recordingsEndpoint+"/:name", n.handleDeleteRecordingEndpoint)
+	}
 	n.engine.GET("/favicon.ico", func(ctx *gin.Context) { ctx.Redirect(http.StatusMovedPermanently, staticEndpoint+"/favicon.ico") })
+}
+
+func (n *NoxonServer) StartAndServe() {
+
+	log.Infof("Starting noxon server")
+	n.Handler()
+	if n.settings.Recording.Enabled {
+		go n.runRecordingSchedule()
+	}
 	n.engine.Run("0.0.0.0:80")
 }
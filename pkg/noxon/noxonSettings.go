@@ -1,5 +1,19 @@
 package noxon
 
+import "time"
+
+// Controls how the server reacts if the connection to a broadcaster gets lost during playback
+type ReconnectSettings struct {
+	// Reconnect transparently instead of ending the playback
+	Enabled bool
+	// Reconnect attempts in a row before the playback ends
+	Retries int
+	// Resolve the station url again (via the StationsModel) before reconnecting
+	Reresolve bool
+	// Send silence to the device while the stream stalls (only mp3 streams)
+	Silence bool
+}
+
 type NoxonServerSettings struct {
 	PresetsModel        PresetModel
 	StationsModel       StationsModel
@@ -9,6 +23,14 @@ type NoxonServerSettings struct {
 	SearchEndpoints     []string
 	GetPresetsEndpoints []string
 	AddPresetsEndpoints []string
+	HlsBandwidth        int
+	Transcoder          Transcoder
+	Reconnect           ReconnectSettings
+	PlaybackManager     PlaybackManager
+	DeviceRedirects     bool // Forward redirects of the upstream to the device instead of following them
+	Tls                 TlsOptions
+	TimeShift           TimeShiftSettings
+	Recording           RecordingSettings
 }
 
 func NewDefaultNoxonServerSettings() NoxonServerSettings {
@@ -22,6 +44,27 @@ func NewDefaultNoxonServerSettings() NoxonServerSettings {
 		SearchEndpoints:     []string{},
 		GetPresetsEndpoints: []string{},
 		AddPresetsEndpoints: []string{},
+		HlsBandwidth:        128000,
+		Transcoder:          NewPassThroughTranscoder(),
+		Reconnect: ReconnectSettings{
+			Enabled:   false,
+			Retries:   5,
+			Reresolve: true,
+			Silence:   true,
+		},
+		PlaybackManager: NewMemPlaybackManager(time.Hour, 100),
+		DeviceRedirects: false,
+		Tls:             TlsOptions{},
+		TimeShift: TimeShiftSettings{
+			Enabled:  false,
+			Duration: 30 * time.Minute,
+			Dir:      "",
+		},
+		Recording: RecordingSettings{
+			Enabled:  false,
+			Dir:      "recordings",
+			Schedule: []RecordingSchedule{},
+		},
 	}
 }
 
@@ -72,3 +115,51 @@ func (s NoxonServerSettings) WithAddPresetsEndpoints(list []string) NoxonServerS
 	s.AddPresetsEndpoints = list
 	return s
 }
+
+func (s NoxonServerSettings) WithHlsBandwidth(bandwidth int) NoxonServerSettings {
+
+	s.HlsBandwidth = bandwidth
+	return s
+}
+
+func (s NoxonServerSettings) WithTranscoder(transcoder Transcoder) NoxonServerSettings {
+
+	s.Transcoder = transcoder
+	return s
+}
+
+func (s NoxonServerSettings) WithReconnect(reconnect ReconnectSettings) NoxonServerSettings {
+
+	s.Reconnect = reconnect
+	return s
+}
+
+func (s NoxonServerSettings) WithPlaybackManager(manager PlaybackManager) NoxonServerSettings {
+
+	s.PlaybackManager = manager
+	return s
+}
+
+func (s NoxonServerSettings) WithDeviceRedirects(enabled bool) NoxonServerSettings {
+
+	s.DeviceRedirects = enabled
+	return s
+}
+
+func (s NoxonServerSettings) WithTls(options TlsOptions) NoxonServerSettings {
+
+	s.Tls = options
+	return s
+}
+
+func (s NoxonServerSettings) WithTimeShift(timeShift TimeShiftSettings) NoxonServerSettings {
+
+	s.TimeShift = timeShift
+	return s
+}
+
+func (s NoxonServerSettings) WithRecording(recording RecordingSettings) NoxonServerSettings {
+
+	s.Recording = recording
+	return s
+}
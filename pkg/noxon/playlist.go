@@ -0,0 +1,381 @@
+package noxon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type playlistFormat int
+
+const (
+	playlistNone playlistFormat = iota
+	playlistM3U
+	playlistPLS
+	playlistASX
+	playlistXSPF
+)
+
+const maxPlaylistSize = 1 << 20
+const maxPlaylistDepth = 5
+
+type playlistEntry struct {
+	Url   string
+	Title string
+	Group string // Only m3u (group-title or #EXTGRP)
+}
+
+// The stream a station url resolves to
+type resolvedStream struct {
+	Url         string
+	Hls         bool
+	ContentType string
+}
+
+const playlistTimeout = 10 * time.Second
+
+var playlistContentTypes = map[string]playlistFormat{
+	"audio/x-mpegurl":               playlistM3U,
+	"audio/mpegurl":                 playlistM3U,
+	"application/x-mpegurl":         playlistM3U,
+	"application/vnd.apple.mpegurl": playlistM3U,
+	"audio/x-scpls":                 playlistPLS,
+	"application/pls+xml":           playlistPLS,
+	"video/x-ms-asx":                playlistASX,
+	"video/x-ms-wvx":                playlistASX,
+	"audio/x-ms-wax":                playlistASX,
+	"application/x-ms-asx":          playlistASX,
+	"application/xspf+xml":          playlistXSPF,
+}
+
+var playlistExtensions = map[string]playlistFormat{
+	".m3u":  playlistM3U,
+	".m3u8": playlistM3U,
+	".pls":  playlistPLS,
+	".asx":  playlistASX,
+	".wax":  playlistASX,
+	".wvx":  playlistASX,
+	".xspf": playlistXSPF,
+}
+
+// Detects the playlist format by the content type of the response and falls back to the extension of the url
+// (lots of broadcasters serve their playlists as text/plain or application/octet-stream)
+func detectPlaylistFormat(contentType string, playlistUrl *url.URL) playlistFormat {
+
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if format, ok := playlistContentTypes[strings.ToLower(mediaType)]; ok {
+			return format
+		}
+		if strings.HasPrefix(mediaType, "audio/") || strings.HasPrefix(mediaType, "video/") {
+			// An actual stream - never guess by extension here
+			return playlistNone
+		}
+	}
+	if playlistUrl != nil {
+		if format, ok := playlistExtensions[strings.ToLower(path.Ext(playlistUrl.Path))]; ok {
+			return format
+		}
+	}
+	return playlistNone
+}
+
+// Error pages and api responses of dead mirrors. Everything else (including unknown content types) might be a stream
+func isAudioContentType(contentType string) bool {
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	mediaType = strings.ToLower(mediaType)
+	switch mediaType {
+	case "application/json", "application/xml", "application/xhtml+xml":
+		return false
+	}
+	return !strings.HasPrefix(mediaType, "text/")
+}
+
+func parsePlaylist(format playlistFormat, data []byte, base *url.URL) (entries []playlistEntry, err error) {
+
+	switch format {
+	case playlistM3U:
+		entries = parseM3U(data)
+	case playlistPLS:
+		entries = parsePLS(data)
+	case playlistASX:
+		entries, err = parseASX(data)
+	case playlistXSPF:
+		entries, err = parseXSPF(data)
+	default:
+		return nil, fmt.Errorf("unknown playlist format")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Make relative entries absolute
+	resolved := []playlistEntry{}
+	for _, entry := range entries {
+		if entryUrl, err := url.Parse(strings.TrimSpace(entry.Url)); err != nil {
+			log.Warnf("Skipping invalid playlist entry '%s': %s", entry.Url, err.Error())
+		} else {
+			if base != nil {
+				entryUrl = base.ResolveReference(entryUrl)
+			}
+			if entryUrl.Scheme == "http" || entryUrl.Scheme == "https" {
+				entry.Url = entryUrl.String()
+				resolved = append(resolved, entry)
+			}
+		}
+	}
+	return resolved, nil
+}
+
+func parseM3U(data []byte) (entries []playlistEntry) {
+
+	title, group, lastGroup := "", "", ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if len(line) == 0 {
+			continue
+		}
+		if strings.HasPrefix(line, "#EXTINF:") {
+			// #EXTINF:<duration> [attributes],<title> - the attributes may contain commas in quotes
+			quoted := false
+			for i, c := range line {
+				if c == '"' {
+					quoted = !quoted
+				} else if c == ',' && !quoted {
+					title = strings.TrimSpace(line[i+1:])
+					group = m3uAttribute(line[:i], "group-title")
+					break
+				}
+			}
+		} else if strings.HasPrefix(line, "#EXTGRP:") {
+			// applies to the following entries
+			lastGroup = strings.TrimSpace(strings.TrimPrefix(line, "#EXTGRP:"))
+		} else if !strings.HasPrefix(line, "#") {
+			if len(group) == 0 {
+				group = lastGroup
+			}
+			entries = append(entries, playlistEntry{Url: line, Title: title, Group: group})
+			title, group = "", ""
+		}
+	}
+	return entries
+}
+
+// The value of an attribute like group-title="News" of an #EXTINF line
+func m3uAttribute(attributes string, name string) string {
+
+	if _, value, found := strings.Cut(attributes, name+"=\""); found {
+		value, _, _ = strings.Cut(value, "\"")
+		return strings.TrimSpace(value)
+	}
+	return ""
+}
+
+func parsePLS(data []byte) (entries []playlistEntry) {
+
+	files := map[string]string{}
+	titles := map[string]string{}
+	order := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if number, ok := strings.CutPrefix(key, "file"); ok {
+			files[number] = strings.TrimSpace(value)
+			order = append(order, number)
+		} else if number, ok := strings.CutPrefix(key, "title"); ok {
+			titles[number] = strings.TrimSpace(value)
+		}
+	}
+	for _, number := range order {
+		entries = append(entries, playlistEntry{Url: files[number], Title: titles[number]})
+	}
+	return entries
+}
+
+type asxRef struct {
+	Href string `xml:"href,attr"`
+}
+
+type asxEntry struct {
+	Title string   `xml:"title"`
+	Refs  []asxRef `xml:"ref"`
+}
+
+type asxPlaylist struct {
+	Entries []asxEntry `xml:"entry"`
+}
+
+// ASX is xml with case insensitive element names - we lower case them before unmarshalling
+func parseASX(data []byte) (entries []playlistEntry, err error) {
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) { return input, nil }
+	normalized := bytes.Buffer{}
+	encoder := xml.NewEncoder(&normalized)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			t.Name.Local = strings.ToLower(t.Name.Local)
+			for i := range t.Attr {
+				t.Attr[i].Name.Local = strings.ToLower(t.Attr[i].Name.Local)
+			}
+			token = t
+		case xml.EndElement:
+			t.Name.Local = strings.ToLower(t.Name.Local)
+			token = t
+		case xml.ProcInst, xml.Directive:
+			continue
+		}
+		if err := encoder.EncodeToken(token); err != nil {
+			return nil, err
+		}
+	}
+	encoder.Flush()
+
+	asx := asxPlaylist{}
+	if err := xml.Unmarshal(normalized.Bytes(), &asx); err != nil {
+		return nil, err
+	}
+	for _, entry := range asx.Entries {
+		for _, ref := range entry.Refs {
+			entries = append(entries, playlistEntry{Url: ref.Href, Title: strings.TrimSpace(entry.Title)})
+		}
+	}
+	return entries, nil
+}
+
+type xspfTrack struct {
+	Locations []string `xml:"location"`
+	Title     string   `xml:"title"`
+}
+
+type xspfPlaylist struct {
+	Tracks []xspfTrack `xml:"trackList>track"`
+}
+
+func parseXSPF(data []byte) (entries []playlistEntry, err error) {
+
+	xspf := xspfPlaylist{}
+	if err := xml.Unmarshal(data, &xspf); err != nil {
+		return nil, err
+	}
+	for _, track := range xspf.Tracks {
+		for _, location := range track.Locations {
+			entries = append(entries, playlistEntry{Url: location, Title: strings.TrimSpace(track.Title)})
+		}
+	}
+	return entries, nil
+}
+
+// Returns the first reachable stream. If streamUrl points to a playlist the entries are tried one after another (nested playlists are resolved too)
+func resolvePlaylistUrl(streamUrl string, client *http.Client) (resolvedStream, error) {
+
+	return resolvePlaylistUrlRecursive(streamUrl, client, 0)
+}
+
+func resolvePlaylistUrlRecursive(streamUrl string, client *http.Client, depth int) (resolvedStream, error) {
+
+	if depth > maxPlaylistDepth {
+		return resolvedStream{}, fmt.Errorf("playlist nesting too deep")
+	}
+
+	// A stream is recognized by a HEAD request - a GET request would open the stream a second time (the broadcaster counts
+	// a listener for a moment). Playlists and servers that don't answer HEAD requests properly are requested with GET
+	if stream, ok, err := headStream(streamUrl, client); ok {
+		return stream, err
+	}
+	resp, err := client.Get(streamUrl)
+	if err != nil {
+		return resolvedStream{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resolvedStream{}, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	// The final url after following redirects is the base for relative playlist entries
+	format := detectPlaylistFormat(resp.Header.Get("Content-Type"), resp.Request.URL)
+	if format == playlistNone {
+		// Not a playlist - that's the stream we are looking for (unless the server answers with an error page or similar)
+		if contentType := resp.Header.Get("Content-Type"); !isAudioContentType(contentType) {
+			return resolvedStream{}, fmt.Errorf("no audio stream (content type %s)", contentType)
+		}
+		return resolvedStream{Url: streamUrl, ContentType: resp.Header.Get("Content-Type")}, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPlaylistSize))
+	if err != nil {
+		return resolvedStream{}, err
+	}
+	if format == playlistM3U && isHlsPlaylist(data) {
+		// HLS can't be played by the device - it has to be bridged
+		return resolvedStream{Url: streamUrl, Hls: true}, nil
+	}
+	entries, err := parsePlaylist(format, data, resp.Request.URL)
+	if err != nil {
+		return resolvedStream{}, fmt.Errorf("could not parse playlist: %w", err)
+	}
+
+	for _, entry := range entries {
+		log.Debugf("Trying playlist entry %s", entry.Url)
+		if resolved, err := resolvePlaylistUrlRecursive(entry.Url, client, depth+1); err == nil {
+			return resolved, nil
+		} else {
+			log.Infof("Playlist entry %s not reachable: %s", entry.Url, err.Error())
+		}
+	}
+	return resolvedStream{}, fmt.Errorf("no reachable entry in playlist %s", streamUrl)
+}
+
+// Recognizes a stream by the content type of a HEAD request. ok is false if only a GET request tells (playlists, servers
+// that don't support HEAD requests or answer them differently)
+func headStream(streamUrl string, client *http.Client) (stream resolvedStream, ok bool, err error) {
+
+	resp, err := client.Head(streamUrl)
+	if err != nil {
+		if urlErr, isUrlErr := err.(*url.Error); isUrlErr && urlErr.Timeout() {
+			// A GET request would time out too
+			return resolvedStream{}, true, err
+		}
+		return resolvedStream{}, false, nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented {
+		return resolvedStream{}, true, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if resp.StatusCode < 200 || resp.StatusCode > 299 || detectPlaylistFormat(contentType, resp.Request.URL) != playlistNone {
+		return resolvedStream{}, false, nil
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || !strings.HasPrefix(strings.ToLower(mediaType), "audio/") {
+		return resolvedStream{}, false, nil
+	}
+	return resolvedStream{Url: streamUrl, ContentType: contentType}, true, nil
+}
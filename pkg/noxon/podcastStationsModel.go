@@ -0,0 +1,423 @@
+package noxon
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Ids of podcasts are "podcast:<feed hash>" and "podcast:<feed hash>:<episode hash>"
+const podcastIdPrefix = "podcast:"
+const podcastTimeout = 20 * time.Second
+
+type podcastEpisode struct {
+	id          string
+	title       string
+	description string
+	url         string
+	published   time.Time
+}
+
+type podcastFeed struct {
+	id           string
+	url          string
+	title        string
+	episodes     []podcastEpisode // The latest first
+	etag         string
+	lastModified string
+}
+
+// Shows RSS/Atom podcast feeds as dirs with the episodes as stations. The feeds are fetched periodically and cached in
+// memory. The latest episode of a feed is marked as new until the device played it
+type PodcastStationsModel struct {
+	mutex  sync.RWMutex
+	feeds  []*podcastFeed
+	client *http.Client
+	// The latest episode a device played by feed id
+	played map[string]map[string]string
+}
+
+// Refreshes the feeds every refreshInterval. Nothing is fetched if refreshInterval is zero (see Refresh)
+func NewPodcastStationsModel(feedUrls []string, refreshInterval time.Duration) *PodcastStationsModel {
+
+	model := &PodcastStationsModel{
+		mutex:  sync.RWMutex{},
+		feeds:  []*podcastFeed{},
+		client: &http.Client{Timeout: podcastTimeout},
+		played: map[string]map[string]string{},
+	}
+	for _, feedUrl := range feedUrls {
+		model.feeds = append(model.feeds, &podcastFeed{
+			id:    podcastIdPrefix + podcastHash(feedUrl),
+			url:   feedUrl,
+			title: feedUrl,
+		})
+	}
+	if refreshInterval > 0 {
+		go func() {
+			for {
+				model.Refresh()
+				time.Sleep(refreshInterval)
+			}
+		}()
+	}
+	return model
+}
+
+func podcastHash(value string) string {
+
+	hash := sha1.Sum([]byte(value))
+	return hex.EncodeToString(hash[:6])
+}
+
+// Fetches all feeds. A feed that could not be fetched keeps its cached episodes
+func (m *PodcastStationsModel) Refresh() {
+
+	for _, feed := range m.feeds {
+		m.mutex.RLock()
+		etag, lastModified := feed.etag, feed.lastModified
+		m.mutex.RUnlock()
+
+		updated, err := m.fetch(feed.url, etag, lastModified)
+		if err != nil {
+			log.Warnf("Could not fetch podcast %s: %s", feed.url, err.Error())
+			continue
+		} else if updated == nil {
+			log.Debugf("Podcast %s not modified", feed.url)
+			continue
+		}
+		for i := range updated.episodes {
+			updated.episodes[i].id = feed.id + ":" + updated.episodes[i].id
+		}
+		m.mutex.Lock()
+		feed.title = updated.title
+		feed.episodes = updated.episodes
+		feed.etag = updated.etag
+		feed.lastModified = updated.lastModified
+		m.mutex.Unlock()
+		log.Infof("Fetched podcast %s with %d episodes", feed.url, len(updated.episodes))
+	}
+}
+
+// Returns nil if the feed was not modified
+func (m *PodcastStationsModel) fetch(feedUrl string, etag string, lastModified string) (*podcastFeed, error) {
+
+	req, err := http.NewRequest(http.MethodGet, feedUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(etag) > 0 {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if len(lastModified) > 0 {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	feed, err := parsePodcastFeed(data)
+	if err != nil {
+		return nil, err
+	}
+	feed.etag = resp.Header.Get("ETag")
+	feed.lastModified = resp.Header.Get("Last-Modified")
+	return feed, nil
+}
+
+type rssFeed struct {
+	XMLName xml.Name `xml:"rss"`
+	Title   string   `xml:"channel>title"`
+	Items   []struct {
+		Title       string `xml:"title"`
+		Description string `xml:"description"`
+		Guid        string `xml:"guid"`
+		PubDate     string `xml:"pubDate"`
+		Enclosure   struct {
+			Url  string `xml:"url,attr"`
+			Type string `xml:"type,attr"`
+		} `xml:"enclosure"`
+	} `xml:"channel>item"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name `xml:"feed"`
+	Title   string   `xml:"title"`
+	Entries []struct {
+		Id        string `xml:"id"`
+		Title     string `xml:"title"`
+		Summary   string `xml:"summary"`
+		Content   string `xml:"content"`
+		Published string `xml:"published"`
+		Updated   string `xml:"updated"`
+		Links     []struct {
+			Rel  string `xml:"rel,attr"`
+			Href string `xml:"href,attr"`
+			Type string `xml:"type,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+// Parses a RSS 2.0 or Atom feed. Only entries with an (audio) enclosure are episodes. The ids of the episodes are hashes
+// of their guid (the enclosure url if there is none)
+func parsePodcastFeed(data []byte) (*podcastFeed, error) {
+
+	feed := &podcastFeed{}
+	var rss rssFeed
+	var atom atomFeed
+	if err := xml.Unmarshal(data, &rss); err == nil {
+		feed.title = strings.TrimSpace(rss.Title)
+		for _, item := range rss.Items {
+			if len(item.Enclosure.Url) == 0 || !isPodcastEnclosure(item.Enclosure.Type) {
+				continue
+			}
+			guid := item.Guid
+			if len(guid) == 0 {
+				guid = item.Enclosure.Url
+			}
+			feed.episodes = append(feed.episodes, podcastEpisode{
+				id:          podcastHash(guid),
+				title:       strings.TrimSpace(item.Title),
+				description: strings.TrimSpace(item.Description),
+				url:         item.Enclosure.Url,
+				published:   parsePodcastTime(item.PubDate),
+			})
+		}
+	} else if err := xml.Unmarshal(data, &atom); err == nil {
+		feed.title = strings.TrimSpace(atom.Title)
+		for _, entry := range atom.Entries {
+			for _, link := range entry.Links {
+				if link.Rel != "enclosure" || len(link.Href) == 0 || !isPodcastEnclosure(link.Type) {
+					continue
+				}
+				guid := entry.Id
+				if len(guid) == 0 {
+					guid = link.Href
+				}
+				description := entry.Summary
+				if len(description) == 0 {
+					description = entry.Content
+				}
+				published := entry.Published
+				if len(published) == 0 {
+					published = entry.Updated
+				}
+				feed.episodes = append(feed.episodes, podcastEpisode{
+					id:          podcastHash(guid),
+					title:       strings.TrimSpace(entry.Title),
+					description: strings.TrimSpace(description),
+					url:         link.Href,
+					published:   parsePodcastTime(published),
+				})
+				break
+			}
+		}
+	} else {
+		return nil, fmt.Errorf("neither a RSS nor an Atom feed")
+	}
+	sort.SliceStable(feed.episodes, func(i, j int) bool {
+		return feed.episodes[i].published.After(feed.episodes[j].published)
+	})
+	return feed, nil
+}
+
+func isPodcastEnclosure(contentType string) bool {
+
+	return len(contentType) == 0 || strings.HasPrefix(strings.ToLower(contentType), "audio/")
+}
+
+func parsePodcastTime(value string) time.Time {
+
+	for _, layout := range []string{time.RFC1123Z, time.RFC1123, time.RFC3339, "Mon, 2 Jan 2006 15:04:05 -0700", "Mon, 2 Jan 2006 15:04:05 MST"} {
+		if t, err := time.Parse(layout, strings.TrimSpace(value)); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (m *PodcastStationsModel) feed(id string) *podcastFeed {
+
+	for _, feed := range m.feeds {
+		if feed.id == id {
+			return feed
+		}
+	}
+	return nil
+}
+
+// The feed and the index of the episode with the id (-1 if the id is the id of the feed)
+func (m *PodcastStationsModel) find(id string) (*podcastFeed, int) {
+
+	feedId, episodeId, isEpisode := strings.Cut(strings.TrimPrefix(id, podcastIdPrefix), ":")
+	feed := m.feed(podcastIdPrefix + feedId)
+	if !strings.HasPrefix(id, podcastIdPrefix) || feed == nil {
+		return nil, -1
+	} else if !isEpisode {
+		return feed, -1
+	}
+	for index, episode := range feed.episodes {
+		if episode.id == podcastIdPrefix+feedId+":"+episodeId {
+			return feed, index
+		}
+	}
+	return nil, -1
+}
+
+func (m *PodcastStationsModel) Data(parentId *string, index int) (Item, string) {
+
+	return m.data(parentId, index, "")
+}
+
+func (m *PodcastStationsModel) Count(parentId *string) int {
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if parentId == nil {
+		// root
+		return len(m.feeds)
+	} else if feed, episodeIndex := m.find(*parentId); feed != nil && episodeIndex < 0 {
+		return len(feed.episodes)
+	}
+	return 0
+}
+
+// Marks the new episodes for the device (if mac is not empty)
+func (m *PodcastStationsModel) data(parentId *string, index int, mac string) (Item, string) {
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if parentId == nil {
+		// root
+		if index >= 0 && index < len(m.feeds) {
+			return m.feedItem(m.feeds[index], mac), m.feeds[index].id
+		}
+	} else if feed, episodeIndex := m.find(*parentId); feed != nil {
+		if index >= 0 && episodeIndex < 0 {
+			// children
+			if index < len(feed.episodes) {
+				return m.episodeItem(feed, index, mac), feed.episodes[index].id
+			}
+			log.Warnf("Could not find Item for parent '%s' with index %d", *parentId, index)
+		} else if index < 0 && episodeIndex < 0 {
+			return m.feedItem(feed, mac), feed.id
+		} else if index < 0 {
+			return m.episodeItem(feed, episodeIndex, mac), feed.episodes[episodeIndex].id
+		}
+	}
+	return ItemDir{}, ""
+}
+
+func (m *PodcastStationsModel) hasNewEpisode(feed *podcastFeed, mac string) bool {
+
+	return len(mac) > 0 && len(feed.episodes) > 0 && m.played[mac][feed.id] != feed.episodes[0].id
+}
+
+func (m *PodcastStationsModel) feedItem(feed *podcastFeed, mac string) ItemDir {
+
+	if m.hasNewEpisode(feed, mac) {
+		return ItemDir{Title: feed.title + " (new)"}
+	}
+	return ItemDir{Title: feed.title}
+}
+
+func (m *PodcastStationsModel) episodeItem(feed *podcastFeed, index int, mac string) ItemStation {
+
+	episode := feed.episodes[index]
+	name := episode.title
+	if index == 0 && m.hasNewEpisode(feed, mac) {
+		name = "New: " + name
+	}
+	return ItemStation{
+		StationName:        name,
+		StationDescription: episode.description,
+		StationUrl:         episode.url,
+		StationMime:        "MP3",
+		Finite:             true,
+	}
+}
+
+func (m *PodcastStationsModel) ForDevice(mac string) StationsModel {
+
+	return podcastDeviceStationsModel{model: m, mac: mac}
+}
+
+// Remembers the latest episode of the feed the device played
+func (m *PodcastStationsModel) Played(mac string, stationId string) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	feed, episodeIndex := m.find(stationId)
+	if feed == nil || episodeIndex < 0 {
+		return
+	}
+	// Older episodes don't matter - the device has to know if there is a newer one
+	if last := m.played[mac][feed.id]; len(last) > 0 {
+		for index, episode := range feed.episodes {
+			if episode.id == last && index < episodeIndex {
+				return
+			}
+		}
+	}
+	if _, ok := m.played[mac]; !ok {
+		m.played[mac] = map[string]string{}
+	}
+	m.played[mac][feed.id] = feed.episodes[episodeIndex].id
+}
+
+// The episodes matching the query by title, description or the title of their feed (the latest first per feed)
+func (m *PodcastStationsModel) Search(query string) []string {
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	words := searchWords(query)
+	ids := []string{}
+	for _, feed := range m.feeds {
+		for _, episode := range feed.episodes {
+			if matchesQuery(words, feed.title, episode.title, episode.description) {
+				ids = append(ids, episode.id)
+			}
+		}
+	}
+	return ids
+}
+
+// The podcasts as seen by a device
+type podcastDeviceStationsModel struct {
+	model *PodcastStationsModel
+	mac   string
+}
+
+func (m podcastDeviceStationsModel) Data(parentId *string, index int) (Item, string) {
+
+	return m.model.data(parentId, index, m.mac)
+}
+
+func (m podcastDeviceStationsModel) Count(parentId *string) int {
+
+	return m.model.Count(parentId)
+}
+
+func (m podcastDeviceStationsModel) Search(query string) []string {
+
+	return m.model.Search(query)
+}
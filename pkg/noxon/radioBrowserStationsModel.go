@@ -0,0 +1,393 @@
+package noxon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Ids of the radio-browser model are short because the device limits the length of the station ids:
+// "rb:" (root), "rb:top", "rb:<category>", "rb:<category>:<group>" and "rb:s:<station uuid>"
+const radioBrowserIdPrefix = "rb:"
+const radioBrowserStationIdPrefix = radioBrowserIdPrefix + "s:"
+const radioBrowserTopId = radioBrowserIdPrefix + "top"
+const radioBrowserTopCount = 100
+const radioBrowserTimeout = 2 * time.Minute
+
+// A station of the radio-browser.info API (/json/stations)
+type radioBrowserStation struct {
+	Uuid        string `json:"stationuuid"`
+	Name        string `json:"name"`
+	Url         string `json:"url"`
+	UrlResolved string `json:"url_resolved"`
+	Tags        string `json:"tags"`
+	Country     string `json:"country"`
+	CountryCode string `json:"countrycode"`
+	Language    string `json:"language"`
+	Votes       int    `json:"votes"`
+	Codec       string `json:"codec"`
+	Bitrate     int    `json:"bitrate"`
+	LastCheckOk *int   `json:"lastcheckok"`
+}
+
+type radioBrowserGroup struct {
+	key      string
+	title    string
+	stations []*radioBrowserStation
+}
+
+type radioBrowserCategory struct {
+	key    string
+	title  string
+	groups []*radioBrowserGroup
+	byKey  map[string]*radioBrowserGroup
+}
+
+type radioBrowserIndex struct {
+	stations   map[string]*radioBrowserStation
+	byVotes    []*radioBrowserStation
+	categories []*radioBrowserCategory
+	top        []*radioBrowserStation
+}
+
+// Browses the stations of radio-browser.info by country, language, genre and votes. The stations are loaded from the
+// API (source is the base url of a server) or from a dump of /json/stations (source is a file). Downloaded stations
+// are cached in cacheFile so the model works offline
+type RadioBrowserStationsModel struct {
+	mutex     sync.RWMutex
+	name      string
+	source    string
+	cacheFile string
+	client    *http.Client
+	index     *radioBrowserIndex
+}
+
+// Loads the cache (or the dump) and refreshes the stations every refreshInterval. The API is not requested if
+// refreshInterval is zero (see Refresh)
+func NewRadioBrowserStationsModel(name string, source string, cacheFile string, refreshInterval time.Duration) *RadioBrowserStationsModel {
+
+	model := &RadioBrowserStationsModel{
+		mutex:     sync.RWMutex{},
+		name:      name,
+		source:    source,
+		cacheFile: cacheFile,
+		client:    &http.Client{Timeout: radioBrowserTimeout},
+		index:     newRadioBrowserIndex(nil),
+	}
+	if !model.isRemote() {
+		if err := model.Refresh(); err != nil {
+			log.Errorf("Could not load radio-browser dump %s: %s", source, err.Error())
+		}
+		return model
+	}
+	if len(cacheFile) > 0 {
+		if data, err := os.ReadFile(cacheFile); err == nil {
+			if err := model.load(data); err != nil {
+				log.Warnf("Could not load radio-browser cache %s: %s", cacheFile, err.Error())
+			}
+		}
+	}
+	if refreshInterval > 0 {
+		go func() {
+			for {
+				if err := model.Refresh(); err != nil {
+					log.Warnf("Could not refresh radio-browser stations: %s", err.Error())
+				}
+				time.Sleep(refreshInterval)
+			}
+		}()
+	}
+	return model
+}
+
+func (m *RadioBrowserStationsModel) isRemote() bool {
+
+	return strings.HasPrefix(m.source, "http://") || strings.HasPrefix(m.source, "https://")
+}
+
+// Loads the stations from the source. Downloaded stations are written to the cache file
+func (m *RadioBrowserStationsModel) Refresh() error {
+
+	if !m.isRemote() {
+		data, err := os.ReadFile(m.source)
+		if err != nil {
+			return err
+		}
+		return m.load(data)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(m.source, "/")+"/json/stations?hidebroken=true", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "noxon-server")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := m.load(data); err != nil {
+		return err
+	}
+	if len(m.cacheFile) > 0 {
+		if err := writeFileAtomic(m.cacheFile, data); err != nil {
+			log.Warnf("Could not write radio-browser cache %s: %s", m.cacheFile, err.Error())
+		}
+	}
+	return nil
+}
+
+func (m *RadioBrowserStationsModel) load(data []byte) error {
+
+	stations := []*radioBrowserStation{}
+	if err := json.Unmarshal(data, &stations); err != nil {
+		return err
+	}
+	index := newRadioBrowserIndex(stations)
+	m.mutex.Lock()
+	m.index = index
+	m.mutex.Unlock()
+	log.Infof("Loaded %d radio-browser stations", len(index.stations))
+	return nil
+}
+
+func splitRadioBrowserList(list string) []string {
+
+	values := []string{}
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.ToLower(strings.TrimSpace(value)); len(value) > 0 {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func newRadioBrowserIndex(stations []*radioBrowserStation) *radioBrowserIndex {
+
+	index := &radioBrowserIndex{
+		stations: map[string]*radioBrowserStation{},
+		top:      []*radioBrowserStation{},
+	}
+	countries := &radioBrowserCategory{key: "country", title: "By country", byKey: map[string]*radioBrowserGroup{}}
+	languages := &radioBrowserCategory{key: "language", title: "By language", byKey: map[string]*radioBrowserGroup{}}
+	tags := &radioBrowserCategory{key: "tag", title: "By genre", byKey: map[string]*radioBrowserGroup{}}
+	index.categories = []*radioBrowserCategory{countries, languages, tags}
+
+	add := func(category *radioBrowserCategory, key string, title string, station *radioBrowserStation) {
+		group, ok := category.byKey[key]
+		if !ok {
+			group = &radioBrowserGroup{key: key, title: title}
+			category.byKey[key] = group
+			category.groups = append(category.groups, group)
+		}
+		group.stations = append(group.stations, station)
+	}
+
+	// the most voted stations first
+	sort.SliceStable(stations, func(i, j int) bool { return stations[i].Votes > stations[j].Votes })
+	for _, station := range stations {
+		if len(station.Uuid) == 0 || len(station.Name) == 0 || len(station.Url) == 0 {
+			continue
+		} else if station.LastCheckOk != nil && *station.LastCheckOk == 0 {
+			continue
+		} else if _, ok := index.stations[station.Uuid]; ok {
+			continue
+		}
+		station.Name = strings.TrimSpace(station.Name)
+		index.stations[station.Uuid] = station
+		index.byVotes = append(index.byVotes, station)
+		if len(index.top) < radioBrowserTopCount {
+			index.top = append(index.top, station)
+		}
+		if countryCode := strings.ToUpper(strings.TrimSpace(station.CountryCode)); len(countryCode) > 0 {
+			country := strings.TrimSpace(station.Country)
+			if len(country) == 0 {
+				country = countryCode
+			}
+			add(countries, countryCode, country, station)
+		}
+		for _, language := range splitRadioBrowserList(station.Language) {
+			runes := []rune(language)
+			add(languages, language, strings.ToUpper(string(runes[:1]))+string(runes[1:]), station)
+		}
+		for _, tag := range splitRadioBrowserList(station.Tags) {
+			add(tags, tag, tag, station)
+		}
+	}
+
+	byTitle := func(groups []*radioBrowserGroup) func(i, j int) bool {
+		return func(i, j int) bool { return strings.ToLower(groups[i].title) < strings.ToLower(groups[j].title) }
+	}
+	sort.SliceStable(countries.groups, byTitle(countries.groups))
+	sort.SliceStable(languages.groups, byTitle(languages.groups))
+	// the most common genres first
+	sort.SliceStable(tags.groups, func(i, j int) bool {
+		if len(tags.groups[i].stations) != len(tags.groups[j].stations) {
+			return len(tags.groups[i].stations) > len(tags.groups[j].stations)
+		}
+		return tags.groups[i].title < tags.groups[j].title
+	})
+	return index
+}
+
+func (i *radioBrowserIndex) category(key string) *radioBrowserCategory {
+
+	for _, category := range i.categories {
+		if category.key == key {
+			return category
+		}
+	}
+	return nil
+}
+
+func (m *RadioBrowserStationsModel) stationItem(station *radioBrowserStation) (Item, string) {
+
+	item := ItemStation{
+		StationName:        station.Name,
+		StationDescription: strings.Join(splitRadioBrowserList(station.Tags), ", "),
+		StationUrl:         station.Url,
+		StationMime:        "MP3",
+	}
+	if country := strings.TrimSpace(station.Country); len(country) > 0 && len(item.StationDescription) > 0 {
+		item.StationDescription = country + ": " + item.StationDescription
+	} else if len(country) > 0 {
+		item.StationDescription = country
+	}
+	if station.Bitrate > 0 {
+		item.StationBandWidth = fmt.Sprint(station.Bitrate)
+	}
+	// the resolved url skips the playlist - the original one is the fallback
+	if len(station.UrlResolved) > 0 && station.UrlResolved != station.Url {
+		item.StationUrl = station.UrlResolved
+		item.AlternativeUrls = []string{station.Url}
+	}
+	return item, radioBrowserStationIdPrefix + station.Uuid
+}
+
+func radioBrowserGroupTitle(group *radioBrowserGroup) string {
+
+	return fmt.Sprintf("%s (%d)", group.title, len(group.stations))
+}
+
+// The child items of an id
+func (m *RadioBrowserStationsModel) children(id string) (count int, child func(index int) (Item, string)) {
+
+	index := m.index
+	if id == radioBrowserIdPrefix {
+		return len(index.categories) + 1, func(i int) (Item, string) {
+			if i < len(index.categories) {
+				return ItemDir{Title: index.categories[i].title}, radioBrowserIdPrefix + index.categories[i].key
+			}
+			return ItemDir{Title: "Top voted"}, radioBrowserTopId
+		}
+	} else if id == radioBrowserTopId {
+		return len(index.top), func(i int) (Item, string) { return m.stationItem(index.top[i]) }
+	} else if strings.HasPrefix(id, radioBrowserStationIdPrefix) {
+		return 0, nil
+	}
+	categoryKey, groupKey, isGroup := strings.Cut(strings.TrimPrefix(id, radioBrowserIdPrefix), ":")
+	category := index.category(categoryKey)
+	if category == nil {
+		return 0, nil
+	} else if !isGroup {
+		return len(category.groups), func(i int) (Item, string) {
+			return ItemDir{Title: radioBrowserGroupTitle(category.groups[i])}, radioBrowserIdPrefix + category.key + ":" + category.groups[i].key
+		}
+	} else if group, ok := category.byKey[groupKey]; ok {
+		return len(group.stations), func(i int) (Item, string) { return m.stationItem(group.stations[i]) }
+	}
+	return 0, nil
+}
+
+// The item with the id
+func (m *RadioBrowserStationsModel) item(id string) (Item, string) {
+
+	index := m.index
+	if id == radioBrowserIdPrefix {
+		return ItemDir{Title: m.name}, id
+	} else if id == radioBrowserTopId {
+		return ItemDir{Title: "Top voted"}, id
+	} else if strings.HasPrefix(id, radioBrowserStationIdPrefix) {
+		if station, ok := index.stations[strings.TrimPrefix(id, radioBrowserStationIdPrefix)]; ok {
+			return m.stationItem(station)
+		}
+		return ItemDir{}, ""
+	}
+	categoryKey, groupKey, isGroup := strings.Cut(strings.TrimPrefix(id, radioBrowserIdPrefix), ":")
+	if category := index.category(categoryKey); category == nil {
+		return ItemDir{}, ""
+	} else if !isGroup {
+		return ItemDir{Title: category.title}, id
+	} else if group, ok := category.byKey[groupKey]; ok {
+		return ItemDir{Title: radioBrowserGroupTitle(group)}, id
+	}
+	return ItemDir{}, ""
+}
+
+func (m *RadioBrowserStationsModel) Data(parentId *string, index int) (Item, string) {
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if parentId == nil {
+		// root
+		if index == 0 {
+			return m.item(radioBrowserIdPrefix)
+		}
+	} else if strings.HasPrefix(*parentId, radioBrowserIdPrefix) {
+		if index >= 0 {
+			// children
+			if count, child := m.children(*parentId); index < count {
+				return child(index)
+			}
+			log.Warnf("Could not find Item for parent '%s' with index %d", *parentId, index)
+		} else {
+			// the item with id
+			return m.item(*parentId)
+		}
+	}
+	return ItemDir{}, ""
+}
+
+func (m *RadioBrowserStationsModel) Count(parentId *string) int {
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if parentId == nil {
+		// root
+		return 1
+	} else if strings.HasPrefix(*parentId, radioBrowserIdPrefix) {
+		count, _ := m.children(*parentId)
+		return count
+	}
+	return 0
+}
+
+// The stations matching the query by name, tags, country or language (the most voted first)
+func (m *RadioBrowserStationsModel) Search(query string) []string {
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	words := searchWords(query)
+	ids := []string{}
+	for _, station := range m.index.byVotes {
+		if matchesQuery(words, station.Name, station.Tags, station.Country, station.Language) {
+			ids = append(ids, radioBrowserStationIdPrefix+station.Uuid)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,125 @@
+package noxon
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const reconnectInitialBackoff = 500 * time.Millisecond
+const reconnectMaxBackoff = 8 * time.Second
+
+// If the stream stalls longer than this we start sending silence to the device
+const silenceGapThreshold = 1500 * time.Millisecond
+const silenceInterval = 500 * time.Millisecond
+
+// reconnectingReader transparently reopens the upstream if the connection gets lost
+type reconnectingReader struct {
+	mutex          sync.Mutex
+	current        io.ReadCloser
+	reopen         func(offset int64) (io.ReadCloser, error)
+	offset         int64 // The bytes read so far - a finite source is reopened at this offset
+	retries        int
+	reconnectOnEOF bool
+	pending        error // The error of a read that returned data too - handled by the next Read
+	closed         bool
+	done           chan struct{}
+}
+
+// Reconnects at most retries times in a row (with exponential backoff). The budget is restored after a successful reconnect.
+// reopen gets the number of bytes read so far
+func newReconnectingReader(source io.ReadCloser, reopen func(offset int64) (io.ReadCloser, error), retries int, reconnectOnEOF bool) *reconnectingReader {
+
+	return &reconnectingReader{
+		current:        source,
+		reopen:         reopen,
+		retries:        retries,
+		reconnectOnEOF: reconnectOnEOF,
+		done:           make(chan struct{}),
+	}
+}
+
+func (r *reconnectingReader) Read(p []byte) (int, error) {
+
+	for {
+		r.mutex.Lock()
+		current := r.current
+		r.mutex.Unlock()
+
+		var count int
+		var err error
+		if r.pending != nil {
+			err, r.pending = r.pending, nil
+		} else {
+			count, err = current.Read(p)
+			r.offset += int64(count)
+		}
+		if err != nil && count > 0 {
+			// The data is returned first - the error is handled by the next call
+			r.pending = err
+			return count, nil
+		} else if err == nil {
+			return count, nil
+		}
+		if r.isClosed() || (err == io.EOF && !r.reconnectOnEOF) {
+			return 0, err
+		}
+		log.Warnf("Lost upstream connection: %s - reconnecting", err.Error())
+		current.Close()
+		if err := r.reconnect(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (r *reconnectingReader) reconnect() error {
+
+	backoff := reconnectInitialBackoff
+	for attempt := 1; attempt <= r.retries; attempt++ {
+		select {
+		case <-r.done:
+			return io.ErrClosedPipe
+		case <-time.After(backoff):
+		}
+
+		source, err := r.reopen(r.offset)
+		if err == nil {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			if r.closed {
+				source.Close()
+				return io.ErrClosedPipe
+			}
+			r.current = source
+			log.Infof("Reconnected to upstream (attempt %d/%d)", attempt, r.retries)
+			return nil
+		}
+		log.Warnf("Reconnect attempt %d/%d failed: %s", attempt, r.retries, err.Error())
+		backoff *= 2
+		if backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+	return fmt.Errorf("giving up after %d reconnect attempts", r.retries)
+}
+
+func (r *reconnectingReader) isClosed() bool {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.closed
+}
+
+func (r *reconnectingReader) Close() error {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.closed {
+		r.closed = true
+		close(r.done)
+	}
+	return r.current.Close()
+}
@@ -0,0 +1,364 @@
+package noxon
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// Recordings are named like 20240131-200000_Station_Name.mp3
+const recordingTimeLayout = "20060102-150405"
+
+var recordingNameReplacer = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+// File extensions of the recordings by content type
+var recordingExtensions = map[string]string{
+	"audio/mpeg": ".mp3",
+	"audio/mp3":  ".mp3",
+	"audio/aac":  ".aac",
+	"audio/aacp": ".aac",
+	"audio/ogg":  ".ogg",
+	"audio/flac": ".flac",
+}
+
+type RecordingSchedule struct {
+	StationId string
+	Cron      string // See CronSchedule
+	Duration  time.Duration
+}
+
+type RecordingSettings struct {
+	Enabled  bool
+	Dir      string
+	Schedule []RecordingSchedule
+}
+
+// A finished or active recording (see /api/recordings)
+type Recording struct {
+	Name      string    `json:"name"`
+	StationId string    `json:"stationId,omitempty"` // Only known for active recordings
+	StartTime time.Time `json:"startTime"`
+	Size      int64     `json:"size"`
+	Active    bool      `json:"active"`
+}
+
+type activeRecording struct {
+	stationId string
+	startTime time.Time
+	stop      chan struct{}
+	stopOnce  sync.Once
+	finished  chan struct{} // closed once the file is closed
+}
+
+// Records stations into files - on demand or scheduled
+type recorder struct {
+	mutex  sync.Mutex
+	active map[string]*activeRecording
+}
+
+func newRecorder() *recorder {
+
+	return &recorder{
+		mutex:  sync.Mutex{},
+		active: map[string]*activeRecording{},
+	}
+}
+
+// Records the station for the given duration. Returns the name of the recording
+func (n *NoxonServer) startRecording(stationId string, duration time.Duration) (string, error) {
+
+	stationItem, stationItemId := n.settings.StationsModel.Data(&stationId, -1)
+	item, ok := stationItem.(ItemStation)
+	if !ok || len(stationItemId) == 0 {
+		return "", fmt.Errorf("a non existing station (id: %s) was requested", stationId)
+	}
+	station, _, err := n.resolveStation(n.settings.StationsModel, stationId, "")
+	if err != nil {
+		return "", err
+	}
+
+	startTime := time.Now()
+	stream, listener, err := n.hub.listen(station, "recorder", stationId)
+	if err != nil {
+		return "", err
+	}
+	opener := func() (io.ReadCloser, http.Header, error) {
+		return n.openStationStream(stationId, station, nil, upstreamEvents{onTitle: stream.setTitle})
+	}
+	if err := stream.open(opener, false); err != nil {
+		stream.unsubscribe(listener)
+		return "", err
+	}
+
+	name := startTime.Format(recordingTimeLayout) + "_" + strings.Trim(recordingNameReplacer.ReplaceAllString(item.StationName, "_"), "_")
+	if err := os.MkdirAll(n.settings.Recording.Dir, 0755); err != nil {
+		stream.unsubscribe(listener)
+		return "", err
+	}
+	file, name, err := createRecordingFile(n.settings.Recording.Dir, name, recordingExtension(stream.header.Get("Content-Type")))
+	if err != nil {
+		stream.unsubscribe(listener)
+		return "", err
+	}
+
+	recording := &activeRecording{
+		stationId: stationId,
+		startTime: startTime,
+		stop:      make(chan struct{}),
+		finished:  make(chan struct{}),
+	}
+	n.recorder.mutex.Lock()
+	n.recorder.active[name] = recording
+	n.recorder.mutex.Unlock()
+	log.Infof("Started recording %s (%s)", name, duration)
+
+	go func() {
+		defer func() {
+			stream.unsubscribe(listener)
+			file.Close()
+			n.recorder.mutex.Lock()
+			delete(n.recorder.active, name)
+			n.recorder.mutex.Unlock()
+			close(recording.finished)
+			log.Infof("Finished recording %s", name)
+		}()
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				return
+			case <-recording.stop:
+				return
+			case chunk, ok := <-listener.chunks:
+				if !ok {
+					log.Warnf("Recording %s stopped early - the stream ended", name)
+					return
+				}
+				if _, err := file.Write(chunk); err != nil {
+					log.Errorf("Could not write recording %s: %s", name, err.Error())
+					return
+				}
+			}
+		}
+	}()
+	return name, nil
+}
+
+// Stops the active recording and waits until its file is closed. False if the recording is not active
+func (n *NoxonServer) stopRecording(name string) bool {
+
+	n.recorder.mutex.Lock()
+	recording, ok := n.recorder.active[name]
+	n.recorder.mutex.Unlock()
+	if ok {
+		recording.stopOnce.Do(func() { close(recording.stop) })
+		<-recording.finished
+	}
+	return ok
+}
+
+// Stops the recording if it is active and removes its file
+func (n *NoxonServer) deleteRecording(name string) error {
+
+	n.stopRecording(name)
+	if err := os.Remove(filepath.Join(n.settings.Recording.Dir, name)); err != nil {
+		return err
+	}
+	log.Infof("Deleted recording %s", name)
+	return nil
+}
+
+func (n *NoxonServer) listRecordings() ([]Recording, error) {
+
+	entries, err := os.ReadDir(n.settings.Recording.Dir)
+	if os.IsNotExist(err) {
+		// Nothing was recorded yet
+		return []Recording{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	n.recorder.mutex.Lock()
+	defer n.recorder.mutex.Unlock()
+	recordings := []Recording{}
+	for _, entry := range entries {
+		timestamp, _, isRecording := strings.Cut(entry.Name(), "_")
+		startTime, err := time.ParseInLocation(recordingTimeLayout, timestamp, time.Local)
+		if entry.IsDir() || !isRecording || err != nil {
+			continue
+		}
+		recording := Recording{
+			Name:      entry.Name(),
+			StartTime: startTime,
+		}
+		if info, err := entry.Info(); err == nil {
+			recording.Size = info.Size()
+		}
+		if active, ok := n.recorder.active[entry.Name()]; ok {
+			recording.StationId = active.stationId
+			recording.StartTime = active.startTime
+			recording.Active = true
+		}
+		recordings = append(recordings, recording)
+	}
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].StartTime.After(recordings[j].StartTime) })
+	return recordings, nil
+}
+
+// Creates the file of a new recording. Recordings of the same station started in the same second are numbered (like
+// 20240131-200000_Station_Name_2.mp3) - an existing recording is never overwritten
+func createRecordingFile(dir string, name string, extension string) (*os.File, string, error) {
+
+	for counter := 1; ; counter++ {
+		fileName := name + extension
+		if counter > 1 {
+			fileName = fmt.Sprintf("%s_%d%s", name, counter, extension)
+		}
+		file, err := os.OpenFile(filepath.Join(dir, fileName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) {
+			return file, fileName, err
+		}
+	}
+}
+
+func recordingExtension(contentType string) string {
+
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if extension, ok := recordingExtensions[strings.ToLower(mediaType)]; ok {
+			return extension
+		}
+	}
+	return ".audio"
+}
+
+// Starts the scheduled recordings. Checks the schedule at the beginning of every minute - the recordings are started in
+// the background so a slow station doesn't hold up the recordings of the next minutes
+func (n *NoxonServer) runRecordingSchedule() {
+
+	type scheduledRecording struct {
+		RecordingSchedule
+		cron CronSchedule
+	}
+	schedule := []scheduledRecording{}
+	for _, entry := range n.settings.Recording.Schedule {
+		if cron, err := ParseCronSchedule(entry.Cron); err != nil {
+			log.Errorf("Invalid recording schedule for station %s: %s", entry.StationId, err.Error())
+		} else {
+			schedule = append(schedule, scheduledRecording{RecordingSchedule: entry, cron: cron})
+		}
+	}
+	if len(schedule) == 0 {
+		return
+	}
+
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(next.Sub(now))
+		for _, entry := range schedule {
+			if entry.cron.Matches(next) {
+				go func(entry RecordingSchedule) {
+					if _, err := n.startRecording(entry.StationId, entry.Duration); err != nil {
+						log.Errorf("Could not start scheduled recording of station %s: %s", entry.StationId, err.Error())
+					}
+				}(entry.RecordingSchedule)
+			}
+		}
+	}
+}
+
+func (n *NoxonServer) handleListRecordingsEndpoint(c *gin.Context) {
+
+	if recordings, err := n.listRecordings(); err != nil {
+		log.Errorf("Could not list recordings: %s", err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+	} else {
+		c.JSON(http.StatusOK, recordings)
+	}
+}
+
+// Starts a recording: POST /api/recordings?stationId=<id>&minutes=<duration>
+func (n *NoxonServer) handleStartRecordingEndpoint(c *gin.Context) {
+
+	stationId := c.Query("stationId")
+	minutes, err := strconv.Atoi(c.DefaultQuery("minutes", "60"))
+	if err != nil || minutes <= 0 || len(stationId) == 0 {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	// only the failures of the upstream are a bad gateway
+	if item, id := n.settings.StationsModel.Data(&stationId, -1); len(id) == 0 {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	} else if _, ok := item.(ItemStation); !ok {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if name, err := n.startRecording(stationId, time.Duration(minutes)*time.Minute); err != nil {
+		log.Errorf("Could not start recording: %s", err.Error())
+		c.AbortWithStatus(http.StatusBadGateway)
+	} else {
+		c.JSON(http.StatusOK, gin.H{"name": name})
+	}
+}
+
+// Stops an active recording - the file is kept: POST /api/recordings/<name>/stop
+func (n *NoxonServer) handleStopRecordingEndpoint(c *gin.Context) {
+
+	if n.stopRecording(c.Param("name")) {
+		c.Status(http.StatusOK)
+	} else {
+		c.AbortWithStatus(http.StatusNotFound)
+	}
+}
+
+// Removes a recording - an active one is stopped first: DELETE /api/recordings/<name>
+func (n *NoxonServer) handleDeleteRecordingEndpoint(c *gin.Context) {
+
+	name := c.Param("name")
+	if !isRecordingName(name) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if err := n.deleteRecording(name); os.IsNotExist(err) {
+		c.AbortWithStatus(http.StatusNotFound)
+	} else if err != nil {
+		log.Errorf("Could not delete recording %s: %s", name, err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+	} else {
+		c.Status(http.StatusOK)
+	}
+}
+
+func (n *NoxonServer) handleDownloadRecordingEndpoint(c *gin.Context) {
+
+	name := c.Param("name")
+	if !isRecordingName(name) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	path := filepath.Join(n.settings.Recording.Dir, name)
+	if _, err := os.Stat(path); err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.FileAttachment(path, name)
+}
+
+// Only plain file names inside of the recording dir are accepted
+func isRecordingName(name string) bool {
+
+	return name == filepath.Base(name) && !strings.HasPrefix(name, ".")
+}
@@ -0,0 +1,349 @@
+package noxon
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Categories of TaggedStationsModel
+const (
+	StationTagCategoryTag      = "tag"
+	StationTagCategoryLanguage = "language"
+	StationTagCategoryCountry  = "country"
+)
+
+const smartFolderIdPrefix = "smart:"
+const smartFolderRecentId = smartFolderIdPrefix + "recent"
+const smartFolderMostPlayedId = smartFolderIdPrefix + "most"
+const smartFolderRecentCount = 20
+
+var smartFolderCategories = []struct {
+	category string
+	title    string
+}{
+	{StationTagCategoryTag, "By tag"},
+	{StationTagCategoryLanguage, "By language"},
+	{StationTagCategoryCountry, "By country"},
+}
+
+type smartFolderGroup struct {
+	key   string
+	title string
+	ids   []string
+}
+
+// Adds virtual dirs to the root menu: the stations by tag, language and country (if the model is a
+// TaggedStationsModel) and the stations a device played recently and most. The stations keep their ids so they are
+// not duplicated. The virtual dirs have stable ids ("smart:<category>" and "smart:<category>:<tag>")
+type SmartFoldersStationsModel struct {
+	model     StationsModel
+	playbacks PlaybackManager    // No "Recently played" and "Most played" dirs if nil
+	mac       string             // Only set for the view of a device (see ForDevice)
+	cache     *smartFoldersCache // Only set for the view of a device
+}
+
+// The virtual dirs of the view of a device. They are computed once per view (a request) instead of once per item
+type smartFoldersCache struct {
+	mutex      sync.Mutex
+	groups     map[string][]*smartFolderGroup // by category
+	recent     []string
+	mostPlayed []string
+	hasRecent  bool
+	hasMost    bool
+}
+
+func NewSmartFoldersStationsModel(model StationsModel, playbacks PlaybackManager) SmartFoldersStationsModel {
+
+	return SmartFoldersStationsModel{
+		model:     model,
+		playbacks: playbacks,
+	}
+}
+
+// The tags of a category - sorted by title
+func (m SmartFoldersStationsModel) groups(category string) []*smartFolderGroup {
+
+	if m.cache == nil {
+		return m.taggedGroups(category)
+	}
+	m.cache.mutex.Lock()
+	defer m.cache.mutex.Unlock()
+	groups, ok := m.cache.groups[category]
+	if !ok {
+		groups = m.taggedGroups(category)
+		m.cache.groups[category] = groups
+	}
+	return groups
+}
+
+func (m SmartFoldersStationsModel) taggedGroups(category string) []*smartFolderGroup {
+
+	taggedModel, ok := m.model.(TaggedStationsModel)
+	if !ok {
+		return nil
+	}
+	tagged := taggedModel.TaggedStations(category)
+	tags := []string{}
+	for tag := range tagged {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	// tags that only differ in case are merged
+	groups := []*smartFolderGroup{}
+	byKey := map[string]*smartFolderGroup{}
+	for _, tag := range tags {
+		key := strings.ToLower(tag)
+		group, ok := byKey[key]
+		if !ok {
+			runes := []rune(tag)
+			group = &smartFolderGroup{key: key, title: strings.ToUpper(string(runes[:1])) + string(runes[1:])}
+			byKey[key] = group
+			groups = append(groups, group)
+		}
+		group.ids = append(group.ids, tagged[tag]...)
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return strings.ToLower(groups[i].title) < strings.ToLower(groups[j].title) })
+	return groups
+}
+
+func (m SmartFoldersStationsModel) group(category string, key string) *smartFolderGroup {
+
+	for _, group := range m.groups(category) {
+		if group.key == key {
+			return group
+		}
+	}
+	return nil
+}
+
+// Whether the station still exists
+func (m SmartFoldersStationsModel) isStation(stationId string) bool {
+
+	if item, id := m.model.Data(&stationId, -1); len(id) > 0 {
+		_, ok := item.(ItemStation)
+		return ok
+	}
+	return false
+}
+
+// The stations the device played - the latest first
+func (m SmartFoldersStationsModel) recent() []string {
+
+	if m.cache == nil {
+		return m.recentlyPlayed()
+	}
+	m.cache.mutex.Lock()
+	defer m.cache.mutex.Unlock()
+	if !m.cache.hasRecent {
+		m.cache.recent, m.cache.hasRecent = m.recentlyPlayed(), true
+	}
+	return m.cache.recent
+}
+
+func (m SmartFoldersStationsModel) recentlyPlayed() []string {
+
+	if m.playbacks == nil || len(m.mac) == 0 {
+		return nil
+	}
+	ids := []string{}
+	seen := map[string]bool{}
+	add := func(stationId string) {
+		if seen[stationId] || len(ids) >= smartFolderRecentCount {
+			return
+		}
+		seen[stationId] = true
+		if m.isStation(stationId) {
+			ids = append(ids, stationId)
+		}
+	}
+	if playback, ok := m.playbacks.Playback(m.mac); ok {
+		add(playback.StationId)
+	}
+	for _, entry := range m.playbacks.DeviceHistory(m.mac) {
+		add(entry.StationId)
+	}
+	return ids
+}
+
+// The stations the device listened to the longest
+func (m SmartFoldersStationsModel) mostPlayed() []string {
+
+	if m.cache == nil {
+		return m.longestPlayed()
+	}
+	m.cache.mutex.Lock()
+	defer m.cache.mutex.Unlock()
+	if !m.cache.hasMost {
+		m.cache.mostPlayed, m.cache.hasMost = m.longestPlayed(), true
+	}
+	return m.cache.mostPlayed
+}
+
+func (m SmartFoldersStationsModel) longestPlayed() []string {
+
+	if m.playbacks == nil || len(m.mac) == 0 {
+		return nil
+	}
+	durations := map[string]time.Duration{}
+	ids := []string{}
+	for _, entry := range m.playbacks.DeviceHistory(m.mac) {
+		if _, ok := durations[entry.StationId]; !ok {
+			ids = append(ids, entry.StationId)
+		}
+		durations[entry.StationId] += entry.Duration
+	}
+	// the latest played first on equal durations
+	sort.SliceStable(ids, func(i, j int) bool { return durations[ids[i]] > durations[ids[j]] })
+	mostPlayed := []string{}
+	for _, stationId := range ids {
+		if len(mostPlayed) >= smartFolderRecentCount {
+			break
+		} else if m.isStation(stationId) {
+			mostPlayed = append(mostPlayed, stationId)
+		}
+	}
+	return mostPlayed
+}
+
+// The ids of the virtual dirs of the root menu (empty dirs are omitted)
+func (m SmartFoldersStationsModel) folders() []string {
+
+	ids := []string{}
+	for _, smartFolder := range smartFolderCategories {
+		if len(m.groups(smartFolder.category)) > 0 {
+			ids = append(ids, smartFolderIdPrefix+smartFolder.category)
+		}
+	}
+	if len(m.recent()) > 0 {
+		ids = append(ids, smartFolderRecentId)
+	}
+	if len(m.mostPlayed()) > 0 {
+		ids = append(ids, smartFolderMostPlayedId)
+	}
+	return ids
+}
+
+// The child items of a virtual dir
+func (m SmartFoldersStationsModel) children(id string) (count int, child func(index int) (Item, string)) {
+
+	station := func(ids []string) func(index int) (Item, string) {
+		return func(i int) (Item, string) { return m.model.Data(&ids[i], -1) }
+	}
+	if id == smartFolderRecentId {
+		recent := m.recent()
+		return len(recent), station(recent)
+	} else if id == smartFolderMostPlayedId {
+		mostPlayed := m.mostPlayed()
+		return len(mostPlayed), station(mostPlayed)
+	}
+	category, key, isGroup := strings.Cut(strings.TrimPrefix(id, smartFolderIdPrefix), ":")
+	if !isGroup {
+		groups := m.groups(category)
+		return len(groups), func(i int) (Item, string) { return m.groupItem(category, groups[i]) }
+	} else if group := m.group(category, key); group != nil {
+		return len(group.ids), station(group.ids)
+	}
+	return 0, nil
+}
+
+func (m SmartFoldersStationsModel) groupItem(category string, group *smartFolderGroup) (Item, string) {
+
+	return ItemDir{Title: fmt.Sprintf("%s (%d)", group.title, len(group.ids))}, smartFolderIdPrefix + category + ":" + group.key
+}
+
+// The virtual dir with the id
+func (m SmartFoldersStationsModel) item(id string) (Item, string) {
+
+	if id == smartFolderRecentId {
+		return ItemDir{Title: "Recently played"}, id
+	} else if id == smartFolderMostPlayedId {
+		return ItemDir{Title: "Most played"}, id
+	}
+	category, key, isGroup := strings.Cut(strings.TrimPrefix(id, smartFolderIdPrefix), ":")
+	for _, smartFolder := range smartFolderCategories {
+		if smartFolder.category != category {
+			continue
+		} else if !isGroup {
+			return ItemDir{Title: smartFolder.title}, id
+		} else if group := m.group(category, key); group != nil {
+			return m.groupItem(category, group)
+		}
+	}
+	return ItemDir{}, ""
+}
+
+func (m SmartFoldersStationsModel) Data(parentId *string, index int) (Item, string) {
+
+	if parentId == nil {
+		// root
+		if count := m.model.Count(nil); index < count {
+			return m.model.Data(nil, index)
+		} else if folders := m.folders(); index-count < len(folders) {
+			return m.item(folders[index-count])
+		}
+	} else if strings.HasPrefix(*parentId, smartFolderIdPrefix) {
+		if index < 0 {
+			// the item with id
+			return m.item(*parentId)
+		} else if count, child := m.children(*parentId); index < count {
+			return child(index)
+		}
+	} else {
+		return m.model.Data(parentId, index)
+	}
+	return ItemDir{}, ""
+}
+
+func (m SmartFoldersStationsModel) Count(parentId *string) int {
+
+	if parentId == nil {
+		// root
+		return m.model.Count(nil) + len(m.folders())
+	} else if strings.HasPrefix(*parentId, smartFolderIdPrefix) {
+		count, _ := m.children(*parentId)
+		return count
+	}
+	return m.model.Count(parentId)
+}
+
+// The view is meant for a single request - the virtual dirs are computed once and don't change afterwards
+func (m SmartFoldersStationsModel) ForDevice(mac string) StationsModel {
+
+	model := m.model
+	if deviceModel, ok := model.(DeviceStationsModel); ok {
+		model = deviceModel.ForDevice(mac)
+	}
+	return SmartFoldersStationsModel{
+		model:     model,
+		playbacks: m.playbacks,
+		mac:       mac,
+		cache:     &smartFoldersCache{groups: map[string][]*smartFolderGroup{}},
+	}
+}
+
+func (m SmartFoldersStationsModel) Played(mac string, stationId string) {
+
+	if deviceModel, ok := m.model.(DeviceStationsModel); ok {
+		deviceModel.Played(mac, stationId)
+	}
+}
+
+func (m SmartFoldersStationsModel) Search(query string) []string {
+
+	if searcher, ok := m.model.(Searcher); ok {
+		return searcher.Search(query)
+	}
+	return []string{}
+}
+
+func (m SmartFoldersStationsModel) TaggedStations(category string) map[string][]string {
+
+	if taggedModel, ok := m.model.(TaggedStationsModel); ok {
+		return taggedModel.TaggedStations(category)
+	}
+	return map[string][]string{}
+}
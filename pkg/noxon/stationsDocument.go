@@ -0,0 +1,189 @@
+package noxon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+var templatePlaceholder = regexp.MustCompile(`\{([a-zA-Z0-9_-]+)\}`)
+
+// A yaml or toml station list. Unlike stations.json it may contain comments, url templates and includes
+type stationsDocument struct {
+	// Urls with {placeholders} by name - available in the included files too
+	Templates map[string]string   `json:"templates"`
+	Stations  []*stationsDocEntry `json:"stations"`
+}
+
+type stationsDocEntry struct {
+	Entry
+	// The url of the station is the template with the placeholders replaced by the params
+	Template string              `json:"template"`
+	Params   map[string]string   `json:"params"`
+	Include  string              `json:"include"` // The entries of another file (relative to this file)
+	Children []*stationsDocEntry `json:"children"`
+}
+
+type stationsDocumentLoader struct {
+	files []string // every file that was read
+	stack []string // the includes that are being loaded
+}
+
+// Loads a station list of any format and converts it to json (see ImportStations). Yaml and toml files may include
+// other files. Returns the loaded files
+func ImportStationsFile(file string, format string) ([]byte, []string, error) {
+
+	loader := &stationsDocumentLoader{}
+	entries, err := loader.load(file, format, map[string]string{})
+	if err != nil {
+		return nil, loader.files, err
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	return data, loader.files, err
+}
+
+func (l *stationsDocumentLoader) load(file string, format string, templates map[string]string) ([]*Entry, error) {
+
+	if absolute, err := filepath.Abs(file); err == nil {
+		file = absolute
+	}
+	for i, included := range l.stack {
+		if included == file {
+			return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(l.stack[i:], " -> "), file)
+		}
+	}
+	l.stack = append(l.stack, file)
+	defer func() { l.stack = l.stack[:len(l.stack)-1] }()
+
+	data, err := os.ReadFile(file)
+	l.files = append(l.files, file)
+	if err != nil {
+		return nil, err
+	}
+	if len(format) == 0 {
+		format = DetectStationsFormat(file)
+	}
+	entries, err := l.parse(data, format, filepath.Dir(file), templates)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return entries, nil
+}
+
+// Includes are relative to dir
+func (l *stationsDocumentLoader) parse(data []byte, format string, dir string, templates map[string]string) ([]*Entry, error) {
+
+	var document interface{}
+	switch format {
+	case StationsFormatYaml:
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, err
+		}
+	case StationsFormatToml:
+		if _, err := toml.Decode(string(data), &document); err != nil {
+			return nil, err
+		}
+	default:
+		// other formats can be included but don't support includes and templates
+		converted, err := ImportStations(format, data)
+		if err != nil {
+			return nil, err
+		}
+		entries := []*Entry{}
+		if err := json.Unmarshal(converted, &entries); err != nil {
+			return nil, err
+		}
+		return entries, nil
+	}
+
+	// a plain list of entries (without templates)
+	if list, ok := document.([]interface{}); ok {
+		document = map[string]interface{}{"stations": list}
+	}
+	// yaml and toml are mapped to the json structure (the field names are the same)
+	converted, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	parsed := stationsDocument{}
+	decoder := json.NewDecoder(bytes.NewReader(converted))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&parsed); err != nil {
+		return nil, err
+	}
+
+	// the templates of the including file can be overwritten
+	merged := map[string]string{}
+	for name, template := range templates {
+		merged[name] = template
+	}
+	for name, template := range parsed.Templates {
+		merged[name] = template
+	}
+	return l.convert(parsed.Stations, dir, merged)
+}
+
+func (l *stationsDocumentLoader) convert(docEntries []*stationsDocEntry, dir string, templates map[string]string) ([]*Entry, error) {
+
+	entries := []*Entry{}
+	for _, docEntry := range docEntries {
+		if docEntry == nil {
+			continue
+		}
+		entry := docEntry.Entry
+		if len(docEntry.Include) > 0 {
+			included, err := l.load(filepath.Join(dir, docEntry.Include), "", templates)
+			if err != nil {
+				return nil, err
+			}
+			if !entry.isDir() {
+				// without a dir the entries are inserted in place
+				entries = append(entries, included...)
+				continue
+			}
+			entry.Children = append(entry.Children, included...)
+		}
+		if len(docEntry.Template) > 0 {
+			stationUrl, err := applyTemplate(templates, docEntry.Template, docEntry.Params)
+			if err != nil {
+				return nil, fmt.Errorf("station '%s': %w", entry.StationName, err)
+			}
+			entry.StationUrl = stationUrl
+		}
+		children, err := l.convert(docEntry.Children, dir, templates)
+		if err != nil {
+			return nil, err
+		}
+		entry.Children = append(children, entry.Children...)
+		entries = append(entries, &entry)
+	}
+	return entries, nil
+}
+
+func applyTemplate(templates map[string]string, name string, params map[string]string) (string, error) {
+
+	template, ok := templates[name]
+	if !ok {
+		return "", fmt.Errorf("unknown template '%s'", name)
+	}
+	var missing []string
+	stationUrl := templatePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		param := placeholder[1 : len(placeholder)-1]
+		value, ok := params[param]
+		if !ok {
+			missing = append(missing, param)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing params %s of template '%s'", strings.Join(missing, ", "), name)
+	}
+	return stationUrl, nil
+}
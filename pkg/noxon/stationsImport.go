@@ -0,0 +1,229 @@
+package noxon
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Formats of the stations file (see ImportStations)
+const (
+	StationsFormatJson = "json"
+	StationsFormatM3U  = "m3u"
+	StationsFormatPLS  = "pls"
+	StationsFormatOPML = "opml"
+	StationsFormatCSV  = "csv"
+	StationsFormatYaml = "yaml"
+	StationsFormatToml = "toml"
+)
+
+var stationsFormatExtensions = map[string]string{
+	".json": StationsFormatJson,
+	".m3u":  StationsFormatM3U,
+	".m3u8": StationsFormatM3U,
+	".pls":  StationsFormatPLS,
+	".opml": StationsFormatOPML,
+	".csv":  StationsFormatCSV,
+	".yaml": StationsFormatYaml,
+	".yml":  StationsFormatYaml,
+	".toml": StationsFormatToml,
+}
+
+// The format of the stations file by its extension (json if unknown)
+func DetectStationsFormat(file string) string {
+
+	if format, ok := stationsFormatExtensions[strings.ToLower(filepath.Ext(file))]; ok {
+		return format
+	}
+	return StationsFormatJson
+}
+
+// Converts a station list to the json format of the stations.json file:
+//   - m3u: the group-title (or #EXTGRP) of an entry is its folder
+//   - pls: a flat list
+//   - opml: outlines with a url are stations, outlines with children are folders
+//   - csv: a header row with the columns name, url, folder and description (in any order)
+//   - yaml and toml: like stations.json plus comments, url templates and includes (see ImportStationsFile)
+//
+// Nested folders are separated by a "/"
+func ImportStations(format string, data []byte) ([]byte, error) {
+
+	tree := newStationsTree()
+	switch strings.ToLower(format) {
+	case StationsFormatJson, "":
+		return data, nil
+	case StationsFormatM3U:
+		for _, entry := range parseM3U(data) {
+			tree.addStation(entry.Group, entry.Title, "", entry.Url)
+		}
+	case StationsFormatPLS:
+		for _, entry := range parsePLS(data) {
+			tree.addStation("", entry.Title, "", entry.Url)
+		}
+	case StationsFormatOPML:
+		if err := importOPML(data, tree); err != nil {
+			return nil, err
+		}
+	case StationsFormatCSV:
+		if err := importCSV(data, tree); err != nil {
+			return nil, err
+		}
+	case StationsFormatYaml, StationsFormatToml:
+		loader := &stationsDocumentLoader{}
+		entries, err := loader.parse(data, format, ".", map[string]string{})
+		if err != nil {
+			return nil, err
+		}
+		return json.MarshalIndent(entries, "", "  ")
+	default:
+		return nil, fmt.Errorf("unknown stations format '%s'", format)
+	}
+	return json.MarshalIndent(tree.root.Children, "", "  ")
+}
+
+// Builds the entries - folders keep the order of their first appearance
+type stationsTree struct {
+	root *Entry
+	dirs map[string]*Entry // by path
+}
+
+func newStationsTree() *stationsTree {
+
+	return &stationsTree{
+		root: &Entry{Children: []*Entry{}},
+		dirs: map[string]*Entry{},
+	}
+}
+
+func (t *stationsTree) dir(path string) *Entry {
+
+	dir := t.root
+	dirPath := ""
+	for _, name := range strings.Split(path, "/") {
+		if name = strings.TrimSpace(name); len(name) == 0 {
+			continue
+		}
+		dirPath += "/" + name
+		child, ok := t.dirs[dirPath]
+		if !ok {
+			child = &Entry{DirName: name, Children: []*Entry{}}
+			t.dirs[dirPath] = child
+			dir.Children = append(dir.Children, child)
+		}
+		dir = child
+	}
+	return dir
+}
+
+func (t *stationsTree) addStation(path string, name string, description string, stationUrl string) {
+
+	stationUrl = strings.TrimSpace(stationUrl)
+	if err := validateStationUrl(stationUrl); err != nil {
+		// e.g. a local file or a mms:// url of a playlist
+		log.Warnf("Stations: skipping '%s' of %s: %s", name, path, err.Error())
+		return
+	}
+	if name = strings.TrimSpace(name); len(name) == 0 {
+		name = stationUrl
+	}
+	dir := t.dir(path)
+	dir.Children = append(dir.Children, &Entry{
+		StationName:        name,
+		StationDescription: strings.TrimSpace(description),
+		StationUrl:         stationUrl,
+	})
+}
+
+type opmlOutline struct {
+	Text     string        `xml:"text,attr"`
+	Title    string        `xml:"title,attr"`
+	Subtext  string        `xml:"subtext,attr"`
+	Url      string        `xml:"URL,attr"`
+	UrlLower string        `xml:"url,attr"`
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+type opmlDocument struct {
+	XMLName  xml.Name      `xml:"opml"`
+	Outlines []opmlOutline `xml:"body>outline"`
+}
+
+func importOPML(data []byte, tree *stationsTree) error {
+
+	document := opmlDocument{}
+	if err := xml.Unmarshal(data, &document); err != nil {
+		return err
+	}
+	var importOutlines func(outlines []opmlOutline, path string)
+	importOutlines = func(outlines []opmlOutline, path string) {
+		for _, outline := range outlines {
+			name := outline.Text
+			if len(name) == 0 {
+				name = outline.Title
+			}
+			if stationUrl := outline.Url + outline.UrlLower; len(stationUrl) > 0 {
+				tree.addStation(path, name, outline.Subtext, stationUrl)
+			} else if len(outline.Outlines) > 0 {
+				dirPath := path + "/" + strings.ReplaceAll(name, "/", " ")
+				tree.dir(dirPath)
+				importOutlines(outline.Outlines, dirPath)
+			}
+		}
+	}
+	importOutlines(document.Outlines, "")
+	return nil
+}
+
+func importCSV(data []byte, tree *stationsTree) error {
+
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\ufeff"))))
+	// spreadsheets often export with semicolons
+	if header, _, _ := bytes.Cut(data, []byte("\n")); bytes.Count(header, []byte(";")) > bytes.Count(header, []byte(",")) {
+		reader.Comma = ';'
+	}
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	columns := map[string]int{}
+	for i, column := range header {
+		switch strings.ToLower(strings.TrimSpace(column)) {
+		case "name", "stationname":
+			columns["name"] = i
+		case "url", "stationurl":
+			columns["url"] = i
+		case "folder", "path", "dir", "dirname":
+			columns["folder"] = i
+		case "description", "stationdescription":
+			columns["description"] = i
+		}
+	}
+	if _, ok := columns["url"]; !ok {
+		return fmt.Errorf("the csv file has no url column")
+	}
+	field := func(record []string, column string) string {
+		if i, ok := columns[column]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(strings.TrimSpace(field(record, "url"))) > 0 {
+			tree.addStation(field(record, "folder"), field(record, "name"), field(record, "description"), field(record, "url"))
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package noxon
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Folds a text for comparison: lower case without accents ("Café" becomes "cafe")
+func foldText(text string) string {
+
+	folder := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(folder, text)
+	if err != nil {
+		folded = text
+	}
+	return strings.ToLower(folded)
+}
+
+// The folded words of a search query
+func searchWords(query string) []string {
+
+	return strings.Fields(foldText(query))
+}
+
+// Every word has to be part of one of the texts (e.g. the name, the description and the names of the parent dirs)
+func matchesQuery(words []string, texts ...string) bool {
+
+	if len(words) == 0 {
+		return false
+	}
+	haystack := foldText(strings.Join(texts, "\n"))
+	for _, word := range words {
+		if !strings.Contains(haystack, word) {
+			return false
+		}
+	}
+	return true
+}
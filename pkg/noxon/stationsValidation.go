@@ -0,0 +1,253 @@
+package noxon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The display of the radios truncates longer texts
+const maxNameLength = 40
+const maxDescriptionLength = 120
+
+// A problem of a stations file. Warnings don't prevent the file from being loaded, invalid entries are skipped and
+// only errors of the file itself (like a syntax error) prevent it from being loaded
+type ValidationError struct {
+	Line    int    // Starts with 1 (0 if unknown)
+	Column  int    // Starts with 1 (0 if unknown)
+	Path    string // The names of the entry and its parents
+	Message string
+	Warning bool
+	entry   string // The indices of the invalid entry and its parents ("0/2") - empty if the file is invalid
+}
+
+func (e ValidationError) Error() string {
+
+	severity := "error"
+	if e.Warning {
+		severity = "warning"
+	}
+	message := fmt.Sprintf("%s: %s", severity, e.Message)
+	if len(e.Path) > 0 {
+		message += fmt.Sprintf(" (%s)", e.Path)
+	}
+	if e.Line > 0 {
+		return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, message)
+	}
+	return message
+}
+
+type ValidationErrors []ValidationError
+
+// Only the errors - without the warnings
+func (e ValidationErrors) Errors() ValidationErrors {
+
+	errs := ValidationErrors{}
+	for _, err := range e {
+		if !err.Warning {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// The errors that prevent the whole file from being loaded
+func (e ValidationErrors) FileErrors() ValidationErrors {
+
+	errs := ValidationErrors{}
+	for _, err := range e.Errors() {
+		if len(err.entry) == 0 {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func (e ValidationErrors) Error() string {
+
+	messages := []string{}
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// An entry without its children
+type validatedEntry struct {
+	Id                 string           `json:"id"`
+	DirName            string           `json:"dirName"`
+	StationName        string           `json:"stationName"`
+	StationDescription string           `json:"stationDescription"`
+	StationUrl         string           `json:"stationUrl"`
+	AlternativeUrls    []AlternativeUrl `json:"alternativeUrls"`
+	Transcode          string           `json:"transcode"`
+	Bitrate            int              `json:"bitrate"`
+	Tls                *TlsOptions      `json:"tls"`
+	Tags               []string         `json:"tags"`
+	Language           string           `json:"language"`
+	Country            string           `json:"country"`
+	Children           json.RawMessage  `json:"children"`
+}
+
+type stationsValidator struct {
+	data []byte
+	ids  map[string]string // path by explicit id
+	errs ValidationErrors
+}
+
+// Validates a stations.json file: syntax, entries that are both dir and station (or neither), urls, duplicates and
+// texts the radios can't display
+func ValidateStations(jsonData []byte) ValidationErrors {
+
+	v := &stationsValidator{data: jsonData, ids: map[string]string{}, errs: ValidationErrors{}}
+	if err := json.Unmarshal(jsonData, &[]json.RawMessage{}); err != nil {
+		v.addJsonError(err, 0, "", "")
+		return v.errs
+	}
+	v.validateList(jsonData, 0, "", "")
+	return v.errs
+}
+
+// Converts the offset to line and column
+func (v *stationsValidator) position(offset int) (int, int) {
+
+	if offset > len(v.data) {
+		offset = len(v.data)
+	}
+	line := bytes.Count(v.data[:offset], []byte("\n")) + 1
+	column := utf8.RuneCount(v.data[bytes.LastIndexByte(v.data[:offset], '\n')+1:offset]) + 1
+	return line, column
+}
+
+func (v *stationsValidator) add(offset int, path string, entry string, warning bool, format string, args ...any) {
+
+	line, column := v.position(offset)
+	v.errs = append(v.errs, ValidationError{
+		Line:    line,
+		Column:  column,
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+		Warning: warning,
+		entry:   entry,
+	})
+}
+
+func (v *stationsValidator) addJsonError(err error, base int, path string, entry string) {
+
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &syntaxError) {
+		// the offset points behind the invalid character
+		v.add(base+int(syntaxError.Offset)-1, path, entry, false, "%s", syntaxError.Error())
+	} else if errors.As(err, &typeError) {
+		v.add(base+int(typeError.Offset), path, entry, false, "%s", typeError.Error())
+	} else {
+		v.add(base, path, entry, false, "%s", err.Error())
+	}
+}
+
+// Validates a list of entries that starts at offset base of the file. The list belongs to the entry parent (empty for
+// the root list)
+func (v *stationsValidator) validateList(list []byte, base int, path string, parent string) {
+
+	decoder := json.NewDecoder(bytes.NewReader(list))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		v.add(base, path, parent, false, "expected a list of entries")
+		return
+	}
+	names := map[string]bool{}
+	for index := 0; decoder.More(); index++ {
+		offset := int(decoder.InputOffset())
+		raw := json.RawMessage{}
+		if err := decoder.Decode(&raw); err != nil {
+			v.addJsonError(err, base, path, parent)
+			return
+		}
+		// skip the separator of the previous entry
+		offset += bytes.Index(list[offset:], raw)
+		v.validateEntry(raw, base+offset, path, strings.TrimPrefix(parent+"/"+strconv.Itoa(index), "/"), names)
+	}
+}
+
+func (v *stationsValidator) validateEntry(raw []byte, offset int, parentPath string, index string, names map[string]bool) {
+
+	entry := validatedEntry{}
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		v.addJsonError(err, offset, parentPath, index)
+		return
+	}
+	name := entry.DirName + entry.StationName
+	path := name
+	if len(parentPath) > 0 {
+		path = parentPath + " / " + name
+	}
+
+	isDir, isStation := len(entry.DirName) > 0, len(entry.StationName) > 0
+	if isDir && isStation {
+		v.add(offset, path, index, false, "the entry is both a dir (dirName) and a station (stationName)")
+	} else if !isDir && !isStation {
+		v.add(offset, path, index, false, "the entry is neither a dir (dirName) nor a station (stationName)")
+	}
+	if isDir && len(entry.StationUrl) > 0 {
+		v.add(offset, path, index, true, "the stationUrl of a dir is ignored")
+	}
+	if isStation && !isDir {
+		if len(entry.StationUrl) == 0 {
+			v.add(offset, path, index, false, "the station has no stationUrl")
+		} else if err := validateStationUrl(entry.StationUrl); err != nil {
+			v.add(offset, path, index, false, "invalid stationUrl: %s", err.Error())
+		}
+		for _, alternative := range entry.AlternativeUrls {
+			if err := validateStationUrl(alternative.Url); err != nil {
+				v.add(offset, path, index, true, "invalid alternative url is ignored: %s", err.Error())
+			}
+		}
+		if len(entry.Children) > 0 && string(entry.Children) != "null" && string(entry.Children) != "[]" {
+			v.add(offset, path, index, true, "the children of a station are ignored")
+		}
+	}
+	switch entry.Transcode {
+	case TranscodeAuto, TranscodeAlways, TranscodeNever:
+	default:
+		v.add(offset, path, index, false, "invalid transcode '%s' (expected '%s' or '%s')", entry.Transcode, TranscodeAlways, TranscodeNever)
+	}
+
+	if names[name] && len(name) > 0 {
+		v.add(offset, path, index, true, "duplicate name '%s' in the same dir", name)
+	}
+	names[name] = true
+	if len(entry.Id) > 0 {
+		if other, ok := v.ids[entry.Id]; ok {
+			v.add(offset, path, index, false, "duplicate id '%s' (already used by %s)", entry.Id, other)
+		}
+		v.ids[entry.Id] = path
+	}
+	if length := utf8.RuneCountInString(name); length > maxNameLength {
+		v.add(offset, path, index, true, "the name is too long to be displayed (%d > %d characters)", length, maxNameLength)
+	}
+	if length := utf8.RuneCountInString(entry.StationDescription); length > maxDescriptionLength {
+		v.add(offset, path, index, true, "the description is too long to be displayed (%d > %d characters)", length, maxDescriptionLength)
+	}
+
+	if isDir && len(entry.Children) > 0 && string(entry.Children) != "null" {
+		v.validateList(entry.Children, offset+bytes.Index(raw, entry.Children), path, index)
+	}
+}
+
+func validateStationUrl(stationUrl string) error {
+
+	parsed, err := url.Parse(stationUrl)
+	if err != nil {
+		return err
+	} else if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("'%s' is not a http(s) url", stationUrl)
+	} else if len(parsed.Host) == 0 {
+		return fmt.Errorf("'%s' has no host", stationUrl)
+	}
+	return nil
+}
@@ -0,0 +1,687 @@
+package noxon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const streamChunkSize = 16 * 1024
+
+const maxUpstreamRedirects = 10
+
+// Number of chunks a listener may lag behind before the upstream is slowed down
+const streamListenerBacklog = 64
+
+// A listener that doesn't take any data for this long gets dropped (so it doesn't stall the other listeners)
+const streamListenerTimeout = 5 * time.Second
+
+// Recent bytes of a stream that are replayed to a new listener so the device buffer fills up quickly
+const streamRingSize = 128 * 1024
+
+// Headers of the upstream response that are forwarded to the device
+var forwardedStreamHeaders = []string{"Content-Type", "icy-name", "icy-genre", "icy-description", "icy-url", "icy-br", "icy-sr", "icy-pub"}
+
+// Headers of the device request that are forwarded to the upstream (some broadcasters serve other formats or nothing
+// at all depending on the user agent). The upstream is shared, so the headers of the device opening it are sent.
+// Icy-MetaData is always requested because the metadata is stripped and inserted again for each device and Range is
+// dropped since a shared live stream can't be seeked
+var forwardedDeviceHeaders = []string{"User-Agent", "Accept", "Accept-Language"}
+
+type streamOpener func() (io.ReadCloser, http.Header, error)
+
+type streamListener struct {
+	chunks    chan []byte   // closed when the listener is removed from the stream
+	done      chan struct{} // closed before chunks to wake up a waiting send
+	doneOnce  sync.Once
+	sendMutex sync.Mutex // chunks is only closed if no send is in progress
+	mac       string
+	stationId string
+	startTime time.Time
+}
+
+// Hands the chunk to the listener. Waits up to timeout if the listener lags behind - false if it didn't take the chunk
+func (l *streamListener) send(chunk []byte, timeout time.Duration) bool {
+
+	l.sendMutex.Lock()
+	defer l.sendMutex.Unlock()
+	select {
+	case <-l.done:
+		return true
+	case l.chunks <- chunk:
+		return true
+	default:
+	}
+	if timeout <= 0 {
+		return false
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-l.done:
+		return true
+	case l.chunks <- chunk:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (l *streamListener) close() {
+
+	l.doneOnce.Do(func() {
+		close(l.done)
+		l.sendMutex.Lock()
+		close(l.chunks)
+		l.sendMutex.Unlock()
+	})
+}
+
+// A sharedStream reads one (possibly transcoded) upstream and distributes it to all listening devices
+type sharedStream struct {
+	url        string
+	key        string // See streamKey
+	header     http.Header
+	source     io.ReadCloser
+	openOnce   sync.Once
+	openErr    error
+	mutex      sync.Mutex
+	listeners  map[*streamListener]struct{}
+	ring       [][]byte
+	ringSize   int
+	title      string
+	lastData   time.Time  // The upstream sent data or the pump stopped waiting for the listeners
+	delivering bool       // The pump waits for a lagging listener - the upstream doesn't stall then
+	framer     *mp3Framer // Only set if stalls are bridged with silence
+	closed     bool
+	onClosed   func(*sharedStream)
+	onTitle    func(*sharedStream, string)
+}
+
+// The streamHub keeps a single upstream connection per stream (see streamKey) regardless of the number of listening
+// devices
+type streamHub struct {
+	mutex     sync.Mutex
+	streams   map[string]*sharedStream
+	playbacks PlaybackManager
+	finite    int // Number of finite streams opened so far - each one gets its own key
+}
+
+func newStreamHub(playbacks PlaybackManager) *streamHub {
+
+	return &streamHub{
+		mutex:     sync.Mutex{},
+		streams:   map[string]*sharedStream{},
+		playbacks: playbacks,
+	}
+}
+
+// Subscribes to the stream without tracking a playback. The upstream is not opened until sharedStream.open is called
+func (h *streamHub) listen(station Station, name string, stationId string) (*sharedStream, *streamListener, error) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	key := streamKey(station)
+	if station.Finite {
+		// A finite source (e.g. a podcast episode) is played from the start by every listener - it is never shared
+		h.finite++
+		key = fmt.Sprintf("%s|finite-%d", key, h.finite)
+	}
+	stream, ok := h.streams[key]
+	if !ok || stream.isClosed() {
+		stream = newSharedStream(station.StreamUrl, h.remove, h.updateTitle)
+		stream.key = key
+		h.streams[key] = stream
+	}
+	listener, err := stream.subscribe(name, stationId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stream, listener, nil
+}
+
+// Tracks the playback of a device listening to the stream. Only called once the upstream was opened - a stream that
+// could not be opened (or redirected the device) is no playback
+func (h *streamHub) attach(stream *sharedStream, listener *streamListener) {
+
+	// Device starts playback
+	h.playbacks.StartPlayback(listener.mac, Playback{
+		StationId: listener.stationId,
+		StreamUrl: stream.url,
+		Title:     stream.currentTitle(),
+		StartTime: listener.startTime,
+	})
+}
+
+// Devices only share an upstream if it is requested the same way - the same url with the same transcoding, HLS bandwidth
+// and TLS options. Finite sources are not shared at all (see listen)
+func streamKey(station Station) string {
+
+	return fmt.Sprintf("%s|%s|%d|%+v", station.StreamUrl, station.Transcode, station.Bandwidth, station.Tls.key())
+}
+
+// Detaches a device from the stream (see attach). The upstream is closed if the last device leaves
+func (h *streamHub) detach(stream *sharedStream, listener *streamListener) {
+
+	stream.unsubscribe(listener)
+
+	// Device stops playback (if it didn't switch to another stream in the meantime)
+	h.playbacks.StopPlayback(listener.mac, listener.startTime)
+}
+
+// Updates the "now playing" title of all devices listening to the stream
+func (h *streamHub) updateTitle(stream *sharedStream, title string) {
+
+	for _, listener := range stream.currentListeners() {
+		h.playbacks.UpdateTitle(listener.mac, listener.startTime, title)
+	}
+}
+
+func (h *streamHub) remove(stream *sharedStream) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.streams[stream.key] == stream {
+		delete(h.streams, stream.key)
+	}
+}
+
+func newSharedStream(streamUrl string, onClosed func(*sharedStream), onTitle func(*sharedStream, string)) *sharedStream {
+
+	return &sharedStream{
+		url:       streamUrl,
+		header:    http.Header{},
+		listeners: map[*streamListener]struct{}{},
+		onClosed:  onClosed,
+		onTitle:   onTitle,
+	}
+}
+
+// Opens the upstream once - concurrent callers wait for the first one. If fillGaps is set, stalls of a mp3 stream are
+// bridged with silence
+func (s *sharedStream) open(opener streamOpener, fillGaps bool) error {
+
+	s.openOnce.Do(func() {
+		s.source, s.header, s.openErr = opener()
+		if s.openErr != nil {
+			s.close()
+		} else {
+			log.Debugf("Opened upstream %s", s.url)
+			bridgeGaps := fillGaps && isDeviceContentType(s.header.Get("Content-Type"))
+			s.mutex.Lock()
+			s.lastData = time.Now()
+			if bridgeGaps {
+				s.framer = &mp3Framer{}
+			}
+			s.mutex.Unlock()
+			go s.pump()
+			if bridgeGaps {
+				go s.bridgeGaps()
+			}
+		}
+	})
+	return s.openErr
+}
+
+func (s *sharedStream) subscribe(mac string, stationId string) (*streamListener, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, fmt.Errorf("stream %s already closed", s.url)
+	}
+	listener := &streamListener{
+		chunks:    make(chan []byte, streamListenerBacklog+len(s.ring)),
+		done:      make(chan struct{}),
+		mac:       mac,
+		stationId: stationId,
+		startTime: time.Now(),
+	}
+	for _, chunk := range s.ring {
+		listener.chunks <- chunk
+	}
+	s.listeners[listener] = struct{}{}
+	return listener, nil
+}
+
+// The stream gets closed if the last listener leaves
+func (s *sharedStream) unsubscribe(listener *streamListener) {
+
+	s.mutex.Lock()
+	delete(s.listeners, listener)
+	lastListener := len(s.listeners) == 0
+	s.mutex.Unlock()
+	listener.close()
+	if lastListener {
+		s.close()
+	}
+}
+
+func (s *sharedStream) pump() {
+
+	defer s.close()
+	for {
+		chunk := make([]byte, streamChunkSize)
+		count, err := s.source.Read(chunk)
+		if count > 0 {
+			s.broadcast(chunk[:count])
+		}
+		if err != nil {
+			if err != io.EOF && !s.isClosed() {
+				log.Warnf("Upstream %s stopped: %s", s.url, err.Error())
+			}
+			s.mutex.Lock()
+			var rest []byte
+			if s.framer != nil {
+				rest = s.framer.flush()
+			}
+			s.mutex.Unlock()
+			if len(rest) > 0 {
+				s.deliver(rest)
+			}
+			return
+		}
+	}
+}
+
+// Hands the chunk to all listeners. The upstream is read at the pace of the slowest listener (a file is served faster
+// than it is played) unless it lags behind for longer than streamListenerTimeout
+func (s *sharedStream) broadcast(chunk []byte) {
+
+	s.mutex.Lock()
+	s.lastData = time.Now()
+	if s.framer != nil {
+		// Only complete frames so silence can be inserted in between
+		chunk = s.framer.frames(chunk)
+		if len(chunk) == 0 {
+			s.mutex.Unlock()
+			return
+		}
+	}
+	s.ring = append(s.ring, chunk)
+	s.ringSize += len(chunk)
+	for len(s.ring) > 1 && s.ringSize-len(s.ring[0]) >= streamRingSize {
+		s.ringSize -= len(s.ring[0])
+		s.ring = s.ring[1:]
+	}
+	s.mutex.Unlock()
+	s.deliver(chunk)
+}
+
+// Hands the chunk to all listeners. The listeners lagging behind are waited for - all of them together up to
+// streamListenerTimeout. Listeners that don't take the chunk until then are dropped
+func (s *sharedStream) deliver(chunk []byte) {
+
+	lagging := []*streamListener{}
+	for _, listener := range s.currentListeners() {
+		if !listener.send(chunk, 0) {
+			lagging = append(lagging, listener)
+		}
+	}
+	if len(lagging) == 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	s.delivering = true
+	s.mutex.Unlock()
+	deadline := time.Now().Add(streamListenerTimeout)
+	for _, listener := range lagging {
+		if !listener.send(chunk, time.Until(deadline)) {
+			log.Warnf("Dropping listener of stream %s - it can't keep up", s.url)
+			s.mutex.Lock()
+			delete(s.listeners, listener)
+			s.mutex.Unlock()
+			listener.close()
+		}
+	}
+	s.mutex.Lock()
+	s.delivering = false
+	s.lastData = time.Now()
+	s.mutex.Unlock()
+}
+
+func (s *sharedStream) currentListeners() []*streamListener {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	listeners := []*streamListener{}
+	for listener := range s.listeners {
+		listeners = append(listeners, listener)
+	}
+	return listeners
+}
+
+// Keeps the devices playing while the upstream stalls (e.g. during a reconnect). The silence is inserted between two
+// frames in the format of the stream - nothing is sent if the stream isn't in sync. The silence is not kept in the ring
+func (s *sharedStream) bridgeGaps() {
+
+	ticker := time.NewTicker(silenceInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mutex.Lock()
+		closed, stalled := s.closed, !s.delivering && time.Since(s.lastData) > silenceGapThreshold
+		var silence []byte
+		if stalled {
+			silence = s.framer.silence(silenceInterval)
+		}
+		s.mutex.Unlock()
+		if closed {
+			return
+		} else if len(silence) > 0 {
+			// Listeners that are still busy with the data don't need silence
+			for _, listener := range s.currentListeners() {
+				listener.send(silence, 0)
+			}
+		}
+	}
+}
+
+func (s *sharedStream) setTitle(title string) {
+
+	s.mutex.Lock()
+	changed := s.title != title
+	s.title = title
+	s.mutex.Unlock()
+	if changed {
+		log.Debugf("Stream %s now playing: %s", s.url, title)
+		if s.onTitle != nil {
+			s.onTitle(s, title)
+		}
+	}
+}
+
+func (s *sharedStream) currentTitle() string {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.title
+}
+
+func (s *sharedStream) isClosed() bool {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+func (s *sharedStream) close() {
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+	s.closed = true
+	listeners := s.listeners
+	s.listeners = map[*streamListener]struct{}{}
+	s.ring = nil
+	s.mutex.Unlock()
+
+	for listener := range listeners {
+		listener.close()
+	}
+
+	if s.source != nil {
+		s.source.Close()
+		log.Debugf("Closed upstream %s", s.url)
+	}
+	if s.onClosed != nil {
+		s.onClosed(s)
+	}
+}
+
+// Notifications about an upstream
+type upstreamEvents struct {
+	// The StreamTitle of the ICY metadata changed
+	onTitle func(string)
+	// The upstream was redirected (server side) to another url
+	onMoved func(string)
+}
+
+type prefixedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Opens the upstream of the station - transcoded if the device can't decode it. The ICY metadata is stripped and the
+// StreamTitle is reported via the events
+func (n *NoxonServer) openStationStream(stationId string, station Station, requestHeader http.Header, events upstreamEvents) (io.ReadCloser, http.Header, error) {
+
+	source, header, err := n.openUpstream(station, requestHeader, 0, events)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if n.settings.Reconnect.Enabled {
+		finite := !station.Hls && (station.Finite || len(header.Get("Content-Length")) > 0)
+		_, icy := source.(*icyReader)
+		if !finite {
+			// Live streams continue at the current position. They are also reconnected when they end - but a HLS stream
+			// only ends if the playlist ends
+			source = newReconnectingReader(source, func(offset int64) (io.ReadCloser, error) {
+				return n.reopenUpstream(stationId, station, requestHeader, 0, events)
+			}, n.settings.Reconnect.Retries, !station.Hls)
+		} else if !icy {
+			// Files (podcast episodes or anything served with a length) continue where the connection got lost. The offset
+			// of a file with ICY metadata doesn't match the bytes of the upstream - it is not reconnected (it would start over)
+			source = newReconnectingReader(source, func(offset int64) (io.ReadCloser, error) {
+				return n.reopenUpstream(stationId, station, requestHeader, offset, events)
+			}, n.settings.Reconnect.Retries, false)
+		}
+	}
+
+	if contentType := header.Get("Content-Type"); n.transcodingEnabled() && needsTranscoding(station.Transcode, contentType) {
+		log.Infof("Transcoding stream %s (%s)", station.StreamUrl, contentType)
+		transcoded, transcodedContentType, err := n.settings.Transcoder.Transcode(source, contentType)
+		if err != nil {
+			source.Close()
+			return nil, nil, err
+		}
+		if transcodedContentType != contentType {
+			header.Set("Content-Type", transcodedContentType)
+			header.Del("icy-br")
+		}
+		return transcoded, header, nil
+	}
+	return source, header, nil
+}
+
+// Opens the upstream again after the connection got lost - at the offset if it is > 0. The station url is resolved again if
+// configured
+func (n *NoxonServer) reopenUpstream(stationId string, station Station, requestHeader http.Header, offset int64, events upstreamEvents) (io.ReadCloser, error) {
+
+	if n.settings.Reconnect.Reresolve {
+		if resolvedStation, resolved, err := n.resolveStation(n.settings.StationsModel, stationId, station.StationUrl); err == nil && resolved {
+			station = resolvedStation
+		}
+	}
+	source, _, err := n.openUpstream(station, requestHeader, offset, events)
+	if redirect, ok := err.(*Redirect); ok {
+		// The device can't be redirected in the middle of the playback
+		station.StreamUrl = redirect.Location
+		source, _, err = n.openUpstream(station, requestHeader, offset, events)
+	}
+	return source, err
+}
+
+// Opens the raw upstream of the station. The forwardedDeviceHeaders of the requestHeader are sent along (not for HLS). If
+// the offset is > 0 the data is requested from there on (not for HLS) - an upstream ignoring the range is an error
+func (n *NoxonServer) openUpstream(station Station, requestHeader http.Header, offset int64, events upstreamEvents) (io.ReadCloser, http.Header, error) {
+
+	var source io.ReadCloser
+	header := http.Header{}
+	if station.Hls {
+		client, err := n.upstreamClient(station.Tls, hlsTimeout, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		// the variant closest to the bandwidth of the station (the setting if the station declares none)
+		bandwidth := station.Bandwidth
+		if bandwidth <= 0 {
+			bandwidth = n.settings.HlsBandwidth
+		}
+		reader := NewHlsReaderWithClient(station.StreamUrl, bandwidth, client)
+		// The content type is only known after reading the first segment
+		buffer := make([]byte, streamChunkSize)
+		count, err := reader.Read(buffer)
+		if err != nil {
+			reader.Close()
+			return nil, nil, err
+		}
+		source = &prefixedReadCloser{Reader: io.MultiReader(bytes.NewReader(buffer[:count]), reader), Closer: reader}
+		header.Set("Content-Type", reader.ContentType())
+		header.Set("icy-br", strconv.Itoa(bandwidth/1000))
+	} else {
+		resp, err := n.requestUpstream(station.StreamUrl, station.Tls, requestHeader, offset)
+		if err != nil {
+			return nil, nil, err
+		}
+		if finalUrl := resp.Request.URL.String(); finalUrl != station.StreamUrl && events.onMoved != nil {
+			events.onMoved(finalUrl)
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			resp.Body.Close()
+			return nil, nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		} else if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+			// The device would get the start of the file once again
+			resp.Body.Close()
+			return nil, nil, fmt.Errorf("upstream can't continue at byte %d (status code %d)", offset, resp.StatusCode)
+		}
+		source = resp.Body
+		header = resp.Header
+		if metaInterval, err := strconv.Atoi(header.Get("icy-metaint")); err == nil && metaInterval > 0 {
+			source = newIcyReader(source, metaInterval, events.onTitle)
+			header.Del("icy-metaint")
+		}
+	}
+	return source, header, nil
+}
+
+// Requests the stream (from the offset on if it is > 0) and follows redirects (also relative and cross-scheme ones). If
+// device redirects are enabled a *Redirect error is returned instead
+func (n *NoxonServer) requestUpstream(streamUrl string, tlsOptions TlsOptions, requestHeader http.Header, offset int64) (*http.Response, error) {
+
+	client, err := n.upstreamClient(tlsOptions, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	visited := map[string]bool{}
+	for len(visited) <= maxUpstreamRedirects {
+		visited[streamUrl] = true
+		req, err := http.NewRequest(http.MethodGet, streamUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range forwardedDeviceHeaders {
+			if value := requestHeader.Get(key); len(value) > 0 {
+				req.Header.Set(key, value)
+			}
+		}
+		req.Header.Set("Icy-MetaData", "1")
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if !isRedirect(resp.StatusCode) {
+			return resp, nil
+		}
+
+		resp.Body.Close()
+		location, err := resp.Location()
+		if err != nil {
+			return nil, fmt.Errorf("invalid redirect location: %w", err)
+		}
+		if n.settings.DeviceRedirects {
+			return nil, &Redirect{Location: location.String()}
+		}
+		log.Debugf("Following redirect %s -> %s", streamUrl, location.String())
+		streamUrl = location.String()
+		if visited[streamUrl] {
+			return nil, fmt.Errorf("redirect loop at %s", streamUrl)
+		}
+	}
+	return nil, fmt.Errorf("stopped after %d redirects", maxUpstreamRedirects)
+}
+
+// Serves the stream of the station. All devices listening to the same stream url share one upstream. Returns an error if
+// the upstream could not be opened - nothing was sent to the device then, so the caller may try another mirror before
+// answering. The device is only redirected (onRedirect) if device redirects are enabled - server
+// side redirects are reported via onMoved. onOpened is called once the upstream was opened
+func (n *NoxonServer) serveStream(c *gin.Context, stationId string, station Station, onRedirect func(*Redirect), onMoved func(string), onOpened func()) error {
+
+	device := extractDeviceInfo(c)
+	log := log.WithField("device", device)
+
+	stream, listener, err := n.hub.listen(station, device.Mac, stationId)
+	if err != nil {
+		log.Errorf("Could not listen to stream: %s", err.Error())
+		return err
+	}
+
+	opener := func() (io.ReadCloser, http.Header, error) {
+		return n.openStationStream(stationId, station, c.Request.Header, upstreamEvents{onTitle: stream.setTitle, onMoved: onMoved})
+	}
+	if err := stream.open(opener, n.settings.Reconnect.Enabled && n.settings.Reconnect.Silence); err != nil {
+		stream.unsubscribe(listener)
+		if redirect, ok := err.(*Redirect); ok {
+			onRedirect(redirect)
+			return nil
+		}
+		log.Errorf("Could not open stream %s: %s", station.StreamUrl, err.Error())
+		return err
+	}
+	n.hub.attach(stream, listener)
+	defer n.hub.detach(stream, listener)
+	onOpened()
+
+	if n.settings.TimeShift.Enabled {
+		n.timeShifts.startLive(device.Mac, stationId, stream)
+		defer n.timeShifts.pause(device.Mac, stream)
+	}
+
+	for _, key := range forwardedStreamHeaders {
+		if value := stream.header.Get(key); len(value) > 0 {
+			c.Header(key, value)
+		}
+	}
+	if len(stream.header.Get("Content-Type")) == 0 {
+		c.Header("Content-Type", "audio/mpeg")
+	}
+	c.Header("Cache-Control", "no-cache")
+
+	var writer io.Writer = c.Writer
+	if c.GetHeader("Icy-MetaData") == "1" {
+		// The device wants the metadata interleaved with the audio data
+		c.Header("icy-metaint", strconv.Itoa(icyMetaInterval))
+		writer = newIcyWriter(c.Writer, icyMetaInterval, stream.currentTitle)
+	}
+
+	c.Status(http.StatusOK)
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			// The device stopped the playback
+			return nil
+		case chunk, ok := <-listener.chunks:
+			if !ok {
+				return nil
+			}
+			if _, err := writer.Write(chunk); err != nil {
+				// The device stopped the playback
+				return nil
+			}
+			c.Writer.Flush()
+		}
+	}
+}
@@ -0,0 +1,598 @@
+package noxon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// Ids of the "Resume" stations are the station id with this prefix
+const timeShiftIdPrefix = "timeshift:"
+
+// A resumed playback starts a bit earlier than where the device stopped
+const timeShiftPreroll = 5 * time.Second
+
+// The disk buffer starts a new file every minute so old data can be deleted
+const timeShiftSegmentDuration = time.Minute
+
+type TimeShiftSettings struct {
+	Enabled bool
+	// How long the stream is recorded for a device that stopped listening
+	Duration time.Duration
+	// Keep the recordings in this directory instead of in memory
+	Dir string
+}
+
+// State of the time-shift buffer of a device (see /api/timeshift)
+type TimeShiftStatus struct {
+	Mac       string        `json:"mac"`
+	StationId string        `json:"stationId"`
+	Live      bool          `json:"live"`
+	Position  time.Time     `json:"position"` // Where a resumed playback continues
+	Buffered  time.Duration `json:"buffered"`
+}
+
+type timeShiftSegment struct {
+	file  *os.File
+	start time.Time
+	size  int64
+}
+
+type timeShiftChunk struct {
+	seq     int64
+	time    time.Time
+	data    []byte            // memory buffer
+	segment *timeShiftSegment // disk buffer
+	offset  int64
+	length  int
+}
+
+// Records the stream a device listens to so it can resume the playback later on
+type timeShiftBuffer struct {
+	mutex     sync.Mutex
+	mac       string
+	stationId string
+	stream    *sharedStream
+	header    http.Header
+	window    time.Duration
+	dir       string
+	chunks    []timeShiftChunk
+	nextSeq   int64
+	segment   *timeShiftSegment
+	position  int64 // seq of the last chunk the device got
+	live      int   // number of live playbacks of the device
+	reading   int   // number of resumed playbacks of the device
+	recording bool
+	closed    bool
+	changed   chan struct{} // closed (and replaced) whenever a chunk was added
+	expiry    *time.Timer
+	stop      func()
+	onClosed  func(*timeShiftBuffer)
+}
+
+// Manages the time-shift buffers - one per device
+type timeShifts struct {
+	mutex    sync.Mutex
+	settings TimeShiftSettings
+	buffers  map[string]*timeShiftBuffer
+}
+
+func newTimeShifts(settings TimeShiftSettings) *timeShifts {
+
+	return &timeShifts{
+		mutex:    sync.Mutex{},
+		settings: settings,
+		buffers:  map[string]*timeShiftBuffer{},
+	}
+}
+
+// The device started listening to the stream. A buffer of another stream gets replaced
+func (t *timeShifts) startLive(mac string, stationId string, stream *sharedStream) {
+
+	t.mutex.Lock()
+	previous := t.buffers[mac]
+	if previous != nil && previous.stream == stream && !previous.isClosed() {
+		t.mutex.Unlock()
+		previous.startLive()
+		return
+	}
+	buffer := &timeShiftBuffer{
+		mac:       mac,
+		stationId: stationId,
+		stream:    stream,
+		header:    stream.header,
+		window:    t.settings.Duration,
+		dir:       t.settings.Dir,
+		position:  -1,
+		live:      1,
+		recording: true,
+		changed:   make(chan struct{}),
+		onClosed:  t.remove,
+	}
+	t.buffers[mac] = buffer
+	t.mutex.Unlock()
+
+	if previous != nil {
+		previous.close()
+	}
+	listener, err := stream.subscribe(mac, stationId)
+	if err != nil {
+		buffer.close()
+		return
+	}
+	buffer.stop = func() { stream.unsubscribe(listener) }
+	go func() {
+		for chunk := range listener.chunks {
+			if err := buffer.append(chunk); err != nil {
+				log.Errorf("Time-shift recording of device %s failed: %s", mac, err.Error())
+				buffer.close()
+			}
+		}
+		buffer.stopRecording()
+	}()
+}
+
+// The device stopped listening to the stream
+func (t *timeShifts) pause(mac string, stream *sharedStream) {
+
+	if buffer := t.get(mac); buffer != nil && buffer.stream == stream {
+		buffer.stopLive()
+	}
+}
+
+func (t *timeShifts) get(mac string) *timeShiftBuffer {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.buffers[mac]
+}
+
+func (t *timeShifts) remove(buffer *timeShiftBuffer) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.buffers[buffer.mac] == buffer {
+		delete(t.buffers, buffer.mac)
+	}
+}
+
+func (t *timeShifts) list() []TimeShiftStatus {
+
+	t.mutex.Lock()
+	buffers := []*timeShiftBuffer{}
+	for _, buffer := range t.buffers {
+		buffers = append(buffers, buffer)
+	}
+	t.mutex.Unlock()
+
+	statuses := []TimeShiftStatus{}
+	for _, buffer := range buffers {
+		statuses = append(statuses, buffer.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Mac < statuses[j].Mac })
+	return statuses
+}
+
+func (b *timeShiftBuffer) append(data []byte) error {
+
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return nil
+	}
+	now := time.Now()
+	chunk := timeShiftChunk{seq: b.nextSeq, time: now, length: len(data)}
+	if len(b.dir) > 0 {
+		if b.segment == nil || now.Sub(b.segment.start) > timeShiftSegmentDuration {
+			file, err := os.CreateTemp(b.dir, "timeshift-*.seg")
+			if err != nil {
+				b.mutex.Unlock()
+				return err
+			}
+			b.segment = &timeShiftSegment{file: file, start: now}
+		}
+		if _, err := b.segment.file.WriteAt(data, b.segment.size); err != nil {
+			b.mutex.Unlock()
+			return err
+		}
+		chunk.segment = b.segment
+		chunk.offset = b.segment.size
+		b.segment.size += int64(len(data))
+	} else {
+		chunk.data = data
+	}
+	b.nextSeq++
+	b.chunks = append(b.chunks, chunk)
+	if b.live > 0 && b.reading == 0 {
+		b.position = chunk.seq
+	}
+	b.prune(now)
+	expired := b.isExpired(now)
+	close(b.changed)
+	b.changed = make(chan struct{})
+	b.mutex.Unlock()
+
+	if expired {
+		b.close()
+	}
+	return nil
+}
+
+// Drops the data that fell out of the window. The caller must hold the mutex
+func (b *timeShiftBuffer) prune(now time.Time) {
+
+	for len(b.chunks) > 0 && now.Sub(b.chunks[0].time) > b.window {
+		dropped := b.chunks[0]
+		b.chunks = b.chunks[1:]
+		if dropped.segment != nil && dropped.segment != b.segment && (len(b.chunks) == 0 || b.chunks[0].segment != dropped.segment) {
+			removeTimeShiftSegment(dropped.segment)
+		}
+	}
+}
+
+// A paused buffer expires if there is nothing left to resume. The caller must hold the mutex
+func (b *timeShiftBuffer) isExpired(now time.Time) bool {
+
+	if b.live > 0 || b.reading > 0 {
+		return false
+	}
+	if len(b.chunks) == 0 {
+		return !b.recording
+	}
+	return b.position < b.chunks[0].seq-1 || (!b.recording && b.position >= b.chunks[len(b.chunks)-1].seq)
+}
+
+func (b *timeShiftBuffer) startLive() {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.live++
+}
+
+func (b *timeShiftBuffer) stopLive() {
+
+	b.mutex.Lock()
+	b.live--
+	b.mutex.Unlock()
+	b.scheduleExpiry()
+}
+
+func (b *timeShiftBuffer) stopRecording() {
+
+	b.mutex.Lock()
+	b.recording = false
+	if !b.closed {
+		// Wake up the readers waiting for data
+		close(b.changed)
+		b.changed = make(chan struct{})
+	}
+	b.mutex.Unlock()
+	b.scheduleExpiry()
+}
+
+// Closes the buffer as soon as there is nothing left to resume
+func (b *timeShiftBuffer) scheduleExpiry() {
+
+	b.mutex.Lock()
+	now := time.Now()
+	b.prune(now)
+	expired := b.isExpired(now)
+	if !expired && !b.closed && b.live == 0 && b.reading == 0 && b.expiry == nil {
+		// Check again when the position of the device falls out of the window - the upstream is kept open until then
+		b.expiry = time.AfterFunc(b.expiryDelay(now), func() {
+			b.mutex.Lock()
+			b.expiry = nil
+			b.mutex.Unlock()
+			b.scheduleExpiry()
+		})
+	}
+	b.mutex.Unlock()
+	if expired {
+		b.close()
+	}
+}
+
+// The time until the chunk a resumed playback would continue with is dropped. The caller must hold the mutex
+func (b *timeShiftBuffer) expiryDelay(now time.Time) time.Duration {
+
+	index := sort.Search(len(b.chunks), func(i int) bool { return b.chunks[i].seq > b.position })
+	if index < len(b.chunks) {
+		// prune drops chunks older than the window
+		return b.chunks[index].time.Add(b.window).Sub(now) + time.Millisecond
+	}
+	return b.window
+}
+
+// Starts a resumed playback. Returns the seq the playback continues after
+func (b *timeShiftBuffer) startReading() int64 {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.reading++
+	index := sort.Search(len(b.chunks), func(i int) bool { return b.chunks[i].seq > b.position })
+	// The preroll also applies if nothing was recorded since the device stopped
+	resumeTime := time.Now()
+	if index < len(b.chunks) {
+		resumeTime = b.chunks[index].time
+	}
+	resumeTime = resumeTime.Add(-timeShiftPreroll)
+	for index > 0 && b.chunks[index-1].time.After(resumeTime) {
+		index--
+	}
+	if index < len(b.chunks) {
+		return b.chunks[index].seq - 1
+	}
+	return b.position
+}
+
+func (b *timeShiftBuffer) stopReading(position int64) {
+
+	b.mutex.Lock()
+	b.reading--
+	b.position = position
+	b.mutex.Unlock()
+	b.scheduleExpiry()
+}
+
+// Returns the first chunk after the seq. Waits for the recording if the reader caught up with it
+func (b *timeShiftBuffer) next(ctx context.Context, after int64) ([]byte, int64, error) {
+
+	for {
+		b.mutex.Lock()
+		if b.closed {
+			b.mutex.Unlock()
+			return nil, after, io.EOF
+		}
+		index := sort.Search(len(b.chunks), func(i int) bool { return b.chunks[i].seq > after })
+		if index < len(b.chunks) {
+			chunk := b.chunks[index]
+			data, err := b.readChunk(chunk)
+			b.mutex.Unlock()
+			return data, chunk.seq, err
+		}
+		if !b.recording {
+			b.mutex.Unlock()
+			return nil, after, io.EOF
+		}
+		changed := b.changed
+		b.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, after, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// The caller must hold the mutex
+func (b *timeShiftBuffer) readChunk(chunk timeShiftChunk) ([]byte, error) {
+
+	if chunk.segment == nil {
+		return chunk.data, nil
+	}
+	data := make([]byte, chunk.length)
+	_, err := chunk.segment.file.ReadAt(data, chunk.offset)
+	return data, err
+}
+
+// A paused buffer can be resumed by the device
+func (b *timeShiftBuffer) isPaused() bool {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return !b.closed && b.live == 0 && b.reading == 0 && len(b.chunks) > 0
+}
+
+func (b *timeShiftBuffer) status() TimeShiftStatus {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	status := TimeShiftStatus{
+		Mac:       b.mac,
+		StationId: b.stationId,
+		Live:      b.live > 0,
+	}
+	if len(b.chunks) > 0 {
+		status.Buffered = b.chunks[len(b.chunks)-1].time.Sub(b.chunks[0].time)
+		status.Position = b.chunks[0].time
+		index := sort.Search(len(b.chunks), func(i int) bool { return b.chunks[i].seq >= b.position })
+		if index < len(b.chunks) {
+			status.Position = b.chunks[index].time
+		}
+	}
+	return status
+}
+
+func (b *timeShiftBuffer) isClosed() bool {
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.closed
+}
+
+func (b *timeShiftBuffer) close() {
+
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return
+	}
+	b.closed = true
+	close(b.changed)
+	segments := map[*timeShiftSegment]struct{}{}
+	for _, chunk := range b.chunks {
+		if chunk.segment != nil {
+			segments[chunk.segment] = struct{}{}
+		}
+	}
+	if b.segment != nil {
+		segments[b.segment] = struct{}{}
+	}
+	b.chunks = nil
+	b.mutex.Unlock()
+
+	for segment := range segments {
+		removeTimeShiftSegment(segment)
+	}
+	if b.stop != nil {
+		b.stop()
+	}
+	if b.onClosed != nil {
+		b.onClosed(b)
+	}
+	log.Debugf("Closed time-shift buffer of device %s", b.mac)
+}
+
+func removeTimeShiftSegment(segment *timeShiftSegment) {
+
+	segment.file.Close()
+	os.Remove(segment.file.Name())
+}
+
+// Adds a "Resume" station to the root menu of a device with a paused time-shift buffer
+type timeShiftStationsModel struct {
+	StationsModel
+	resume   ItemStation
+	resumeId string
+}
+
+func (m timeShiftStationsModel) Data(parentId *string, index int) (Item, string) {
+
+	if parentId == nil && index == 0 {
+		return m.resume, m.resumeId
+	} else if parentId == nil {
+		return m.StationsModel.Data(nil, index-1)
+	} else if index < 0 && *parentId == m.resumeId {
+		return m.resume, m.resumeId
+	}
+	return m.StationsModel.Data(parentId, index)
+}
+
+func (m timeShiftStationsModel) Count(parentId *string) int {
+
+	if parentId == nil {
+		return m.StationsModel.Count(nil) + 1
+	}
+	return m.StationsModel.Count(parentId)
+}
+
+func (m timeShiftStationsModel) ForDevice(mac string) StationsModel {
+
+	if deviceModel, ok := m.StationsModel.(DeviceStationsModel); ok {
+		m.StationsModel = deviceModel.ForDevice(mac)
+	}
+	return m
+}
+
+func (m timeShiftStationsModel) Played(mac string, stationId string) {
+
+	if deviceModel, ok := m.StationsModel.(DeviceStationsModel); ok {
+		deviceModel.Played(mac, stationId)
+	}
+}
+
+func (m timeShiftStationsModel) Search(query string) []string {
+
+	if searcher, ok := m.StationsModel.(Searcher); ok {
+		return searcher.Search(query)
+	}
+	return []string{}
+}
+
+func (m timeShiftStationsModel) TaggedStations(category string) map[string][]string {
+
+	if taggedModel, ok := m.StationsModel.(TaggedStationsModel); ok {
+		return taggedModel.TaggedStations(category)
+	}
+	return map[string][]string{}
+}
+
+// Adds the "Resume" station to the model if the time-shift buffer of the device is paused
+func (n *NoxonServer) timeShiftModel(mac string, model StationsModel) StationsModel {
+
+	buffer := n.timeShifts.get(mac)
+	if buffer == nil || !buffer.isPaused() {
+		return model
+	}
+	stationName := buffer.stationId
+	stationId := buffer.stationId
+	if item, id := n.settings.StationsModel.Data(&stationId, -1); len(id) > 0 {
+		if station, ok := item.(ItemStation); ok {
+			stationName = station.StationName
+		}
+	}
+	status := buffer.status()
+	return timeShiftStationsModel{
+		StationsModel: model,
+		resume: ItemStation{
+			StationName:        fmt.Sprintf("Resume %s", stationName),
+			StationDescription: fmt.Sprintf("Paused %s ago", time.Since(status.Position).Round(time.Minute)),
+			StationMime:        "MP3",
+		},
+		resumeId: timeShiftIdPrefix + buffer.stationId,
+	}
+}
+
+// Serves the time-shift buffer of the device from where it stopped listening
+func (n *NoxonServer) serveTimeShift(c *gin.Context, stationId string) {
+
+	device := extractDeviceInfo(c)
+	log := log.WithField("device", device)
+
+	buffer := n.timeShifts.get(device.Mac)
+	if buffer == nil || buffer.stationId != stationId || buffer.isClosed() {
+		log.Warnf("No time-shift buffer for station %s", stationId)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	position := buffer.startReading()
+	defer func() { buffer.stopReading(position) }()
+
+	startTime := time.Now()
+	n.settings.PlaybackManager.StartPlayback(device.Mac, Playback{
+		StationId: stationId,
+		StreamUrl: buffer.stream.url,
+		Title:     "Time-shift",
+		StartTime: startTime,
+	})
+	defer n.settings.PlaybackManager.StopPlayback(device.Mac, startTime)
+
+	for _, key := range forwardedStreamHeaders {
+		if value := buffer.header.Get(key); len(value) > 0 {
+			c.Header(key, value)
+		}
+	}
+	if len(buffer.header.Get("Content-Type")) == 0 {
+		c.Header("Content-Type", "audio/mpeg")
+	}
+	c.Header("Cache-Control", "no-cache")
+
+	log.Infof("Resuming playback of station %s", stationId)
+	c.Status(http.StatusOK)
+	for {
+		data, seq, err := buffer.next(c.Request.Context(), position)
+		if err != nil {
+			return
+		}
+		if _, err := c.Writer.Write(data); err != nil {
+			// The device stopped the playback
+			return
+		}
+		c.Writer.Flush()
+		position = seq
+	}
+}
+
+func (n *NoxonServer) handleTimeShiftEndpoint(c *gin.Context) {
+
+	c.JSON(http.StatusOK, n.timeShifts.list())
+}
@@ -0,0 +1,190 @@
+package noxon
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Per station transcoding modes (see Entry.Transcode)
+const (
+	TranscodeAuto   = ""
+	TranscodeAlways = "always"
+	TranscodeNever  = "never"
+)
+
+// Lines of the ffmpeg error output that are logged if it fails
+const ffmpegStderrLines = 10
+
+// Content types the device is able to decode
+var deviceContentTypes = []string{"audio/mpeg", "audio/mp3", "audio/mpeg3", "audio/x-mpeg", "audio/x-mp3"}
+
+// A Transcoder converts an audio stream into a format the device is able to decode
+type Transcoder interface {
+	// Returns the transcoded stream and its content type. Closing the returned stream also closes the source
+	Transcode(source io.ReadCloser, contentType string) (io.ReadCloser, string, error)
+}
+
+type PassThroughTranscoder struct {
+}
+
+func NewPassThroughTranscoder() PassThroughTranscoder {
+
+	return PassThroughTranscoder{}
+}
+
+func (t PassThroughTranscoder) Transcode(source io.ReadCloser, contentType string) (io.ReadCloser, string, error) {
+
+	return source, contentType, nil
+}
+
+// Re-encodes the stream to mp3 by piping it through an ffmpeg subprocess
+type FfmpegTranscoder struct {
+	path    string
+	bitrate int
+}
+
+func NewFfmpegTranscoder(path string, bitrate int) FfmpegTranscoder {
+
+	return FfmpegTranscoder{
+		path:    path,
+		bitrate: bitrate,
+	}
+}
+
+func (t FfmpegTranscoder) Transcode(source io.ReadCloser, contentType string) (io.ReadCloser, string, error) {
+
+	cmd := exec.Command(t.path, "-hide_banner", "-loglevel", "error", "-i", "pipe:0", "-vn", "-codec:a", "libmp3lame", "-b:a", fmt.Sprintf("%dk", t.bitrate/1000), "-f", "mp3", "pipe:1")
+	cmd.Stdin = source
+	stderr := &lineTail{size: ffmpegStderrLines}
+	cmd.Stderr = stderr
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, "", fmt.Errorf("could not start ffmpeg: %w", err)
+	}
+	log.Debugf("Started ffmpeg (pid %d) transcoding %s to mp3 with %d bit/s", cmd.Process.Pid, contentType, t.bitrate)
+	return &ffmpegProcess{cmd: cmd, source: source, output: output, stderr: stderr}, "audio/mpeg", nil
+}
+
+type ffmpegProcess struct {
+	cmd       *exec.Cmd
+	source    io.ReadCloser
+	output    io.ReadCloser
+	stderr    *lineTail
+	closeOnce sync.Once
+	waitOnce  sync.Once
+	killed    atomic.Bool
+}
+
+func (p *ffmpegProcess) Read(data []byte) (int, error) {
+
+	count, err := p.output.Read(data)
+	if err != nil {
+		// ffmpeg exited on its own
+		p.wait()
+	}
+	return count, err
+}
+
+func (p *ffmpegProcess) Close() error {
+
+	p.closeOnce.Do(func() {
+		p.source.Close()
+		p.killed.Store(true)
+		p.cmd.Process.Kill()
+		p.wait()
+		log.Debugf("Stopped ffmpeg (pid %d)", p.cmd.Process.Pid)
+	})
+	return nil
+}
+
+// Waits for the process to exit. The end of its error output is logged if it failed (and was not killed by Close)
+func (p *ffmpegProcess) wait() {
+
+	p.waitOnce.Do(func() {
+		if err := p.cmd.Wait(); err != nil && !p.killed.Load() {
+			log.Warnf("ffmpeg (pid %d) failed: %s\n%s", p.cmd.Process.Pid, err.Error(), strings.Join(p.stderr.lines(), "\n"))
+		}
+	})
+}
+
+// Keeps the last size lines written to it
+type lineTail struct {
+	mutex   sync.Mutex
+	size    int
+	tail    []string
+	partial string
+}
+
+func (t *lineTail) Write(data []byte) (int, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	lines := strings.Split(t.partial+string(data), "\n")
+	t.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			t.tail = append(t.tail, line)
+		}
+	}
+	if len(t.tail) > t.size {
+		t.tail = t.tail[len(t.tail)-t.size:]
+	}
+	return len(data), nil
+}
+
+func (t *lineTail) lines() []string {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	lines := append([]string{}, t.tail...)
+	if partial := strings.TrimSpace(t.partial); len(partial) > 0 {
+		lines = append(lines, partial)
+	}
+	if len(lines) > t.size {
+		lines = lines[len(lines)-t.size:]
+	}
+	return lines
+}
+
+func isDeviceContentType(contentType string) bool {
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, deviceContentType := range deviceContentTypes {
+		if strings.EqualFold(mediaType, deviceContentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Without a transcoder (see NoxonServerSettings.WithTranscoder) every stream is passed through as it is
+func (n *NoxonServer) transcodingEnabled() bool {
+
+	_, passThrough := n.settings.Transcoder.(PassThroughTranscoder)
+	return n.settings.Transcoder != nil && !passThrough
+}
+
+// An unknown content type is considered playable - it is up to the device then
+func needsTranscoding(mode string, contentType string) bool {
+
+	switch mode {
+	case TranscodeAlways:
+		return true
+	case TranscodeNever:
+		return false
+	}
+	return len(contentType) > 0 && !isDeviceContentType(contentType)
+}
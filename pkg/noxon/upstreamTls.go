@@ -0,0 +1,193 @@
+package noxon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLS options for the connections to the broadcasters. The radio itself only speaks plain http
+type TlsOptions struct {
+	CaFile             string `json:"caFile"`             // PEM bundle of additional trusted CAs
+	InsecureSkipVerify *bool  `json:"insecureSkipVerify"` // Accept expired and self-signed certificates (a station may explicitly turn it off)
+	ServerName         string `json:"serverName"`         // Overrides the SNI (and the name the certificate is verified against)
+	ClientCertFile     string `json:"clientCertFile"`     // PEM client certificate
+	ClientKeyFile      string `json:"clientKeyFile"`      // PEM key of the client certificate
+	serverNameHost     string // The host the ServerName applies to - all hosts if empty (see forUrl)
+}
+
+// Station options overrule the global ones
+func (o TlsOptions) merge(station *TlsOptions) TlsOptions {
+
+	if station == nil {
+		return o
+	}
+	if len(station.CaFile) > 0 {
+		o.CaFile = station.CaFile
+	}
+	if station.InsecureSkipVerify != nil {
+		o.InsecureSkipVerify = station.InsecureSkipVerify
+	}
+	if len(station.ServerName) > 0 {
+		o.ServerName = station.ServerName
+	}
+	if len(station.ClientCertFile) > 0 {
+		o.ClientCertFile = station.ClientCertFile
+		o.ClientKeyFile = station.ClientKeyFile
+	}
+	return o
+}
+
+// The ServerName only applies to the host of the url. Redirects and playlist entries pointing to other hosts are
+// verified against their own name
+func (o TlsOptions) forUrl(rawUrl string) TlsOptions {
+
+	if parsed, err := url.Parse(rawUrl); err == nil && len(o.ServerName) > 0 {
+		o.serverNameHost = parsed.Hostname()
+	}
+	return o
+}
+
+func (o TlsOptions) insecureSkipVerify() bool {
+
+	return o.InsecureSkipVerify != nil && *o.InsecureSkipVerify
+}
+
+// The options by value - equal options have the same key (see upstreamTransports and streamKey)
+type tlsOptionsKey struct {
+	caFile             string
+	insecureSkipVerify bool
+	serverName         string
+	clientCertFile     string
+	clientKeyFile      string
+	serverNameHost     string
+}
+
+func (o TlsOptions) key() tlsOptionsKey {
+
+	return tlsOptionsKey{
+		caFile:             o.CaFile,
+		insecureSkipVerify: o.insecureSkipVerify(),
+		serverName:         o.ServerName,
+		clientCertFile:     o.ClientCertFile,
+		clientKeyFile:      o.ClientKeyFile,
+		serverNameHost:     o.serverNameHost,
+	}
+}
+
+// Builds the configuration of the connections to the broadcasters
+func (o TlsOptions) TlsConfig() (*tls.Config, error) {
+
+	config := &tls.Config{
+		InsecureSkipVerify: o.insecureSkipVerify(),
+		ServerName:         o.ServerName,
+	}
+	if len(o.CaFile) > 0 {
+		pem, err := os.ReadFile(o.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", o.CaFile)
+		}
+		config.RootCAs = pool
+	}
+	if len(o.ClientCertFile) > 0 {
+		keyFile := o.ClientKeyFile
+		if len(keyFile) == 0 {
+			// The key might be part of the certificate file
+			keyFile = o.ClientCertFile
+		}
+		certificate, err := tls.LoadX509KeyPair(o.ClientCertFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+// One transport per distinct set of options so the connections can be reused
+type upstreamTransports struct {
+	mutex      sync.Mutex
+	transports map[tlsOptionsKey]*http.Transport
+}
+
+func newUpstreamTransports() *upstreamTransports {
+
+	return &upstreamTransports{
+		mutex:      sync.Mutex{},
+		transports: map[tlsOptionsKey]*http.Transport{},
+	}
+}
+
+func (t *upstreamTransports) get(options TlsOptions) (*http.Transport, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if transport, ok := t.transports[options.key()]; ok {
+		return transport, nil
+	}
+	config, err := options.TlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	t.transports[options.key()] = transport
+	return transport, nil
+}
+
+// A client for the requests to a broadcaster. Without a timeout for the streams itself
+func (n *NoxonServer) upstreamClient(options TlsOptions, timeout time.Duration, followRedirects bool) (*http.Client, error) {
+
+	named, err := n.transports.get(options)
+	if err != nil {
+		return nil, err
+	}
+	var transport http.RoundTripper = named
+	if len(options.ServerName) > 0 && len(options.serverNameHost) > 0 {
+		other := options
+		other.ServerName, other.serverNameHost = "", ""
+		otherTransport, err := n.transports.get(other)
+		if err != nil {
+			return nil, err
+		}
+		transport = &serverNameTransport{host: options.serverNameHost, named: named, other: otherTransport}
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}
+	if !followRedirects {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client, nil
+}
+
+// Sends the ServerName only to the host it was configured for
+type serverNameTransport struct {
+	host  string
+	named http.RoundTripper
+	other http.RoundTripper
+}
+
+func (t *serverNameTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	if strings.EqualFold(req.URL.Hostname(), t.host) {
+		return t.named.RoundTrip(req)
+	}
+	return t.other.RoundTrip(req)
+}
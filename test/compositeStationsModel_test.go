@@ -0,0 +1,79 @@
+package noxon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompositeStationsModel(t *testing.T) {
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.mp3"), []byte{}, 0644))
+	stations := noxon.NewJsonModelFromJson([]byte(`[{"id": "station", "stationName": "Station", "stationUrl": "https://example.com/stream.mp3"}]`))
+	other := noxon.NewJsonModelFromJson([]byte(`[{"id": "station", "stationName": "Other", "stationUrl": "https://example.com/other.mp3"}]`))
+
+	model := noxon.NewCompositeStationsModel(
+		noxon.Mount{Model: stations},
+		noxon.Mount{Id: "music", Name: "My music", Model: noxon.NewLocalMediaStationsModel("Music", dir)},
+		noxon.Mount{Id: "other", Name: "Other stations", Model: other},
+		noxon.Mount{Id: "in/valid", Name: "Invalid", Model: other},
+	)
+
+	// The unnamed mount is shown at the top level and keeps its ids
+	assert.Equal(t, 3, model.Count(nil))
+	station, stationId := model.Data(nil, 0)
+	assert.Equal(t, "Station", station.(noxon.ItemStation).StationName)
+	assert.Equal(t, "station", stationId)
+
+	// The single root dir of a model is replaced by the mount dir
+	music, musicId := model.Data(nil, 1)
+	assert.Equal(t, noxon.ItemDir{Title: "My music"}, music)
+	assert.Equal(t, 1, model.Count(&musicId))
+	file, fileId := model.Data(&musicId, 0)
+	assert.Equal(t, filepath.Join(dir, "a.mp3"), file.(noxon.ItemStation).MediaFile)
+	same, _ := model.Data(&fileId, -1)
+	assert.Equal(t, file, same)
+
+	// The ids are namespaced
+	otherDir, otherDirId := model.Data(nil, 2)
+	assert.Equal(t, noxon.ItemDir{Title: "Other stations"}, otherDir)
+	otherStation, otherStationId := model.Data(&otherDirId, 0)
+	assert.Equal(t, "other/station", otherStationId)
+	same, _ = model.Data(&otherStationId, -1)
+	assert.Equal(t, otherStation, same)
+	same, _ = model.Data(&stationId, -1)
+	assert.Equal(t, station, same)
+}
+
+func TestCompositeStationsModelExplicitIdWithMountPrefix(t *testing.T) {
+
+	stations := noxon.NewJsonModelFromJson([]byte(`[
+  {"id": "other/plain", "stationName": "Plain", "stationUrl": "https://example.com/plain.mp3"},
+  {"id": "podcasts/dir", "dirName": "Dir", "children": [{"id": "child", "stationName": "Child", "stationUrl": "https://example.com/child.mp3"}]}
+]`))
+	other := noxon.NewJsonModelFromJson([]byte(`[{"id": "station", "stationName": "Other", "stationUrl": "https://example.com/other.mp3"}]`))
+	model := noxon.NewCompositeStationsModel(
+		noxon.Mount{Model: stations},
+		noxon.Mount{Id: "other", Name: "Other stations", Model: other},
+		noxon.Mount{Id: "podcasts", Model: noxon.NewJsonModelFromJson([]byte(`[]`))},
+	)
+
+	// The ids of the plain mount stay with the plain mount
+	plainId := "other/plain"
+	plain, id := model.Data(&plainId, -1)
+	assert.Equal(t, "Plain", plain.(noxon.ItemStation).StationName)
+	assert.Equal(t, plainId, id)
+	dirId := "podcasts/dir"
+	assert.Equal(t, 1, model.Count(&dirId))
+	_, childId := model.Data(&dirId, 0)
+	assert.Equal(t, "child", childId)
+
+	// The generated ids are still routed to the mount
+	otherId := "other/station"
+	station, _ := model.Data(&otherId, -1)
+	assert.Equal(t, "Other", station.(noxon.ItemStation).StationName)
+}
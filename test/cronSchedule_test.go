@@ -0,0 +1,41 @@
+package noxon
+
+import (
+	"testing"
+	"time"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCronScheduleMatches(t *testing.T) {
+
+	// Weekdays at 20:00 and 20:30
+	schedule, err := noxon.ParseCronSchedule("0,30 20 * * 1-5")
+	assert.NoError(t, err)
+	assert.True(t, schedule.Matches(time.Date(2024, 1, 31, 20, 0, 0, 0, time.Local)))  // Wednesday
+	assert.True(t, schedule.Matches(time.Date(2024, 1, 31, 20, 30, 0, 0, time.Local))) // Wednesday
+	assert.False(t, schedule.Matches(time.Date(2024, 1, 31, 20, 15, 0, 0, time.Local)))
+	assert.False(t, schedule.Matches(time.Date(2024, 2, 3, 20, 0, 0, 0, time.Local))) // Saturday
+
+	// Every 15 minutes on sundays
+	schedule, err = noxon.ParseCronSchedule("*/15 * * * 7")
+	assert.NoError(t, err)
+	assert.True(t, schedule.Matches(time.Date(2024, 2, 4, 9, 45, 0, 0, time.Local)))
+	assert.False(t, schedule.Matches(time.Date(2024, 2, 4, 9, 50, 0, 0, time.Local)))
+
+	// The first of the month or mondays
+	schedule, err = noxon.ParseCronSchedule("0 8 1 * 1")
+	assert.NoError(t, err)
+	assert.True(t, schedule.Matches(time.Date(2024, 2, 1, 8, 0, 0, 0, time.Local)))  // Thursday
+	assert.True(t, schedule.Matches(time.Date(2024, 2, 5, 8, 0, 0, 0, time.Local)))  // Monday
+	assert.False(t, schedule.Matches(time.Date(2024, 2, 6, 8, 0, 0, 0, time.Local))) // Tuesday
+}
+
+func TestCronScheduleInvalid(t *testing.T) {
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		_, err := noxon.ParseCronSchedule(spec)
+		assert.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,217 @@
+package noxon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+const pmtPid = 0x1000
+const audioPid = 0x0101
+
+func tsPacket(pid int, payloadStart bool, counter int, payload []byte) []byte {
+
+	packet := []byte{0x47, byte(pid>>8) & 0x1f, byte(pid), 0x10 | byte(counter&0x0f)}
+	if payloadStart {
+		packet[1] |= 0x40
+	}
+	if stuffing := 184 - len(payload); stuffing > 0 {
+		// Pad with an adaptation field
+		packet[3] |= 0x20
+		adaptation := []byte{byte(stuffing - 1)}
+		if stuffing > 1 {
+			adaptation = append(adaptation, 0x00)
+			adaptation = append(adaptation, bytes.Repeat([]byte{0xff}, stuffing-2)...)
+		}
+		packet = append(packet, adaptation...)
+	}
+	return append(packet, payload...)
+}
+
+func tsSegment(audio []byte) []byte {
+
+	pat := []byte{0x00, 0x00, 0xb0, 13, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xe0 | byte(pmtPid>>8), byte(pmtPid & 0xff), 0, 0, 0, 0}
+	pmt := []byte{0x00, 0x02, 0xb0, 18, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe0 | byte(audioPid>>8), byte(audioPid & 0xff), 0xf0, 0x00,
+		0x0f, 0xe0 | byte(audioPid>>8), byte(audioPid & 0xff), 0xf0, 0x00, 0, 0, 0, 0}
+	pes := append([]byte{0x00, 0x00, 0x01, 0xc0, 0x00, 0x00, 0x80, 0x80, 0x05, 0x21, 0x00, 0x01, 0x00, 0x01}, audio...)
+
+	segment := append(tsPacket(0, true, 0, pat), tsPacket(pmtPid, true, 0, pmt)...)
+	for counter := 0; len(pes) > 0; counter++ {
+		size := len(pes)
+		if size > 184 {
+			size = 184
+		}
+		segment = append(segment, tsPacket(audioPid, counter == 0, counter, pes[:size])...)
+		pes = pes[size:]
+	}
+	return segment
+}
+
+func adtsPayload(seed byte, size int) []byte {
+
+	payload := []byte{0xff, 0xf1}
+	for i := 0; len(payload) < size; i++ {
+		payload = append(payload, seed+byte(i))
+	}
+	return payload
+}
+
+func newHlsFixture(segments map[string][][]byte) *httptest.Server {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		fmt.Fprint(w, "#EXTM3U\n")
+		fmt.Fprint(w, "#EXT-X-STREAM-INF:BANDWIDTH=64000,CODECS=\"mp4a.40.5\"\nlow/media.m3u8\n")
+		fmt.Fprint(w, "#EXT-X-STREAM-INF:BANDWIDTH=128000,CODECS=\"mp4a.40.2\"\nhigh/media.m3u8\n")
+		fmt.Fprint(w, "#EXT-X-STREAM-INF:BANDWIDTH=320000,CODECS=\"mp4a.40.2\"\nhighest/media.m3u8\n")
+	})
+	for variant, variantSegments := range segments {
+		variant, variantSegments := variant, variantSegments
+		mux.HandleFunc("/"+variant+"/media.m3u8", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:7\n")
+			for i := range variantSegments {
+				fmt.Fprintf(w, "#EXTINF:1.0,\nsegment%d.ts\n", i)
+			}
+			fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+		})
+		for i, segment := range variantSegments {
+			segment := segment
+			mux.HandleFunc(fmt.Sprintf("/%s/segment%d.ts", variant, i), func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "video/mp2t")
+				w.Write(tsSegment(segment))
+			})
+		}
+	}
+	return httptest.NewServer(mux)
+}
+
+func TestHlsBridgeSelectsClosestVariant(t *testing.T) {
+
+	segments := map[string][][]byte{
+		"low":     {adtsPayload(1, 300)},
+		"high":    {adtsPayload(10, 1000), adtsPayload(20, 50), adtsPayload(30, 700)},
+		"highest": {adtsPayload(100, 300)},
+	}
+	server := newHlsFixture(segments)
+	defer server.Close()
+
+	reader := noxon.NewHlsReader(server.URL+"/master.m3u8", 150000)
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Join(segments["high"], nil), data)
+	assert.Equal(t, "audio/aac", reader.ContentType())
+}
+
+func TestHlsBridgeMediaPlaylist(t *testing.T) {
+
+	segments := map[string][][]byte{
+		"low": {adtsPayload(1, 184), adtsPayload(2, 185)},
+	}
+	server := newHlsFixture(segments)
+	defer server.Close()
+
+	reader := noxon.NewHlsReader(server.URL+"/low/media.m3u8", 128000)
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Join(segments["low"], nil), data)
+}
+
+// The audio of a segment is passed on at once - not packet by packet
+func TestHlsBridgeReadsWholeSegments(t *testing.T) {
+
+	segments := map[string][][]byte{
+		"low": {adtsPayload(1, 5000), adtsPayload(2, 3000)},
+	}
+	server := newHlsFixture(segments)
+	defer server.Close()
+
+	reader := noxon.NewHlsReader(server.URL+"/low/media.m3u8", 128000)
+	defer reader.Close()
+	buffer := make([]byte, 16*1024)
+	for _, segment := range segments["low"] {
+		count, err := reader.Read(buffer)
+		assert.NoError(t, err)
+		assert.Equal(t, segment, buffer[:count])
+	}
+}
+
+func TestHlsBridgeMissingPlaylist(t *testing.T) {
+
+	server := newHlsFixture(map[string][][]byte{})
+	defer server.Close()
+
+	reader := noxon.NewHlsReader(server.URL+"/missing.m3u8", 128000)
+	defer reader.Close()
+	_, err := io.ReadAll(reader)
+	assert.Error(t, err)
+}
+
+func TestHlsBridgeSelectsVariantOfStation(t *testing.T) {
+
+	segments := map[string][][]byte{
+		"low":     {adtsPayload(1, 300)},
+		"high":    {adtsPayload(10, 300)},
+		"highest": {adtsPayload(100, 300)},
+	}
+	upstream := newHlsFixture(segments)
+	defer upstream.Close()
+
+	_, settings := newTestServer(fmt.Sprintf(`[
+		{"id": "declared", "stationName": "Declared", "stationUrl": "%[1]s/master.m3u8", "bitrate": 320000},
+		{"id": "default", "stationName": "Default", "stationUrl": "%[1]s/master.m3u8"}
+	]`, upstream.URL))
+	server := noxon.NewNoxonServer(settings.WithHlsBandwidth(64000))
+
+	// The bandwidth of the station wins over the setting
+	recorder := requestPlayback(server, "mac", "declared")
+	assert.Equal(t, bytes.Join(segments["highest"], nil), recorder.Body.Bytes())
+	assert.Equal(t, "320", recorder.Header().Get("icy-br"))
+
+	recorder = requestPlayback(server, "mac", "default")
+	assert.Equal(t, bytes.Join(segments["low"], nil), recorder.Body.Bytes())
+	assert.Equal(t, "64", recorder.Header().Get("icy-br"))
+}
+
+func TestHlsBridgeMediaSequenceRestart(t *testing.T) {
+
+	// The encoder restarts once the first segments were fetched: the media sequence starts over at 0
+	audio := [][]byte{adtsPayload(1, 300), adtsPayload(2, 300), adtsPayload(3, 300), adtsPayload(4, 300)}
+	restarted := atomic.Bool{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/media.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		if !restarted.Load() {
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:100\n#EXTINF:1.0,\nsegment0.ts\n#EXTINF:1.0,\nsegment1.ts\n")
+		} else {
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:1.0,\nsegment2.ts\n#EXTINF:1.0,\nsegment3.ts\n#EXT-X-ENDLIST\n")
+		}
+	})
+	for i, segment := range audio {
+		i, segment := i, segment
+		mux.HandleFunc(fmt.Sprintf("/segment%d.ts", i), func(w http.ResponseWriter, r *http.Request) {
+			w.Write(tsSegment(segment))
+			if i == 1 {
+				restarted.Store(true)
+			}
+		})
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	reader := noxon.NewHlsReader(server.URL+"/media.m3u8", 128000)
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Join(audio, nil), data)
+}
@@ -0,0 +1,133 @@
+package noxon
+
+import (
+	"bytes"
+	b64 "encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A metadata block: the length byte (in blocks of 16 bytes) and the metadata padded with zeros
+func icyBlock(metadata string) []byte {
+
+	blocks := (len(metadata) + 15) / 16
+	block := make([]byte, 1+blocks*16)
+	block[0] = byte(blocks)
+	copy(block[1:], metadata)
+	return block
+}
+
+// Serves the audio with the metadata interleaved every interval bytes. The metadata is sent in the first block only
+func newIcyUpstream(audio []byte, interval int, metadata string) *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Header().Set("icy-metaint", strconv.Itoa(interval))
+		for offset := 0; offset < len(audio); offset += interval {
+			end := offset + interval
+			if end > len(audio) {
+				end = len(audio)
+			}
+			w.Write(audio[offset:end])
+			if end == len(audio) {
+				break
+			} else if offset == 0 {
+				w.Write(icyBlock(metadata))
+			} else {
+				w.Write([]byte{0})
+			}
+		}
+	}))
+}
+
+// Splits the stream of a device into the audio and the metadata blocks (without padding)
+func splitIcyStream(t *testing.T, stream []byte, interval int) (audio []byte, metadata []string) {
+
+	for len(stream) > 0 {
+		count := interval
+		if count > len(stream) {
+			count = len(stream)
+		}
+		audio = append(audio, stream[:count]...)
+		stream = stream[count:]
+		if len(stream) == 0 {
+			break
+		}
+		length := int(stream[0]) * 16
+		if !assert.LessOrEqual(t, 1+length, len(stream)) {
+			break
+		}
+		if length > 0 {
+			metadata = append(metadata, string(bytes.TrimRight(stream[1:1+length], "\x00")))
+		}
+		stream = stream[1+length:]
+	}
+	return audio, metadata
+}
+
+func TestIcyMetadata(t *testing.T) {
+
+	audio := make([]byte, 40000)
+	for i := range audio {
+		audio[i] = byte(i % 251)
+	}
+	longTitle := strings.Repeat("\xe9", 3000)
+
+	tests := []struct {
+		name        string
+		interval    int
+		metadata    string
+		title       string // as parsed from the upstream
+		deviceTitle string // as sent to the device
+	}{
+		{"title and url", 100, "StreamTitle='Artist - Song';StreamUrl='https://example.com';", "Artist - Song", "Artist - Song"},
+		{"quotes", 333, "StreamTitle='Rock 'n' Roll';", "Rock 'n' Roll", "Rock 'n' Roll"},
+		{"quote at the end", 8192, "StreamTitle='Quote'';", "Quote'", "Quote'"},
+		{"latin-1", 16000, "StreamTitle='Caf\xe9';", "Café", "Café"},
+		{"whitespace", 16001, "StreamTitle='  Padded  ';", "Padded", "Padded"},
+		{"no closing semicolon", 1, "StreamTitle='Unterminated'", "Unterminated", "Unterminated"},
+		{"no title", 100, "StreamUrl='https://example.com';", "", ""},
+		// utf-8 doubles the size - the title is cut at a character boundary
+		{"long title", 100, "StreamTitle='" + longTitle + "';", strings.Repeat("é", 3000), strings.Repeat("é", 2032)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			upstream := newIcyUpstream(audio, test.interval, test.metadata)
+			defer upstream.Close()
+			server, settings := newTestServer(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s"}]`, upstream.URL))
+
+			// The metadata is stripped for devices that didn't ask for it
+			response := requestPlayback(server, "plain", "station")
+			assert.Empty(t, response.Header().Get("icy-metaint"))
+			assert.Equal(t, audio, response.Body.Bytes())
+			history := settings.PlaybackManager.DeviceHistory("plain")
+			if assert.Len(t, history, 1) {
+				assert.Equal(t, test.title, history[0].Title)
+			}
+
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, "/playback?mac=icy&stationId="+b64.URLEncoding.EncodeToString([]byte("station")), nil)
+			request.Header.Set("Icy-MetaData", "1")
+			server.Handler().ServeHTTP(recorder, request)
+			interval, err := strconv.Atoi(recorder.Header().Get("icy-metaint"))
+			if !assert.NoError(t, err) {
+				return
+			}
+			deviceAudio, metadata := splitIcyStream(t, recorder.Body.Bytes(), interval)
+			assert.Equal(t, audio, deviceAudio)
+			if len(test.deviceTitle) == 0 {
+				assert.Empty(t, metadata)
+			} else {
+				// Only changes of the title are sent
+				assert.Equal(t, []string{"StreamTitle='" + test.deviceTitle + "';"}, metadata)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package noxon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJsonPlaybackHistory(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "history.json")
+	jsonHistory := noxon.NewJsonPlaybackHistory(file, 2)
+	manager := noxon.NewMemPlaybackManagerWithHistory(time.Hour, 10, jsonHistory)
+	for _, stationId := range []string{"1", "2", "3"} {
+		startTime := time.Now()
+		manager.StartPlayback("mac", noxon.Playback{StationId: stationId, StreamUrl: "https://example.com/stream.mp3", StartTime: startTime})
+		manager.StopPlayback("mac", startTime)
+	}
+	startTime := time.Now()
+	manager.StartPlayback("other", noxon.Playback{StationId: "4", StartTime: startTime})
+	manager.StopPlayback("other", startTime)
+
+	// Bounded per device - the latest first
+	history := manager.DeviceHistory("mac")
+	assert.Len(t, history, 2)
+	assert.Equal(t, "3", history[0].StationId)
+	assert.Equal(t, "2", history[1].StationId)
+
+	// The file is written with a delay - not once per playback
+	assert.NoFileExists(t, file)
+	jsonHistory.Flush()
+
+	// The history survives a restart (without the stream urls)
+	reloaded := noxon.NewJsonPlaybackHistory(file, 2)
+	history = reloaded.Device("mac")
+	assert.Len(t, history, 2)
+	assert.Equal(t, "3", history[0].StationId)
+	assert.Equal(t, "mac", history[0].Mac)
+	assert.Empty(t, history[0].StreamUrl)
+	assert.Len(t, reloaded.Device("other"), 1)
+	assert.Empty(t, reloaded.Device("unknown"))
+}
+
+func TestPlaybackManagerDeviceHistoryWithoutPersistence(t *testing.T) {
+
+	manager := noxon.NewMemPlaybackManager(time.Hour, 10)
+	for _, mac := range []string{"mac", "other", "mac"} {
+		startTime := time.Now()
+		manager.StartPlayback(mac, noxon.Playback{StationId: mac, StartTime: startTime})
+		manager.StopPlayback(mac, startTime)
+	}
+	assert.Len(t, manager.DeviceHistory("mac"), 2)
+	assert.Len(t, manager.DeviceHistory("other"), 1)
+}
+
+func TestPlaybackHistoryWithNegativeSize(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "history.json")
+	manager := noxon.NewMemPlaybackManagerWithHistory(time.Hour, -1, noxon.NewJsonPlaybackHistory(file, -1))
+	startTime := time.Now()
+	manager.StartPlayback("mac", noxon.Playback{StationId: "1", StartTime: startTime})
+	manager.StopPlayback("mac", startTime)
+	assert.Empty(t, manager.History())
+	assert.Empty(t, manager.DeviceHistory("mac"))
+}
+
+func TestJsonPlaybackHistoryIsWrittenDelayed(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "history.json")
+	assert.NoError(t, os.WriteFile(file, []byte("[]"), 0640))
+	history := noxon.NewJsonPlaybackHistory(file, 10)
+	history.Add(noxon.HistoryEntry{Mac: "mac", StationId: "1", StartTime: time.Now()})
+	history.Add(noxon.HistoryEntry{Mac: "mac", StationId: "2", StartTime: time.Now()})
+
+	assert.Eventually(t, func() bool { return len(noxon.NewJsonPlaybackHistory(file, 10).Device("mac")) == 2 }, 5*time.Second, 50*time.Millisecond)
+	// The permissions of the file are kept
+	info, err := os.Stat(file)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+}
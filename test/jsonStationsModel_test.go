@@ -1,7 +1,10 @@
 package noxon
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
 	"github.com/stretchr/testify/assert"
@@ -26,3 +29,144 @@ func TestOperationHealthCheck(t *testing.T) {
 	model := noxon.NewJsonStationsModel()
 	requestDataRecursive(t, nil, model)
 }
+
+func TestAlternativeUrlsOrder(t *testing.T) {
+
+	model := noxon.NewJsonModelFromJson([]byte(`[{
+		"stationName": "Mirrored",
+		"stationUrl": "https://primary.example.com/stream",
+		"alternativeUrls": [
+			{ "url": "https://backup.example.com/stream", "priority": 2 },
+			{ "url": "https://low.example.com/stream", "priority": 1, "bitrate": 64000 },
+			{ "url": "https://high.example.com/stream", "priority": 1, "bitrate": 128000 }
+		]
+	}]`))
+	item, _ := model.Data(nil, 0)
+	station, ok := item.(noxon.ItemStation)
+	assert.True(t, ok)
+	assert.Equal(t, "https://primary.example.com/stream", station.StationUrl)
+	assert.Equal(t, []string{"https://high.example.com/stream", "https://low.example.com/stream", "https://backup.example.com/stream"}, station.AlternativeUrls)
+}
+
+func TestJsonModelReload(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "stations.json")
+	write := func(content string, modTime time.Time) {
+		assert.NoError(t, os.WriteFile(file, []byte(content), 0644))
+		assert.NoError(t, os.Chtimes(file, modTime, modTime))
+	}
+	write(`[{"stationName": "One", "stationUrl": "https://example.com/one"}, {"stationName": "Two", "stationUrl": "https://example.com/two"}]`, time.Now().Add(-time.Hour))
+
+	model := noxon.NewJsonModelFromFile(file, 10*time.Millisecond)
+	assert.Equal(t, 2, model.Count(nil))
+	_, twoId := model.Data(nil, 1)
+
+	// A new station in front - the existing station keeps its id
+	write(`[{"stationName": "Zero", "stationUrl": "https://example.com/zero"}, {"stationName": "Two", "stationUrl": "https://example.com/two"}]`, time.Now().Add(-time.Minute))
+	assert.Eventually(t, func() bool { return model.Count(nil) == 2 && first(model) == "Zero" }, time.Second, 10*time.Millisecond)
+	item, id := model.Data(&twoId, -1)
+	assert.Equal(t, twoId, id)
+	assert.Equal(t, "Two", item.(noxon.ItemStation).StationName)
+
+	// An invalid file is ignored
+	write(`[{"stationName": "Broken"`, time.Now())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "Zero", first(model))
+
+	// A closed model keeps its stations
+	model.Close()
+	write(`[{"stationName": "Three", "stationUrl": "https://example.com/three"}]`, time.Now().Add(time.Minute))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "Zero", first(model))
+}
+
+func first(model noxon.JsonModel) string {
+
+	item, _ := model.Data(nil, 0)
+	if station, ok := item.(noxon.ItemStation); ok {
+		return station.StationName
+	}
+	return ""
+}
+
+func TestStableIds(t *testing.T) {
+
+	stations := `[
+		{"dirName": "News", "children": [{"stationName": "DLF", "stationUrl": "https://example.com/dlf"}]},
+		{"id": "jazz", "stationName": "Jazz", "stationUrl": "https://example.com/jazz"}
+	]`
+	model := noxon.NewJsonModelFromJson([]byte(stations))
+	_, newsId := model.Data(nil, 0)
+	_, dlfId := model.Data(&newsId, 0)
+	_, jazzId := model.Data(nil, 1)
+	assert.Equal(t, "jazz", jazzId)
+
+	// Inserting a station does not change the ids of the others
+	moved := noxon.NewJsonModelFromJson([]byte(`[{"stationName": "New", "stationUrl": "https://example.com/new"},` + stations[1:]))
+	_, movedNewsId := moved.Data(nil, 1)
+	_, movedDlfId := moved.Data(&movedNewsId, 0)
+	assert.Equal(t, newsId, movedNewsId)
+	assert.Equal(t, dlfId, movedDlfId)
+
+	ids, err := noxon.MigratePositionalIds([]byte(stations))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"0": newsId, "1": dlfId, "2": "jazz"}, ids)
+}
+
+// Searches the item recursively without the index (the baseline of the benchmarks)
+func findLinear(model noxon.JsonModel, parentId *string, id string) noxon.Item {
+
+	for index := 0; index < model.Count(parentId); index++ {
+		item, itemId := model.Data(parentId, index)
+		if itemId == id {
+			return item
+		}
+		if _, ok := item.(noxon.ItemDir); ok {
+			if child := findLinear(model, &itemId, id); child != nil {
+				return child
+			}
+		}
+	}
+	return nil
+}
+
+// The id of the last entry of the random model - the worst case of the linear search
+func lastId(model noxon.JsonModel) string {
+
+	var id string
+	var parentId *string
+	for count := model.Count(nil); count > 0; count = model.Count(parentId) {
+		_, id = model.Data(parentId, count-1)
+		parentId = &id
+	}
+	return id
+}
+
+func TestFindEntryIndexed(t *testing.T) {
+
+	model := noxon.NewRandomJsonModel()
+	id := lastId(model)
+	item, itemId := model.Data(&id, -1)
+	assert.Equal(t, id, itemId)
+	assert.Equal(t, findLinear(model, nil, id), item)
+}
+
+func BenchmarkFindEntryIndexed(b *testing.B) {
+
+	model := noxon.NewRandomJsonModel()
+	id := lastId(model)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		model.Data(&id, -1)
+	}
+}
+
+func BenchmarkFindEntryLinear(b *testing.B) {
+
+	model := noxon.NewRandomJsonModel()
+	id := lastId(model)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		findLinear(model, nil, id)
+	}
+}
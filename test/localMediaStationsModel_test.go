@@ -0,0 +1,140 @@
+package noxon
+
+import (
+	"bytes"
+	b64 "encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalMediaStationsModel(t *testing.T) {
+
+	dir := t.TempDir()
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "Podcasts"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.mp3"), []byte{}, 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "cover.jpg"), []byte{}, 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, ".hidden.mp3"), []byte{}, 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "Podcasts", "b.mp3"), []byte{}, 0644))
+
+	model := noxon.NewLocalMediaStationsModel("Music", dir)
+	assert.Equal(t, 1, model.Count(nil))
+	root, rootId := model.Data(nil, 0)
+	assert.Equal(t, noxon.ItemDir{Title: "Music"}, root)
+
+	// Dirs first, only playable files
+	assert.Equal(t, 2, model.Count(&rootId))
+	podcasts, podcastsId := model.Data(&rootId, 0)
+	assert.Equal(t, noxon.ItemDir{Title: "Podcasts"}, podcasts)
+	file, fileId := model.Data(&rootId, 1)
+	assert.Equal(t, "a", file.(noxon.ItemStation).StationName)
+	assert.Equal(t, filepath.Join(dir, "a.mp3"), file.(noxon.ItemStation).MediaFile)
+	same, _ := model.Data(&fileId, -1)
+	assert.Equal(t, file, same)
+
+	assert.Equal(t, 1, model.Count(&podcastsId))
+	nested, _ := model.Data(&podcastsId, 0)
+	assert.Equal(t, filepath.Join(dir, "Podcasts", "b.mp3"), nested.(noxon.ItemStation).MediaFile)
+
+	// Never leave the directory
+	outside := rootId + "../secret.mp3"
+	_, outsideId := model.Data(&outside, -1)
+	assert.Empty(t, outsideId)
+}
+
+func TestLocalMediaStationsModelSymlinks(t *testing.T) {
+
+	dir, outside := t.TempDir(), t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(outside, "secret.mp3"), []byte{}, 0644))
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "Albums"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "Albums", "a.mp3"), []byte{}, 0644))
+	assert.NoError(t, os.Symlink(filepath.Join(outside, "secret.mp3"), filepath.Join(dir, "secret.mp3")))
+	assert.NoError(t, os.Symlink(outside, filepath.Join(dir, "Outside")))
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "Albums", "a.mp3"), filepath.Join(dir, "link.mp3")))
+	assert.NoError(t, os.Symlink(dir, filepath.Join(dir, "Albums", "Loop")))
+
+	model := noxon.NewLocalMediaStationsModel("Music", dir)
+	_, rootId := model.Data(nil, 0)
+
+	// Symlinks pointing outside of the directory are neither listed nor served
+	assert.Equal(t, 2, model.Count(&rootId))
+	albums, _ := model.Data(&rootId, 0)
+	assert.Equal(t, noxon.ItemDir{Title: "Albums"}, albums)
+	link, _ := model.Data(&rootId, 1)
+	assert.Equal(t, "link", link.(noxon.ItemStation).StationName)
+	for _, id := range []string{rootId + "secret.mp3", rootId + "Outside/secret.mp3"} {
+		_, itemId := model.Data(&id, -1)
+		assert.Empty(t, itemId, id)
+	}
+
+	// A symlinked dir is searched once
+	assert.Equal(t, []string{rootId + "link.mp3"}, model.Search("link"))
+}
+
+func TestLocalMediaStationsModelListsChanges(t *testing.T) {
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.mp3"), []byte{}, 0644))
+	model := noxon.NewLocalMediaStationsModel("Music", dir)
+	_, rootId := model.Data(nil, 0)
+	assert.Equal(t, 1, model.Count(&rootId))
+
+	// The cached listing is read again once the dir changed
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "b.mp3"), []byte{}, 0644))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(dir, later, later))
+	assert.Equal(t, 2, model.Count(&rootId))
+	second, _ := model.Data(&rootId, 1)
+	assert.Equal(t, "b", second.(noxon.ItemStation).StationName)
+}
+
+func TestLocalMediaPlaybackWithRange(t *testing.T) {
+
+	dir := t.TempDir()
+	audio := bytes.Repeat([]byte{0xff, 0xfb, 0x90, 0x44}, 1000)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.mp3"), audio, 0644))
+	model := noxon.NewLocalMediaStationsModel("Music", dir)
+	_, rootId := model.Data(nil, 0)
+	_, fileId := model.Data(&rootId, 0)
+	settings := noxon.NewDefaultNoxonServerSettings().WithWhitelist([]string{"*"}).WithStationsModel(model)
+	server := noxon.NewNoxonServer(settings)
+
+	play := func(rangeHeader string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/playback?mac=mac&stationId="+b64.URLEncoding.EncodeToString([]byte(fileId)), nil)
+		if len(rangeHeader) > 0 {
+			request.Header.Set("Range", rangeHeader)
+		}
+		server.Handler().ServeHTTP(recorder, request)
+		return recorder
+	}
+	assert.Equal(t, audio, play("").Body.Bytes())
+	assert.Equal(t, audio[100:], play("bytes=100-").Body.Bytes())
+	assert.Equal(t, http.StatusPartialContent, play("bytes=2000-").Code)
+
+	// Seeking is no new playback - only playing from the start again is
+	assert.Len(t, settings.PlaybackManager.DeviceHistory("mac"), 1)
+	assert.Equal(t, audio, play("bytes=0-").Body.Bytes())
+	assert.Len(t, settings.PlaybackManager.DeviceHistory("mac"), 2)
+}
+
+func TestLocalMediaPlaybackOfRecording(t *testing.T) {
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "20240131-200000_Station.aac"), []byte("aac"), 0644))
+	model := noxon.NewLocalMediaStationsModel("Recordings", dir)
+	_, rootId := model.Data(nil, 0)
+	assert.Equal(t, 1, model.Count(&rootId))
+	_, fileId := model.Data(&rootId, 0)
+	server := noxon.NewNoxonServer(noxon.NewDefaultNoxonServerSettings().WithWhitelist([]string{"*"}).WithStationsModel(model))
+
+	response := requestPlayback(server, "mac", fileId)
+	assert.Equal(t, "audio/aac", response.Header().Get("Content-Type"))
+	assert.Equal(t, "aac", response.Body.String())
+}
@@ -0,0 +1,59 @@
+package noxon
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlaybackManagerStationExpires(t *testing.T) {
+
+	manager := noxon.NewMemPlaybackManager(time.Minute, 10)
+	manager.SetStation("mac", "1", noxon.Station{StreamUrl: "https://example.com/fresh", LastUpdate: time.Now()})
+	manager.SetStation("mac", "2", noxon.Station{StreamUrl: "https://example.com/stale", LastUpdate: time.Now().Add(-time.Hour)})
+
+	station, ok := manager.Station("mac", "1")
+	assert.True(t, ok)
+	assert.Equal(t, "https://example.com/fresh", station.StreamUrl)
+	_, ok = manager.Station("mac", "2")
+	assert.False(t, ok)
+	_, ok = manager.Station("other", "1")
+	assert.False(t, ok)
+}
+
+func TestPlaybackManagerHistoryIsBounded(t *testing.T) {
+
+	manager := noxon.NewMemPlaybackManager(time.Hour, 3)
+	for i := 0; i < 5; i++ {
+		startTime := time.Now()
+		manager.StartPlayback("mac", noxon.Playback{StationId: fmt.Sprint(i), StartTime: startTime})
+		manager.UpdateTitle("mac", startTime, fmt.Sprintf("title %d", i))
+		manager.StopPlayback("mac", startTime)
+	}
+
+	history := manager.History()
+	assert.Len(t, history, 3)
+	assert.Equal(t, "4", history[0].StationId)
+	assert.Equal(t, "title 4", history[0].Title)
+	assert.Equal(t, "2", history[2].StationId)
+	assert.Empty(t, manager.Playbacks())
+}
+
+func TestPlaybackManagerIgnoresStaleStop(t *testing.T) {
+
+	manager := noxon.NewMemPlaybackManager(time.Hour, 10)
+	first := time.Now()
+	manager.StartPlayback("mac", noxon.Playback{StationId: "1", StartTime: first})
+	second := first.Add(time.Second)
+	manager.StartPlayback("mac", noxon.Playback{StationId: "2", StartTime: second})
+	// The device switched the station - the first playback must not stop the second one
+	manager.StopPlayback("mac", first)
+
+	playback, ok := manager.Playback("mac")
+	assert.True(t, ok)
+	assert.Equal(t, "2", playback.StationId)
+	assert.Len(t, manager.History(), 1)
+}
@@ -0,0 +1,268 @@
+package noxon
+
+import (
+	"bytes"
+	b64 "encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+// A server with the stations (json) that accepts every device
+func newTestServer(stations string) (*noxon.NoxonServer, noxon.NoxonServerSettings) {
+
+	settings := noxon.NewDefaultNoxonServerSettings().
+		WithWhitelist([]string{"*"}).
+		WithStationsModel(noxon.NewJsonModelFromJson([]byte(stations)))
+	return noxon.NewNoxonServer(settings), settings
+}
+
+// Requests the playback of the station and waits until the stream ends
+func requestPlayback(server *noxon.NoxonServer, mac string, stationId string) *httptest.ResponseRecorder {
+
+	recorder := httptest.NewRecorder()
+	target := fmt.Sprintf("/playback?mac=%s&stationId=%s", mac, b64.URLEncoding.EncodeToString([]byte(stationId)))
+	server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+	return recorder
+}
+
+// Serves the audio once - the stream ends afterwards
+func newAudioUpstream(audio []byte) *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Header().Set("icy-name", "Test Radio")
+		w.Write(audio)
+	}))
+}
+
+func TestPlaybackEndpoint(t *testing.T) {
+
+	audio := bytes.Repeat([]byte{0xff, 0xfb, 0x90, 0x44}, 20000)
+	upstream := newAudioUpstream(audio)
+	defer upstream.Close()
+	server, settings := newTestServer(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s"}]`, upstream.URL))
+
+	response := requestPlayback(server, "mac", "station")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "audio/mpeg", response.Header().Get("Content-Type"))
+	assert.Equal(t, "Test Radio", response.Header().Get("icy-name"))
+	assert.Equal(t, audio, response.Body.Bytes())
+
+	history := settings.PlaybackManager.DeviceHistory("mac")
+	assert.Len(t, history, 1)
+	assert.Equal(t, "station", history[0].StationId)
+	assert.Empty(t, settings.PlaybackManager.Playbacks())
+
+	// Unknown stations and devices
+	assert.Equal(t, http.StatusNotFound, requestPlayback(server, "mac", "unknown").Code)
+	blocked := noxon.NewNoxonServer(settings.WithWhitelist([]string{"other"}))
+	assert.NotEqual(t, http.StatusOK, requestPlayback(blocked, "mac", "station").Code)
+}
+
+func TestPlaybackRemembersMirror(t *testing.T) {
+
+	primaryRequests := atomic.Int32{}
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryRequests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	mirror := newAudioUpstream([]byte("audio"))
+	defer mirror.Close()
+	_, settings := newTestServer(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s", "alternativeUrls": [{"url": "%s"}]}]`, primary.URL, mirror.URL))
+	// The resolved stations expire immediately
+	server := noxon.NewNoxonServer(settings.WithPlaybackManager(noxon.NewMemPlaybackManager(0, 10)))
+
+	assert.Equal(t, "audio", requestPlayback(server, "mac", "station").Body.String())
+	assert.Equal(t, int32(1), primaryRequests.Load())
+
+	// The mirror is tried first - for other devices too
+	assert.Equal(t, "audio", requestPlayback(server, "mac", "station").Body.String())
+	assert.Equal(t, "audio", requestPlayback(server, "other", "station").Body.String())
+	assert.Equal(t, int32(1), primaryRequests.Load())
+}
+
+func TestPlaybackFailsOverWhenStreamCannotBeOpened(t *testing.T) {
+
+	// The primary goes down right after the station was resolved
+	primaryRequests := atomic.Int32{}
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if primaryRequests.Add(1) == 1 {
+			w.Header().Set("Content-Type", "audio/mpeg")
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	mirror := newAudioUpstream([]byte("audio"))
+	defer mirror.Close()
+	server, settings := newTestServer(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s", "alternativeUrls": [{"url": "%s"}]}]`, primary.URL, mirror.URL))
+
+	response := requestPlayback(server, "mac", "station")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "audio", response.Body.String())
+	assert.Equal(t, mirror.URL, settings.PlaybackManager.Mirror("station"))
+
+	// No mirror left
+	mirror.Close()
+	response = requestPlayback(server, "other", "station")
+	assert.Equal(t, http.StatusBadGateway, response.Code)
+}
+
+func TestPlaybackOfPodcastEpisodeEnds(t *testing.T) {
+
+	episodeRequests := atomic.Int32{}
+	var feed string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/feed.rss" {
+			w.Header().Set("Content-Type", "application/rss+xml")
+			w.Write([]byte(feed))
+		} else if episodeRequests.Add(1) > 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			// Served without a length like a live stream
+			w.Header().Set("Content-Type", "audio/mpeg")
+			w.(http.Flusher).Flush()
+			w.Write([]byte("episode"))
+		}
+	}))
+	defer server.Close()
+	feed = fmt.Sprintf(`<rss version="2.0"><channel><title>Podcast</title><item><title>Episode</title><guid>episode</guid>
+		<enclosure url="%s/episode.mp3" type="audio/mpeg"/></item></channel></rss>`, server.URL)
+	model := noxon.NewPodcastStationsModel([]string{server.URL + "/feed.rss"}, 0)
+	model.Refresh()
+	feedItem, feedId := model.Data(nil, 0)
+	assert.Equal(t, noxon.ItemDir{Title: "Podcast"}, feedItem)
+	_, episodeId := model.Data(&feedId, 0)
+
+	settings := noxon.NewDefaultNoxonServerSettings().
+		WithWhitelist([]string{"*"}).
+		WithStationsModel(model).
+		WithReconnect(noxon.ReconnectSettings{Enabled: true, Retries: 5})
+	noxonServer := noxon.NewNoxonServer(settings)
+
+	// The episode is played once - it is not reconnected when it ends
+	response := requestPlayback(noxonServer, "mac", episodeId)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "episode", response.Body.String())
+	assert.Equal(t, int32(2), episodeRequests.Load())
+}
+
+func TestPlaybackOfPodcastEpisodeIsNotShared(t *testing.T) {
+
+	// A (long) episode of numbered lines that is served much faster than it is played
+	episode := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		if r.Method == http.MethodHead {
+			return
+		}
+		for counter := 0; ; counter++ {
+			if _, err := fmt.Fprintf(w, "%08d\n", counter); err != nil {
+				return
+			}
+		}
+	}))
+	defer episode.Close()
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprintf(w, `<rss version="2.0"><channel><title>Podcast</title><item><title>Episode</title><guid>episode</guid>
+			<enclosure url="%s/episode.mp3" type="audio/mpeg"/></item></channel></rss>`, episode.URL)
+	}))
+	defer feed.Close()
+	model := noxon.NewPodcastStationsModel([]string{feed.URL}, 0)
+	model.Refresh()
+	_, feedId := model.Data(nil, 0)
+	_, episodeId := model.Data(&feedId, 0)
+	settings := noxon.NewDefaultNoxonServerSettings().WithWhitelist([]string{"*"}).WithStationsModel(model)
+	server := httptest.NewServer(noxon.NewNoxonServer(settings).Handler())
+	defer server.Close()
+
+	first := listen(t, server, "first", episodeId, nil)
+	defer first.close()
+	assert.Equal(t, 0, first.counters(50)[0])
+
+	// The first device doesn't read for a while - the start of the episode is long gone from a shared stream. The
+	// second device plays the episode from the start anyway
+	time.Sleep(time.Second)
+	second := listen(t, server, "second", episodeId, nil)
+	defer second.close()
+	counters := second.counters(50)
+	assert.Equal(t, 0, counters[0])
+	assertContiguous(t, counters)
+}
+
+// Remembers the stations reported as played
+type playedStationsModel struct {
+	noxon.StationsModel
+	played []string
+}
+
+func (m *playedStationsModel) ForDevice(mac string) noxon.StationsModel {
+
+	return m
+}
+
+func (m *playedStationsModel) Played(mac string, stationId string) {
+
+	m.played = append(m.played, stationId)
+}
+
+func TestPlaybackReportsOnlyOpenedStationsAsPlayed(t *testing.T) {
+
+	upstream := newAudioUpstream(bytes.Repeat([]byte{0xff, 0xfb, 0x90, 0x44}, 1000))
+	defer upstream.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	model := &playedStationsModel{StationsModel: noxon.NewJsonModelFromJson([]byte(fmt.Sprintf(`[
+  {"id": "station", "stationName": "Station", "stationUrl": "%s"},
+  {"id": "dead", "stationName": "Dead", "stationUrl": "%s", "alternativeUrls": [{"url": "%[2]s/mirror"}]}
+]`, upstream.URL, dead.URL)))}
+	server := noxon.NewNoxonServer(noxon.NewDefaultNoxonServerSettings().WithWhitelist([]string{"*"}).WithStationsModel(model))
+
+	assert.Equal(t, http.StatusNotFound, requestPlayback(server, "mac", "unknown").Code)
+	assert.Empty(t, model.played)
+	// None of the mirrors could be opened
+	assert.Equal(t, http.StatusBadGateway, requestPlayback(server, "mac", "dead").Code)
+	assert.Empty(t, model.played)
+	assert.Equal(t, http.StatusOK, requestPlayback(server, "mac", "station").Code)
+	assert.Equal(t, []string{"station"}, model.played)
+}
+
+// Offers the stations only to the device
+type deviceOnlyStationsModel struct {
+	noxon.StationsModel
+	mac    string
+	device noxon.StationsModel
+}
+
+func (m deviceOnlyStationsModel) ForDevice(mac string) noxon.StationsModel {
+
+	if mac == m.mac {
+		return m.device
+	}
+	return m
+}
+
+func (m deviceOnlyStationsModel) Played(mac string, stationId string) {}
+
+func TestPlaybackOfDeviceStation(t *testing.T) {
+
+	upstream := newAudioUpstream([]byte("audio"))
+	defer upstream.Close()
+	model := deviceOnlyStationsModel{
+		StationsModel: noxon.NewJsonModelFromJson([]byte(`[]`)),
+		mac:           "mac",
+		device:        noxon.NewJsonModelFromJson([]byte(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s"}]`, upstream.URL))),
+	}
+	server := noxon.NewNoxonServer(noxon.NewDefaultNoxonServerSettings().WithWhitelist([]string{"*"}).WithStationsModel(model))
+
+	assert.Equal(t, "audio", requestPlayback(server, "mac", "station").Body.String())
+	assert.Equal(t, http.StatusNotFound, requestPlayback(server, "other", "station").Code)
+}
@@ -0,0 +1,135 @@
+package noxon
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type playlistFile struct {
+	contentType string
+	body        string
+}
+
+// Serves the playlists by path. The streams at /stream/<name> answer with "stream <name>", /dead with 404 and /error
+// with an error page. The GET requests are counted by path
+type playlistUpstream struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests map[string]int
+}
+
+func newPlaylistUpstream(playlists map[string]playlistFile) *playlistUpstream {
+
+	upstream := &playlistUpstream{requests: map[string]int{}}
+	upstream.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			upstream.mutex.Lock()
+			upstream.requests[r.URL.Path]++
+			upstream.mutex.Unlock()
+		}
+		if name, ok := strings.CutPrefix(r.URL.Path, "/stream/"); ok {
+			w.Header().Set("Content-Type", "audio/mpeg")
+			fmt.Fprintf(w, "stream %s", name)
+		} else if r.URL.Path == "/error" {
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, "<html><body>Server error</body></html>")
+		} else if playlist, ok := playlists[r.URL.Path]; ok {
+			w.Header().Set("Content-Type", playlist.contentType)
+			fmt.Fprint(w, strings.ReplaceAll(playlist.body, "{url}", upstream.URL))
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return upstream
+}
+
+func (u *playlistUpstream) requestCount(path string) int {
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.requests[path]
+}
+
+func TestPlaylistResolution(t *testing.T) {
+
+	upstream := newPlaylistUpstream(map[string]playlistFile{
+		"/m3u":     {"audio/x-mpegurl", "#EXTM3U\n#EXTINF:-1,Radio\n\n# a comment\nstream/m3u\n"},
+		"/m3u-bom": {"audio/mpegurl", "\ufeff{url}/stream/bom\n"},
+		"/pls":     {"audio/x-scpls", "[playlist]\nNumberOfEntries=2\nFile1={url}/dead\nTitle1=Dead\nFile2={url}/stream/pls\nTitle2=Radio\n"},
+		"/asx":     {"video/x-ms-asx", `<ASX version="3.0"><ENTRY><TITLE>Radio</TITLE><REF HREF="{url}/stream/asx"/></ENTRY></ASX>`},
+		"/xspf": {"application/xspf+xml", `<?xml version="1.0" encoding="UTF-8"?>
+<playlist version="1" xmlns="http://xspf.org/ns/0/"><trackList>
+  <track><title>Radio</title><location>{url}/stream/xspf</location></track>
+</trackList></playlist>`},
+		"/list.pls":      {"text/plain", "[playlist]\nFile1=stream/extension\n"},
+		"/list.m3u":      {"application/octet-stream", "{url}/stream/octet\n"},
+		"/audio.m3u":     {"audio/mpeg", "not a playlist"},
+		"/skip.m3u":      {"audio/x-mpegurl", "mms://example.com/stream\nfile:///music/radio.mp3\n{url}/dead\n{url}/error\n{url}/stream/skip\n"},
+		"/outer.m3u":     {"audio/x-mpegurl", "inner.pls\n"},
+		"/inner.pls":     {"audio/x-scpls", "[playlist]\nFile1={url}/innermost.asx\n"},
+		"/innermost.asx": {"video/x-ms-asx", `<asx><entry><ref href="stream/nested"/></entry></asx>`},
+	})
+	defer upstream.Close()
+
+	for _, test := range []struct {
+		name   string
+		path   string
+		stream string
+	}{
+		{"m3u with relative entries", "/m3u", "stream m3u"},
+		{"m3u with a byte order mark", "/m3u-bom", "stream bom"},
+		{"pls with a dead entry", "/pls", "stream pls"},
+		{"asx with upper case elements", "/asx", "stream asx"},
+		{"xspf", "/xspf", "stream xspf"},
+		{"detected by the extension", "/list.pls", "stream extension"},
+		{"octet-stream detected by the extension", "/list.m3u", "stream octet"},
+		{"audio is never a playlist", "/audio.m3u", "not a playlist"},
+		{"unreachable and non http entries are skipped", "/skip.m3u", "stream skip"},
+		{"nested playlists", "/outer.m3u", "stream nested"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server, _ := newTestServer(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s%s"}]`, upstream.URL, test.path))
+			response := requestPlayback(server, "mac", "station")
+			assert.Equal(t, http.StatusOK, response.Code)
+			assert.Equal(t, test.stream, response.Body.String())
+		})
+	}
+}
+
+func TestPlaylistRecursionLimit(t *testing.T) {
+
+	upstream := newPlaylistUpstream(map[string]playlistFile{
+		"/loop.m3u": {"audio/x-mpegurl", "loop.m3u\n"},
+	})
+	defer upstream.Close()
+	server, _ := newTestServer(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s/loop.m3u"}]`, upstream.URL))
+
+	// The resolution gives up after 5 nested playlists - the station url is played as it is then
+	requestPlayback(server, "mac", "station")
+	assert.Equal(t, 6+1, upstream.requestCount("/loop.m3u"))
+}
+
+func TestStreamIsOpenedOnce(t *testing.T) {
+
+	upstream := newPlaylistUpstream(map[string]playlistFile{
+		"/playlist.m3u": {"audio/x-mpegurl", "{url}/stream/m3u\n"},
+	})
+	defer upstream.Close()
+	server, _ := newTestServer(fmt.Sprintf(`[
+  {"id": "stream", "stationName": "Stream", "stationUrl": "%[1]s/stream/plain"},
+  {"id": "playlist", "stationName": "Playlist", "stationUrl": "%[1]s/playlist.m3u"}
+]`, upstream.URL))
+
+	// The stream is recognized without opening it - only the playback opens it
+	assert.Equal(t, "stream plain", requestPlayback(server, "mac", "stream").Body.String())
+	assert.Equal(t, 1, upstream.requestCount("/stream/plain"))
+	assert.Equal(t, "stream m3u", requestPlayback(server, "mac", "playlist").Body.String())
+	assert.Equal(t, 1, upstream.requestCount("/playlist.m3u"))
+	assert.Equal(t, 1, upstream.requestCount("/stream/m3u"))
+}
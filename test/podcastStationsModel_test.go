@@ -0,0 +1,58 @@
+package noxon
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPodcastStationsModel(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "podcast.rss")
+	}))
+	defer server.Close()
+
+	model := noxon.NewPodcastStationsModel([]string{server.URL + "/podcast.rss"}, 0)
+	model.Refresh()
+
+	assert.Equal(t, 1, model.Count(nil))
+	feed, feedId := model.Data(nil, 0)
+	assert.Equal(t, noxon.ItemDir{Title: "Test Podcast"}, feed)
+
+	// The latest episode first, entries without enclosure are skipped
+	assert.Equal(t, 2, model.Count(&feedId))
+	latest, latestId := model.Data(&feedId, 0)
+	assert.Equal(t, "Episode 2", latest.(noxon.ItemStation).StationName)
+	assert.Equal(t, "The second episode", latest.(noxon.ItemStation).StationDescription)
+	assert.Equal(t, "https://example.com/episode2.mp3", latest.(noxon.ItemStation).StationUrl)
+	same, _ := model.Data(&latestId, -1)
+	assert.Equal(t, latest, same)
+	_, olderId := model.Data(&feedId, 1)
+
+	// The latest episode is new until the device played it
+	device := model.ForDevice("mac")
+	feed, _ = device.Data(nil, 0)
+	assert.Equal(t, noxon.ItemDir{Title: "Test Podcast (new)"}, feed)
+	model.Played("mac", olderId)
+	latest, _ = device.Data(&feedId, 0)
+	assert.Equal(t, "New: Episode 2", latest.(noxon.ItemStation).StationName)
+	model.Played("mac", latestId)
+	latest, _ = device.Data(&feedId, 0)
+	assert.Equal(t, "Episode 2", latest.(noxon.ItemStation).StationName)
+	model.Played("mac", olderId)
+	feed, _ = device.Data(nil, 0)
+	assert.Equal(t, noxon.ItemDir{Title: "Test Podcast"}, feed)
+
+	// Other devices did not play it
+	feed, _ = model.ForDevice("other").Data(nil, 0)
+	assert.Equal(t, noxon.ItemDir{Title: "Test Podcast (new)"}, feed)
+
+	// The cached feed survives a failing refresh
+	server.Close()
+	model.Refresh()
+	assert.Equal(t, 2, model.Count(&feedId))
+}
@@ -0,0 +1,72 @@
+package noxon
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRadioBrowserStationsModel(t *testing.T) {
+
+	model := noxon.NewRadioBrowserStationsModel("Radio Browser", "radio-browser.json", "", 0)
+
+	assert.Equal(t, 1, model.Count(nil))
+	root, rootId := model.Data(nil, 0)
+	assert.Equal(t, noxon.ItemDir{Title: "Radio Browser"}, root)
+	assert.Equal(t, 4, model.Count(&rootId))
+
+	// Countries by name
+	_, countriesId := model.Data(&rootId, 0)
+	assert.Equal(t, 2, model.Count(&countriesId))
+	austria, austriaId := model.Data(&countriesId, 0)
+	assert.Equal(t, noxon.ItemDir{Title: "Austria (1)"}, austria)
+	station, _ := model.Data(&austriaId, 0)
+	assert.Equal(t, "Rock Radio", station.(noxon.ItemStation).StationName)
+	assert.Equal(t, "Austria: rock, jazz", station.(noxon.ItemStation).StationDescription)
+
+	// The most voted station first, broken stations are skipped
+	_, languagesId := model.Data(&rootId, 1)
+	assert.Equal(t, 2, model.Count(&languagesId))
+	german, germanId := model.Data(&languagesId, 1)
+	assert.Equal(t, noxon.ItemDir{Title: "German (2)"}, german)
+	station, _ = model.Data(&germanId, 0)
+	assert.Equal(t, "Rock Radio", station.(noxon.ItemStation).StationName)
+
+	// The most common genre first
+	_, genresId := model.Data(&rootId, 2)
+	jazz, _ := model.Data(&genresId, 0)
+	assert.Equal(t, noxon.ItemDir{Title: "jazz (2)"}, jazz)
+
+	_, topId := model.Data(&rootId, 3)
+	assert.Equal(t, 2, model.Count(&topId))
+	station, stationId := model.Data(&topId, 1)
+	assert.Equal(t, "https://example.com/jazz.mp3", station.(noxon.ItemStation).StationUrl)
+	assert.Equal(t, []string{"https://example.com/jazz.m3u"}, station.(noxon.ItemStation).AlternativeUrls)
+	same, _ := model.Data(&stationId, -1)
+	assert.Equal(t, station, same)
+}
+
+func TestRadioBrowserStationsModelCache(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/json/stations", r.URL.Path)
+		http.ServeFile(w, r, "radio-browser.json")
+	}))
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+
+	model := noxon.NewRadioBrowserStationsModel("Radio Browser", server.URL, cacheFile, 0)
+	assert.NoError(t, model.Refresh())
+	rootId := "rb:"
+	assert.Equal(t, 4, model.Count(&rootId))
+	server.Close()
+
+	// Offline - the stations come from the cache
+	offline := noxon.NewRadioBrowserStationsModel("Radio Browser", server.URL, cacheFile, 0)
+	assert.Error(t, offline.Refresh())
+	_, topId := offline.Data(&rootId, 3)
+	assert.Equal(t, 2, offline.Count(&topId))
+}
@@ -0,0 +1,227 @@
+package noxon
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+// A MPEG-1 layer III frame (64 kbit/s, 48 kHz, mono) - 192 bytes
+func mp3Frame(fill byte) []byte {
+
+	return append([]byte{0xff, 0xfb, 0x54, 0xc0}, bytes.Repeat([]byte{fill}, 192-4)...)
+}
+
+func mp3Frames(fill byte, count int) []byte {
+
+	return bytes.Repeat(mp3Frame(fill), count)
+}
+
+// The upstream answers the n-th request (starting with 1) with the handler. The times of the requests are recorded
+type scriptedUpstream struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []time.Time
+}
+
+func newScriptedUpstream(handler func(n int, w http.ResponseWriter, r *http.Request)) *scriptedUpstream {
+
+	upstream := &scriptedUpstream{}
+	upstream.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.mutex.Lock()
+		upstream.requests = append(upstream.requests, time.Now())
+		n := len(upstream.requests)
+		upstream.mutex.Unlock()
+		handler(n, w, r)
+	}))
+	return upstream
+}
+
+func (u *scriptedUpstream) requestTimes() []time.Time {
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return append([]time.Time{}, u.requests...)
+}
+
+// Writes the data like a live stream (without a length) in pieces that don't match the frames
+func writeLive(w http.ResponseWriter, data []byte) {
+
+	w.Header().Set("Content-Type", "audio/mpeg")
+	w.(http.Flusher).Flush()
+	for len(data) > 0 {
+		count := 100
+		if count > len(data) {
+			count = len(data)
+		}
+		w.Write(data[:count])
+		w.(http.Flusher).Flush()
+		data = data[count:]
+	}
+}
+
+// Splits the stream of the device into frames. Silent frames are reported with fill 0
+func splitMp3Frames(t *testing.T, stream []byte) (fills []byte) {
+
+	for len(stream) >= 192 {
+		frame := stream[:192]
+		stream = stream[192:]
+		// The silence has no padding and no CRC but the same format
+		if !assert.Equal(t, []byte{0xff, 0xfb, 0x54, 0xc0}, []byte{frame[0], frame[1] | 0x01, frame[2] &^ 0x02, frame[3]}, "out of sync") {
+			return fills
+		}
+		fills = append(fills, frame[4])
+		assert.Equal(t, bytes.Repeat(frame[4:5], 192-4), frame[4:])
+	}
+	assert.Empty(t, stream)
+	return fills
+}
+
+func newReconnectingServer(stationUrl string, reconnect noxon.ReconnectSettings) *noxon.NoxonServer {
+
+	_, settings := newTestServer(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s"}]`, stationUrl))
+	return noxon.NewNoxonServer(settings.WithReconnect(reconnect))
+}
+
+func TestReconnect(t *testing.T) {
+
+	// The first request resolves the station, the stream drops twice and the upstream is gone afterwards
+	upstream := newScriptedUpstream(func(n int, w http.ResponseWriter, r *http.Request) {
+		switch n {
+		case 1:
+			w.Header().Set("Content-Type", "audio/mpeg")
+		case 2:
+			writeLive(w, mp3Frames(0x11, 20))
+		case 3:
+			writeLive(w, mp3Frames(0x22, 20))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	defer upstream.Close()
+	server := newReconnectingServer(upstream.URL, noxon.ReconnectSettings{Enabled: true, Retries: 2})
+
+	response := requestPlayback(server, "mac", "station")
+	assert.Equal(t, http.StatusOK, response.Code)
+	fills := splitMp3Frames(t, response.Body.Bytes())
+	assert.Equal(t, append(bytes.Repeat([]byte{0x11}, 20), bytes.Repeat([]byte{0x22}, 20)...), fills)
+
+	// The budget is restored after the successful reconnect and exhausted by the two failing ones. The attempts back off
+	requests := upstream.requestTimes()
+	if assert.Len(t, requests, 5) {
+		assert.GreaterOrEqual(t, requests[2].Sub(requests[1]), 500*time.Millisecond)
+		assert.GreaterOrEqual(t, requests[3].Sub(requests[2]), 500*time.Millisecond)
+		assert.GreaterOrEqual(t, requests[4].Sub(requests[3]), time.Second)
+	}
+}
+
+func TestReconnectDisabled(t *testing.T) {
+
+	upstream := newScriptedUpstream(func(n int, w http.ResponseWriter, r *http.Request) {
+		writeLive(w, mp3Frames(byte(n), 10))
+	})
+	defer upstream.Close()
+	server := newReconnectingServer(upstream.URL, noxon.ReconnectSettings{Enabled: false, Retries: 2})
+
+	response := requestPlayback(server, "mac", "station")
+	assert.Equal(t, bytes.Repeat([]byte{2}, 10), splitMp3Frames(t, response.Body.Bytes()))
+	assert.Len(t, upstream.requestTimes(), 2)
+}
+
+func TestReconnectSilence(t *testing.T) {
+
+	// The stream stalls in the middle of a frame
+	stream := mp3Frames(0x33, 20)
+	upstream := newScriptedUpstream(func(n int, w http.ResponseWriter, r *http.Request) {
+		if n == 1 {
+			w.Header().Set("Content-Type", "audio/mpeg")
+			return
+		}
+		writeLive(w, stream[:10*192+50])
+		time.Sleep(2600 * time.Millisecond)
+		writeLive(w, stream[10*192+50:])
+	})
+	defer upstream.Close()
+	server := newReconnectingServer(upstream.URL, noxon.ReconnectSettings{Enabled: true, Retries: 0, Silence: true})
+
+	response := requestPlayback(server, "mac", "station")
+	fills := splitMp3Frames(t, response.Body.Bytes())
+	// The silence is inserted between the frames
+	silence := bytes.Count(fills, []byte{0})
+	assert.Greater(t, silence, 0)
+	assert.Equal(t, bytes.Repeat([]byte{0x33}, 10), fills[:10])
+	assert.Equal(t, bytes.Repeat([]byte{0}, silence), fills[10:10+silence])
+	assert.Equal(t, bytes.Repeat([]byte{0x33}, 10), fills[10+silence:])
+}
+
+func TestReconnectNoSilenceForUnknownFormat(t *testing.T) {
+
+	// Not a mp3 stream - the stall is not bridged
+	stream := bytes.Repeat([]byte("no frames"), 1000)
+	upstream := newScriptedUpstream(func(n int, w http.ResponseWriter, r *http.Request) {
+		if n == 1 {
+			w.Header().Set("Content-Type", "audio/mpeg")
+			return
+		}
+		writeLive(w, stream[:5000])
+		time.Sleep(2600 * time.Millisecond)
+		writeLive(w, stream[5000:])
+	})
+	defer upstream.Close()
+	server := newReconnectingServer(upstream.URL, noxon.ReconnectSettings{Enabled: true, Retries: 0, Silence: true})
+
+	response := requestPlayback(server, "mac", "station")
+	assert.Equal(t, stream, response.Body.Bytes())
+}
+
+// The upstream serves a file - the first download breaks off in the middle
+func newBreakingFileUpstream(file []byte, rangeRequests bool) *scriptedUpstream {
+
+	return newScriptedUpstream(func(n int, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		switch {
+		case n == 1:
+		case n == 2:
+			w.Header().Set("Content-Length", strconv.Itoa(len(file)))
+			w.Write(file[:len(file)/2])
+		case rangeRequests:
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(file))
+		default:
+			w.Write(file)
+		}
+	})
+}
+
+func TestReconnectContinuesFile(t *testing.T) {
+
+	file := mp3Frames(0x44, 20)
+	upstream := newBreakingFileUpstream(file, true)
+	defer upstream.Close()
+	server := newReconnectingServer(upstream.URL, noxon.ReconnectSettings{Enabled: true, Retries: 1})
+
+	// The file is continued where the download broke off
+	response := requestPlayback(server, "mac", "station")
+	assert.Equal(t, file, response.Body.Bytes())
+	assert.Len(t, upstream.requestTimes(), 3)
+}
+
+func TestReconnectFileWithoutRangeRequests(t *testing.T) {
+
+	file := mp3Frames(0x55, 20)
+	upstream := newBreakingFileUpstream(file, false)
+	defer upstream.Close()
+	server := newReconnectingServer(upstream.URL, noxon.ReconnectSettings{Enabled: true, Retries: 1})
+
+	// The file is not played from the start again
+	response := requestPlayback(server, "mac", "station")
+	assert.Equal(t, file[:len(file)/2], response.Body.Bytes())
+	assert.Len(t, upstream.requestTimes(), 3)
+}
@@ -0,0 +1,197 @@
+package noxon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRecordingServer(t *testing.T, upstreamUrl string) (*noxon.NoxonServer, string) {
+
+	dir := t.TempDir()
+	stations := fmt.Sprintf(`[
+  {"id": "station", "stationName": "My Station", "stationUrl": "%s"},
+  {"id": "dir", "dirName": "Dir"}
+]`, upstreamUrl)
+	settings := noxon.NewDefaultNoxonServerSettings().
+		WithWhitelist([]string{"*"}).
+		WithStationsModel(noxon.NewJsonModelFromJson([]byte(stations))).
+		WithRecording(noxon.RecordingSettings{Enabled: true, Dir: dir})
+	return noxon.NewNoxonServer(settings), dir
+}
+
+func requestRecordings(server *noxon.NoxonServer, method string, target string) *httptest.ResponseRecorder {
+
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+	return recorder
+}
+
+func listRecordings(t *testing.T, server *noxon.NoxonServer) []noxon.Recording {
+
+	response := requestRecordings(server, http.MethodGet, "/api/recordings")
+	assert.Equal(t, http.StatusOK, response.Code)
+	recordings := []noxon.Recording{}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &recordings))
+	return recordings
+}
+
+func TestRecording(t *testing.T) {
+
+	connections := atomic.Int32{}
+	upstream := newCounterUpstream(&connections)
+	defer upstream.Close()
+	server, dir := newRecordingServer(t, upstream.URL)
+
+	response := requestRecordings(server, http.MethodPost, "/api/recordings?stationId=station&minutes=1")
+	assert.Equal(t, http.StatusOK, response.Code)
+	started := map[string]string{}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &started))
+	name := started["name"]
+	assert.True(t, strings.HasSuffix(name, "_My_Station.mp3"), name)
+
+	// Active recordings know their station
+	time.Sleep(100 * time.Millisecond)
+	recordings := listRecordings(t, server)
+	assert.Len(t, recordings, 1)
+	assert.Equal(t, name, recordings[0].Name)
+	assert.Equal(t, "station", recordings[0].StationId)
+	assert.True(t, recordings[0].Active)
+
+	// Stopping closes the upstream
+	assert.Equal(t, http.StatusOK, requestRecordings(server, http.MethodPost, "/api/recordings/"+name+"/stop").Code)
+	assert.Eventually(t, func() bool { return connections.Load() == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, listRecordings(t, server)[0].Active)
+	assert.Equal(t, http.StatusNotFound, requestRecordings(server, http.MethodPost, "/api/recordings/"+name+"/stop").Code)
+
+	// The recording contains the stream from its start
+	recorded, err := os.ReadFile(filepath.Join(dir, name))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(recorded), "00000000\n00000001\n"))
+	recordings = listRecordings(t, server)
+	assert.Equal(t, int64(len(recorded)), recordings[0].Size)
+	assert.Empty(t, recordings[0].StationId)
+
+	response = requestRecordings(server, http.MethodGet, "/api/recordings/"+name)
+	assert.Equal(t, http.StatusOK, response.Code)
+	downloaded, _ := io.ReadAll(response.Body)
+	assert.Equal(t, recorded, downloaded)
+
+	// Deleting removes the file
+	assert.Equal(t, http.StatusOK, requestRecordings(server, http.MethodDelete, "/api/recordings/"+name).Code)
+	assert.NoFileExists(t, filepath.Join(dir, name))
+	assert.Empty(t, listRecordings(t, server))
+	assert.Equal(t, http.StatusNotFound, requestRecordings(server, http.MethodDelete, "/api/recordings/"+name).Code)
+}
+
+func TestRecordingsStartedInTheSameSecond(t *testing.T) {
+
+	connections := atomic.Int32{}
+	upstream := newCounterUpstream(&connections)
+	defer upstream.Close()
+	server, dir := newRecordingServer(t, upstream.URL)
+
+	names := []string{}
+	for i := 0; i < 2; i++ {
+		response := requestRecordings(server, http.MethodPost, "/api/recordings?stationId=station")
+		assert.Equal(t, http.StatusOK, response.Code)
+		started := map[string]string{}
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &started))
+		names = append(names, started["name"])
+	}
+
+	// Each recording gets its own file
+	assert.NotEqual(t, names[0], names[1])
+	recordings := listRecordings(t, server)
+	assert.Len(t, recordings, 2)
+	for _, name := range names {
+		assert.Equal(t, http.StatusOK, requestRecordings(server, http.MethodPost, "/api/recordings/"+name+"/stop").Code)
+		assert.FileExists(t, filepath.Join(dir, name))
+	}
+}
+
+func TestDeleteActiveRecording(t *testing.T) {
+
+	connections := atomic.Int32{}
+	upstream := newCounterUpstream(&connections)
+	defer upstream.Close()
+	server, dir := newRecordingServer(t, upstream.URL)
+
+	response := requestRecordings(server, http.MethodPost, "/api/recordings?stationId=station")
+	assert.Equal(t, http.StatusOK, response.Code)
+	started := map[string]string{}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &started))
+
+	// The recording is stopped before its file is removed
+	assert.Equal(t, http.StatusOK, requestRecordings(server, http.MethodDelete, "/api/recordings/"+started["name"]).Code)
+	assert.NoFileExists(t, filepath.Join(dir, started["name"]))
+	assert.Empty(t, listRecordings(t, server))
+	assert.Eventually(t, func() bool { return connections.Load() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRecordingsWithoutDir(t *testing.T) {
+
+	// The dir is only created by the first recording
+	settings := noxon.NewDefaultNoxonServerSettings().
+		WithWhitelist([]string{"*"}).
+		WithRecording(noxon.RecordingSettings{Enabled: true, Dir: filepath.Join(t.TempDir(), "recordings")})
+	assert.Empty(t, listRecordings(t, noxon.NewNoxonServer(settings)))
+}
+
+func TestRecordingRequests(t *testing.T) {
+
+	connections := atomic.Int32{}
+	upstream := newCounterUpstream(&connections)
+	defer upstream.Close()
+	server, dir := newRecordingServer(t, upstream.URL)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, ".hidden"), []byte("secret"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(dir), "outside"), []byte("secret"), 0644))
+
+	for _, test := range []struct {
+		name   string
+		method string
+		target string
+		status int
+	}{
+		{"unknown station", http.MethodPost, "/api/recordings?stationId=unknown", http.StatusNotFound},
+		{"dir", http.MethodPost, "/api/recordings?stationId=dir", http.StatusBadRequest},
+		{"no station", http.MethodPost, "/api/recordings", http.StatusBadRequest},
+		{"invalid duration", http.MethodPost, "/api/recordings?stationId=station&minutes=0", http.StatusBadRequest},
+		{"unknown recording", http.MethodGet, "/api/recordings/20240131-200000_Unknown.mp3", http.StatusNotFound},
+		{"hidden file", http.MethodGet, "/api/recordings/.hidden", http.StatusBadRequest},
+		{"parent dir", http.MethodGet, "/api/recordings/..", http.StatusBadRequest},
+		{"outside the dir", http.MethodGet, "/api/recordings/..%2Foutside", http.StatusNotFound}, // not routed at all
+		{"stop unknown recording", http.MethodPost, "/api/recordings/unknown/stop", http.StatusNotFound},
+		{"delete unknown recording", http.MethodDelete, "/api/recordings/unknown", http.StatusNotFound},
+		{"delete hidden file", http.MethodDelete, "/api/recordings/.hidden", http.StatusBadRequest},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.status, requestRecordings(server, test.method, test.target).Code)
+		})
+	}
+	assert.Empty(t, listRecordings(t, server))
+	assert.Equal(t, int32(0), connections.Load())
+}
+
+func TestRecordingOfUnreachableStation(t *testing.T) {
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+	server, _ := newRecordingServer(t, upstream.URL)
+
+	assert.Equal(t, http.StatusBadGateway, requestRecordings(server, http.MethodPost, "/api/recordings?stationId=station").Code)
+	assert.Empty(t, listRecordings(t, server))
+}
@@ -0,0 +1,109 @@
+package noxon
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+const taggedStations = `[
+	{"id": "news", "dirName": "News", "children": [
+		{"id": "dlf", "stationName": "Deutschlandfunk", "stationUrl": "https://example.com/dlf.mp3", "tags": ["news"], "language": "german", "country": "Germany"},
+		{"id": "bbc", "stationName": "BBC World Service", "stationUrl": "https://example.com/bbc.mp3", "tags": ["News", "english"], "language": "english"}
+	]},
+	{"id": "fip", "stationName": "FIP", "stationUrl": "https://example.com/fip.mp3", "tags": ["jazz"]}
+]`
+
+func TestSmartFoldersStationsModel(t *testing.T) {
+
+	playbacks := noxon.NewMemPlaybackManager(time.Hour, 10)
+	model := noxon.NewSmartFoldersStationsModel(noxon.NewJsonModelFromJson([]byte(taggedStations)), playbacks)
+
+	// The virtual dirs follow the root items
+	assert.Equal(t, 5, model.Count(nil))
+	byTag, byTagId := model.Data(nil, 2)
+	assert.Equal(t, noxon.ItemDir{Title: "By tag"}, byTag)
+	assert.Equal(t, "smart:tag", byTagId)
+	_, byLanguageId := model.Data(nil, 3)
+	assert.Equal(t, "smart:language", byLanguageId)
+	_, byCountryId := model.Data(nil, 4)
+	assert.Equal(t, "smart:country", byCountryId)
+
+	// Sorted by title, tags that only differ in case are merged
+	assert.Equal(t, 3, model.Count(&byTagId))
+	english, _ := model.Data(&byTagId, 0)
+	assert.Equal(t, noxon.ItemDir{Title: "English (1)"}, english)
+	news, newsId := model.Data(&byTagId, 2)
+	assert.Equal(t, noxon.ItemDir{Title: "News (2)"}, news)
+	assert.Equal(t, "smart:tag:news", newsId)
+	same, _ := model.Data(&newsId, -1)
+	assert.Equal(t, news, same)
+
+	// The stations keep their ids
+	assert.Equal(t, 2, model.Count(&newsId))
+	station, stationId := model.Data(&newsId, 1)
+	assert.Equal(t, "BBC World Service", station.(noxon.ItemStation).StationName)
+	assert.Equal(t, "bbc", stationId)
+
+	// The stations the device played - the latest first
+	device := model.ForDevice("00:11:22:33:44:55")
+	other := model.ForDevice("66:77:88:99:aa:bb")
+	playbacks.StartPlayback("00:11:22:33:44:55", noxon.Playback{StationId: "fip", StartTime: time.Now()})
+	playbacks.StartPlayback("00:11:22:33:44:55", noxon.Playback{StationId: "dlf", StartTime: time.Now()})
+	assert.Equal(t, 7, device.Count(nil))
+	assert.Equal(t, 5, other.Count(nil))
+	recent, recentId := device.Data(nil, 5)
+	assert.Equal(t, noxon.ItemDir{Title: "Recently played"}, recent)
+	assert.Equal(t, 2, device.Count(&recentId))
+	_, stationId = device.Data(&recentId, 0)
+	assert.Equal(t, "dlf", stationId)
+	_, stationId = device.Data(&recentId, 1)
+	assert.Equal(t, "fip", stationId)
+}
+
+func TestSmartFoldersStationsModelMostPlayed(t *testing.T) {
+
+	history := noxon.NewJsonPlaybackHistory(filepath.Join(t.TempDir(), "history.json"), 10)
+	start := time.Now().Add(-time.Hour)
+	history.Add(noxon.HistoryEntry{Mac: "mac", StationId: "fip", StartTime: start, Duration: 30 * time.Minute})
+	history.Add(noxon.HistoryEntry{Mac: "mac", StationId: "dlf", StartTime: start.Add(30 * time.Minute), Duration: 10 * time.Minute})
+	history.Add(noxon.HistoryEntry{Mac: "mac", StationId: "removed", StartTime: start.Add(40 * time.Minute), Duration: time.Hour})
+	history.Add(noxon.HistoryEntry{Mac: "mac", StationId: "dlf", StartTime: start.Add(50 * time.Minute), Duration: 5 * time.Minute})
+	playbacks := noxon.NewMemPlaybackManagerWithHistory(time.Hour, 10, history)
+	model := noxon.NewSmartFoldersStationsModel(noxon.NewJsonModelFromJson([]byte(taggedStations)), playbacks)
+	device := model.ForDevice("mac")
+
+	// Stations that no longer exist are skipped
+	assert.Equal(t, 7, device.Count(nil))
+	recent, recentId := device.Data(nil, 5)
+	assert.Equal(t, noxon.ItemDir{Title: "Recently played"}, recent)
+	_, stationId := device.Data(&recentId, 0)
+	assert.Equal(t, "dlf", stationId)
+
+	// By the time the device listened to the station
+	mostPlayed, mostPlayedId := device.Data(nil, 6)
+	assert.Equal(t, noxon.ItemDir{Title: "Most played"}, mostPlayed)
+	assert.Equal(t, "smart:most", mostPlayedId)
+	assert.Equal(t, 2, device.Count(&mostPlayedId))
+	station, stationId := device.Data(&mostPlayedId, 0)
+	assert.Equal(t, "FIP", station.(noxon.ItemStation).StationName)
+	assert.Equal(t, "fip", stationId)
+	_, stationId = device.Data(&mostPlayedId, 1)
+	assert.Equal(t, "dlf", stationId)
+}
+
+func TestSmartFoldersStationsModelDeviceViewIsStable(t *testing.T) {
+
+	playbacks := noxon.NewMemPlaybackManager(time.Hour, 10)
+	model := noxon.NewSmartFoldersStationsModel(noxon.NewJsonModelFromJson([]byte(taggedStations)), playbacks)
+
+	// The virtual dirs of a view (a request) are computed once - a new view shows the changes
+	device := model.ForDevice("mac")
+	assert.Equal(t, 5, device.Count(nil))
+	playbacks.StartPlayback("mac", noxon.Playback{StationId: "fip", StartTime: time.Now()})
+	assert.Equal(t, 5, device.Count(nil))
+	assert.Equal(t, 6, model.ForDevice("mac").Count(nil))
+}
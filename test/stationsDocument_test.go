@@ -0,0 +1,77 @@
+package noxon
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+
+	dir := t.TempDir()
+	for name, content := range files {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	return dir
+}
+
+func TestImportYamlWithIncludesAndTemplates(t *testing.T) {
+
+	dir := writeFiles(t, map[string]string{
+		"stations.yaml": `
+# Broadcaster families
+templates:
+  rbb: https://dispatcher.rndfnk.com/{org}/{station}/live/mp3/high
+stations:
+  - stationName: Radio Eins
+    template: rbb
+    params: {org: rbb, station: radioeins}
+  - dirName: Anna
+    include: family/anna.toml
+  - include: family/shared.yaml
+`,
+		"family/anna.toml": `
+[[stations]]
+stationName = "Fritz"
+template = "rbb"
+params = { org = "rbb", station = "fritz" }
+`,
+		"family/shared.yaml": `
+- stationName: Shared
+  stationUrl: https://example.com/shared.mp3
+`,
+	})
+
+	data, files, err := noxon.ImportStationsFile(filepath.Join(dir, "stations.yaml"), "")
+	assert.NoError(t, err)
+	assert.Len(t, files, 3)
+	entries := []*noxon.Entry{}
+	assert.NoError(t, json.Unmarshal(data, &entries))
+	assert.Len(t, entries, 3)
+	assert.Equal(t, "https://dispatcher.rndfnk.com/rbb/radioeins/live/mp3/high", entries[0].StationUrl)
+	assert.Equal(t, "Anna", entries[1].DirName)
+	assert.Equal(t, "https://dispatcher.rndfnk.com/rbb/fritz/live/mp3/high", entries[1].Children[0].StationUrl)
+	assert.Equal(t, "Shared", entries[2].StationName)
+}
+
+func TestImportYamlErrors(t *testing.T) {
+
+	dir := writeFiles(t, map[string]string{
+		"a.yaml":        "stations:\n  - include: b.yaml\n",
+		"b.yaml":        "stations:\n  - dirName: Loop\n    include: a.yaml\n",
+		"template.yaml": "stations:\n  - stationName: Missing\n    template: unknown\n",
+		"params.yaml":   "templates:\n  t: https://example.com/{station}\nstations:\n  - stationName: Missing\n    template: t\n",
+	})
+
+	_, _, err := noxon.ImportStationsFile(filepath.Join(dir, "a.yaml"), "")
+	assert.ErrorContains(t, err, "include cycle")
+	_, _, err = noxon.ImportStationsFile(filepath.Join(dir, "template.yaml"), "")
+	assert.ErrorContains(t, err, "unknown template 'unknown'")
+	_, _, err = noxon.ImportStationsFile(filepath.Join(dir, "params.yaml"), "")
+	assert.ErrorContains(t, err, "missing params station")
+}
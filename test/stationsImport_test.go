@@ -0,0 +1,108 @@
+package noxon
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+func importEntries(t *testing.T, format string, data string) []*noxon.Entry {
+
+	converted, err := noxon.ImportStations(format, []byte(data))
+	assert.NoError(t, err)
+	entries := []*noxon.Entry{}
+	assert.NoError(t, json.Unmarshal(converted, &entries))
+	return entries
+}
+
+func TestImportM3U(t *testing.T) {
+
+	entries := importEntries(t, noxon.StationsFormatM3U, `#EXTM3U
+#EXTINF:-1 tvg-logo="logo.png" group-title="News",DLF, the news
+https://example.com/dlf.mp3
+#EXTINF:-1 group-title="Music/Jazz",Jazz Radio
+https://example.com/jazz.mp3
+#EXTINF:-1,Ungrouped
+https://example.com/other.mp3
+#EXTINF:-1 group-title="News",NDR
+https://example.com/ndr.mp3
+`)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, "News", entries[0].DirName)
+	assert.Equal(t, "DLF, the news", entries[0].Children[0].StationName)
+	assert.Equal(t, "NDR", entries[0].Children[1].StationName)
+	assert.Equal(t, "Music", entries[1].DirName)
+	assert.Equal(t, "Jazz", entries[1].Children[0].DirName)
+	assert.Equal(t, "https://example.com/jazz.mp3", entries[1].Children[0].Children[0].StationUrl)
+	assert.Equal(t, "Ungrouped", entries[2].StationName)
+}
+
+func TestImportM3USkipsInvalidUrls(t *testing.T) {
+
+	entries := importEntries(t, noxon.StationsFormatM3U, `#EXTM3U
+#EXTINF:-1,Local
+/music/radio.mp3
+#EXTINF:-1,Mms
+mms://example.com/stream
+#EXTINF:-1,DLF
+https://example.com/dlf.mp3
+`)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "DLF", entries[0].StationName)
+}
+
+func TestImportPLS(t *testing.T) {
+
+	entries := importEntries(t, noxon.StationsFormatPLS, "[playlist]\nFile1=https://example.com/one.mp3\nTitle1=One\nFile2=https://example.com/two.mp3\nNumberOfEntries=2\n")
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "One", entries[0].StationName)
+	assert.Equal(t, "https://example.com/two.mp3", entries[1].StationName)
+}
+
+func TestImportOPML(t *testing.T) {
+
+	entries := importEntries(t, noxon.StationsFormatOPML, `<?xml version="1.0" encoding="UTF-8"?>
+<opml version="1.0">
+	<body>
+		<outline text="Local Radio">
+			<outline text="Rock">
+				<outline type="audio" text="Rock Radio" subtext="Only rock" URL="https://example.com/rock.mp3"/>
+			</outline>
+		</outline>
+		<outline type="audio" text="Top Radio" URL="https://example.com/top.mp3"/>
+	</body>
+</opml>`)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "Local Radio", entries[0].DirName)
+	station := entries[0].Children[0].Children[0]
+	assert.Equal(t, "Rock Radio", station.StationName)
+	assert.Equal(t, "Only rock", station.StationDescription)
+	assert.Equal(t, "Top Radio", entries[1].StationName)
+}
+
+func TestImportCSV(t *testing.T) {
+
+	entries := importEntries(t, noxon.StationsFormatCSV, "Name;URL;Folder;Description\nDLF;https://example.com/dlf.mp3;News/Germany;The news\nJazz;https://example.com/jazz.mp3;;\n")
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "Germany", entries[0].Children[0].DirName)
+	assert.Equal(t, "The news", entries[0].Children[0].Children[0].StationDescription)
+	assert.Equal(t, "Jazz", entries[1].StationName)
+
+	_, err := noxon.ImportStations(noxon.StationsFormatCSV, []byte("name,link\nDLF,https://example.com"))
+	assert.Error(t, err)
+}
+
+func TestJsonModelFromM3U(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "stations.m3u")
+	assert.NoError(t, os.WriteFile(file, []byte("#EXTINF:-1 group-title=\"News\",DLF\nhttps://example.com/dlf.mp3\n"), 0644))
+	model := noxon.NewJsonModelFromFile(file, 0)
+	dir, dirId := model.Data(nil, 0)
+	assert.Equal(t, noxon.ItemDir{Title: "News"}, dir)
+	station, _ := model.Data(&dirId, 0)
+	assert.Equal(t, "DLF", station.(noxon.ItemStation).StationName)
+}
@@ -0,0 +1,115 @@
+package noxon
+
+import (
+	b64 "encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+const searchStations = `[
+	{"id": "news", "dirName": "Nachrichten", "children": [
+		{"id": "dlf", "stationName": "Deutschlandfunk", "stationDescription": "Informationen", "stationUrl": "https://example.com/dlf.mp3"},
+		{"id": "br24", "stationName": "BR24", "stationDescription": "Nachrichten aus Bayern", "stationUrl": "https://example.com/br24.mp3"}
+	]},
+	{"id": "music", "dirName": "Musique", "children": [
+		{"id": "fip", "stationName": "FIP", "stationDescription": "Éclectique", "stationUrl": "https://example.com/fip.mp3"},
+		{"id": "cafe", "stationName": "Café del Mar", "stationUrl": "https://example.com/cafe.mp3"}
+	]}
+]`
+
+func TestJsonModelSearch(t *testing.T) {
+
+	model := noxon.NewJsonModelFromJson([]byte(searchStations))
+
+	// Case and accent insensitive
+	assert.Equal(t, []string{"cafe"}, model.Search("CAFE"))
+	assert.Equal(t, []string{"fip"}, model.Search("eclectique"))
+	// The names of the dirs match their stations
+	assert.Equal(t, []string{"dlf", "br24"}, model.Search("nachrichten"))
+	// Every word has to match
+	assert.Equal(t, []string{"br24"}, model.Search("nachrichten bayern"))
+	assert.Equal(t, []string{"fip", "cafe"}, model.Search("musique"))
+	assert.Empty(t, model.Search("jazz"))
+	assert.Empty(t, model.Search(" "))
+}
+
+func TestCompositeStationsModelSearch(t *testing.T) {
+
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "Jazz"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "Jazz", "Café.mp3"), []byte{}, 0644))
+
+	model := noxon.NewCompositeStationsModel(
+		noxon.Mount{Model: noxon.NewJsonModelFromJson([]byte(searchStations))},
+		noxon.Mount{Id: "music", Name: "My music", Model: noxon.NewLocalMediaStationsModel("Music", dir)},
+	)
+
+	// The ids are namespaced like the ids of the items
+	ids := model.Search("cafe")
+	assert.Equal(t, []string{"cafe", "music/media:Music:Jazz/Café.mp3"}, ids)
+	file, fileId := model.Data(&ids[1], -1)
+	assert.Equal(t, ids[1], fileId)
+	assert.Equal(t, "Café", file.(noxon.ItemStation).StationName)
+	assert.Equal(t, []string{"music/media:Music:Jazz/Café.mp3"}, model.Search("jazz"))
+	// The name of the model doesn't match everything in it
+	assert.Empty(t, model.Search("music"))
+}
+
+func TestRadioBrowserStationsModelSearch(t *testing.T) {
+
+	model := noxon.NewRadioBrowserStationsModel("Radio Browser", "radio-browser.json", "", 0)
+
+	// The most voted first - broken stations are skipped
+	assert.Equal(t, []string{"rb:s:00000000-0000-0000-0000-000000000002", "rb:s:00000000-0000-0000-0000-000000000001"}, model.Search("JAZZ"))
+	assert.Equal(t, []string{"rb:s:00000000-0000-0000-0000-000000000002"}, model.Search("jazz english"))
+	assert.Empty(t, model.Search("radio browser"))
+}
+
+func TestPodcastStationsModelSearch(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "podcast.rss")
+	}))
+	defer server.Close()
+	model := noxon.NewPodcastStationsModel([]string{server.URL + "/podcast.rss"}, 0)
+	model.Refresh()
+
+	second := model.Search("second")
+	assert.Len(t, second, 1)
+	episode, _ := model.Data(&second[0], -1)
+	assert.Equal(t, "Episode 2", episode.(noxon.ItemStation).StationName)
+	// The title of the feed matches its episodes - the latest first
+	assert.Len(t, model.Search("test podcast"), 2)
+	assert.Equal(t, second, model.ForDevice("mac").(noxon.Searcher).Search("second"))
+	assert.Empty(t, model.Search("jazz"))
+}
+
+func TestSearchEndpoint(t *testing.T) {
+
+	_, settings := newTestServer(searchStations)
+	server := noxon.NewNoxonServer(settings.WithSearchEndpoints([]string{"/search"}))
+	search := func(query string) string {
+		recorder := httptest.NewRecorder()
+		target := "/search?mac=mac&Search=" + url.QueryEscape(query)
+		server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		return recorder.Body.String()
+	}
+
+	// The StationId of an item is the station
+	body := search(b64.URLEncoding.EncodeToString([]byte("fip")))
+	assert.Contains(t, body, "<StationName>FIP</StationName>")
+	assert.NotContains(t, body, "Deutschlandfunk")
+	// Words are searched as entered - even if they are valid base64
+	assert.Contains(t, search("news"), "No stations found")
+	assert.Contains(t, search("cafe"), "<StationName>Café del Mar</StationName>")
+	// Only the exact encoding counts as an id ("Y2FmZR==" decodes to "cafe" too)
+	assert.Contains(t, search("Y2FmZR=="), "No stations found")
+}
@@ -0,0 +1,86 @@
+package noxon
+
+import (
+	"testing"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateStationsSyntax(t *testing.T) {
+
+	errs := noxon.ValidateStations([]byte("[\n  {\"stationName\": \"A\", \"stationUrl\": \"https://example.com\"},\n]"))
+	assert.Len(t, errs, 1)
+	assert.Equal(t, 3, errs[0].Line)
+	assert.Equal(t, 1, errs[0].Column)
+	assert.False(t, errs[0].Warning)
+}
+
+func TestValidateStationsEntries(t *testing.T) {
+
+	errs := noxon.ValidateStations([]byte(`[
+  {"stationName": "Ftp", "stationUrl": "ftp://example.com/stream"},
+  {"dirName": "Both", "stationName": "Both"},
+  {"dirName": "Dir", "children": [
+    {"id": "same", "stationName": "Twice", "stationUrl": "https://example.com/1"},
+    {"id": "same", "stationName": "Twice", "stationUrl": "https://example.com/2"},
+    {"stationDescription": "Neither"}
+  ]},
+  {"stationName": "A name that is much too long for the display of the radio", "stationUrl": "https://example.com"}
+]`))
+
+	type problem struct {
+		Line    int
+		Warning bool
+	}
+	problems := []problem{}
+	for _, err := range errs {
+		problems = append(problems, problem{err.Line, err.Warning})
+	}
+	assert.Equal(t, []problem{
+		{2, false}, // invalid url
+		{3, false}, // both
+		{6, true},  // duplicate name
+		{6, false}, // duplicate id
+		{7, false}, // neither
+		{9, true},  // too long
+	}, problems)
+	assert.Equal(t, "Dir / Twice", errs[3].Path)
+	assert.Len(t, errs.Errors(), 4)
+}
+
+func TestJsonModelSkipsInvalidEntries(t *testing.T) {
+
+	model := noxon.NewJsonModelFromJson([]byte(`[
+  {"stationName": "File", "stationUrl": "file:///music/radio.mp3"},
+  {"stationName": "Mms", "stationUrl": "mms://example.com/stream"},
+  {"stationName": "Relative", "stationUrl": "stream.mp3"},
+  {"stationName": "Transcode", "stationUrl": "https://example.com/t", "transcode": "sometimes"},
+  {"stationName": "Tags", "stationUrl": "https://example.com/tags", "tags": "jazz"},
+  {"dirName": "Dir", "children": [
+    {"id": "same", "stationName": "First", "stationUrl": "https://example.com/1"},
+    {"id": "same", "stationName": "Second", "stationUrl": "https://example.com/2"},
+    {"stationName": "Mirrors", "stationUrl": "https://example.com/3", "alternativeUrls": [
+      {"url": "mms://example.com/3"}, {"url": "https://mirror.example.com/3"}
+    ]}
+  ]},
+  {"stationName": "Valid", "stationUrl": "https://example.com/valid"}
+]`))
+	assert.Equal(t, 2, model.Count(nil))
+	dir, dirId := model.Data(nil, 0)
+	assert.Equal(t, noxon.ItemDir{Title: "Dir"}, dir)
+	assert.Equal(t, 2, model.Count(&dirId))
+	first, _ := model.Data(&dirId, 0)
+	assert.Equal(t, "First", first.(noxon.ItemStation).StationName)
+	mirrors, _ := model.Data(&dirId, 1)
+	assert.Equal(t, "Mirrors", mirrors.(noxon.ItemStation).StationName)
+	assert.Equal(t, []string{"https://mirror.example.com/3"}, mirrors.(noxon.ItemStation).AlternativeUrls)
+	valid, _ := model.Data(nil, 1)
+	assert.Equal(t, "Valid", valid.(noxon.ItemStation).StationName)
+
+	// Files with syntax errors are not loaded
+	model = noxon.NewJsonModelFromJson([]byte(`[{"stationName": "Valid", "stationUrl": "https://example.com/valid"},]`))
+	assert.Equal(t, 0, model.Count(nil))
+	model = noxon.NewJsonModelFromJson([]byte(`{"stationName": "Valid", "stationUrl": "https://example.com/valid"}`))
+	assert.Equal(t, 0, model.Count(nil))
+}
@@ -0,0 +1,354 @@
+package noxon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	b64 "encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+// A live stream of numbered lines (one every 5ms). Counts the open connections
+func newCounterUpstream(connections *atomic.Int32) *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connections.Add(1)
+		defer connections.Add(-1)
+		w.Header().Set("Content-Type", "audio/mpeg")
+		if r.Method == http.MethodHead {
+			return
+		}
+		for counter := 0; ; counter++ {
+			if _, err := fmt.Fprintf(w, "%08d\n", counter); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}))
+}
+
+// A device playing a station of the server
+type testListener struct {
+	response *http.Response
+	scanner  *bufio.Scanner
+	first    bool
+	cancel   context.CancelFunc
+}
+
+func listen(t *testing.T, server *httptest.Server, mac string, stationId string, header http.Header) *testListener {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	target := fmt.Sprintf("%s/playback?mac=%s&stationId=%s", server.URL, mac, b64.URLEncoding.EncodeToString([]byte(stationId)))
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	response, err := http.DefaultClient.Do(request)
+	if !assert.NoError(t, err) {
+		cancel()
+		t.FailNow()
+	}
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	return &testListener{response: response, scanner: bufio.NewScanner(response.Body), first: true, cancel: cancel}
+}
+
+// The numbers of the next count lines of the stream (less if the stream ended)
+func (l *testListener) counters(count int) []int {
+
+	counters := []int{}
+	for len(counters) < count && l.scanner.Scan() {
+		// The device might join in the middle of a line
+		if counter, err := strconv.Atoi(l.scanner.Text()); err == nil && (!l.first || len(l.scanner.Text()) == 8) {
+			counters = append(counters, counter)
+		}
+		l.first = false
+	}
+	return counters
+}
+
+func (l *testListener) close() {
+
+	l.cancel()
+	l.response.Body.Close()
+}
+
+// Plays the station and returns the numbers of the lines of the stream until count lines were received
+func readCounters(t *testing.T, server *httptest.Server, mac string, stationId string, count int) []int {
+
+	listener := listen(t, server, mac, stationId, nil)
+	defer listener.close()
+	return listener.counters(count)
+}
+
+func assertContiguous(t *testing.T, counters []int) {
+
+	for i := 1; i < len(counters); i++ {
+		if !assert.Equal(t, counters[i-1]+1, counters[i], "gap in stream") {
+			return
+		}
+	}
+}
+
+func TestStreamHub(t *testing.T) {
+
+	connections := atomic.Int32{}
+	upstream := newCounterUpstream(&connections)
+	defer upstream.Close()
+	_, settings := newTestServer(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s"}]`, upstream.URL))
+	server := httptest.NewServer(noxon.NewNoxonServer(settings).Handler())
+	defer server.Close()
+
+	first := listen(t, server, "first", "station", nil)
+	live := first.counters(50)
+	assertContiguous(t, live)
+
+	// The second device shares the upstream and starts with the recent data of the ring
+	second := listen(t, server, "second", "station", nil)
+	caughtUp := second.counters(50)
+	assertContiguous(t, caughtUp)
+	assert.Less(t, caughtUp[0], live[len(live)-1])
+	assert.Eventually(t, func() bool { return connections.Load() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Len(t, settings.PlaybackManager.Playbacks(), 2)
+
+	// Both get the same data
+	live = first.counters(20)
+	assertContiguous(t, live)
+	for _, counter := range second.counters(200) {
+		if counter == live[len(live)-1] {
+			break
+		}
+		assert.Less(t, counter, live[len(live)-1])
+	}
+
+	// The upstream is kept open until the last device leaves
+	first.close()
+	assertContiguous(t, second.counters(20))
+	assert.Equal(t, int32(1), connections.Load())
+	second.close()
+	assert.Eventually(t, func() bool { return connections.Load() == 0 }, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return len(settings.PlaybackManager.Playbacks()) == 0 }, time.Second, 10*time.Millisecond)
+
+	// A new device opens the upstream again
+	assertContiguous(t, readCounters(t, server, "third", "station", 20))
+}
+
+func TestStreamHubDropsSlowListener(t *testing.T) {
+
+	// A fast upstream that fills up the buffers of a device not reading
+	chunk := make([]byte, 16*1024)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		if r.Method == http.MethodHead {
+			return
+		}
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}))
+	defer upstream.Close()
+	_, settings := newTestServer(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s"}]`, upstream.URL))
+	server := httptest.NewServer(noxon.NewNoxonServer(settings).Handler())
+	defer server.Close()
+
+	fast := listen(t, server, "fast", "station", nil)
+	defer fast.close()
+	fastDone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, fast.response.Body)
+		close(fastDone)
+	}()
+	slow := listen(t, server, "slow", "station", nil)
+	defer slow.close()
+
+	// The slow device gets dropped once its buffers are full for a while: its stream ends while the fast one keeps going
+	time.Sleep(7 * time.Second)
+	slowDone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, slow.response.Body)
+		close(slowDone)
+	}()
+	select {
+	case <-slowDone:
+	case <-fastDone:
+		assert.Fail(t, "the fast device was dropped")
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "the slow device was not dropped")
+	}
+	assert.Eventually(t, func() bool { return len(settings.PlaybackManager.Playbacks()) == 1 }, time.Second, 10*time.Millisecond)
+}
+
+// Waiting for a slow device is no stall of the upstream - the other devices get no silence meanwhile
+func TestStreamHubSlowListenerCausesNoSilence(t *testing.T) {
+
+	chunk := mp3Frames(0x11, 85)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		if r.Method == http.MethodHead {
+			return
+		}
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}))
+	defer upstream.Close()
+	_, settings := newTestServer(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s"}]`, upstream.URL))
+	settings = settings.WithReconnect(noxon.ReconnectSettings{Enabled: true, Silence: true})
+	server := httptest.NewServer(noxon.NewNoxonServer(settings).Handler())
+	defer server.Close()
+
+	fast := listen(t, server, "fast", "station", nil)
+	defer fast.close()
+	silence := atomic.Int32{}
+	go func() {
+		frame := make([]byte, 192)
+		for {
+			if _, err := io.ReadFull(fast.response.Body, frame); err != nil {
+				return
+			}
+			if frame[4] == 0 {
+				silence.Add(1)
+			}
+		}
+	}()
+	slow := listen(t, server, "slow", "station", nil)
+	defer slow.close()
+
+	// The slow device is dropped after a while
+	time.Sleep(7 * time.Second)
+	assert.Zero(t, silence.Load())
+}
+
+func TestStreamHubWaitsForListener(t *testing.T) {
+
+	// A file is served much faster than the device plays it
+	audio := make([]byte, 1000000)
+	for i := range audio {
+		audio[i] = byte(i % 251)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		for offset := 0; offset < len(audio); offset += 100 {
+			w.Write(audio[offset : offset+100])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer upstream.Close()
+	server, _ := newTestServer(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s"}]`, upstream.URL))
+
+	response := requestPlayback(server, "mac", "station")
+	assert.Equal(t, len(audio), response.Body.Len())
+	assert.True(t, bytes.Equal(audio, response.Body.Bytes()))
+}
+
+func TestStreamHubForwardsDeviceHeaders(t *testing.T) {
+
+	headers := make(chan http.Header, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Write([]byte("audio"))
+	}))
+	defer upstream.Close()
+	server, _ := newTestServer(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s"}]`, upstream.URL))
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/playback?mac=mac&stationId="+b64.URLEncoding.EncodeToString([]byte("station")), nil)
+	request.Header.Set("User-Agent", "Noxon iRadio")
+	request.Header.Set("Accept-Language", "de")
+	request.Header.Set("Range", "bytes=100-")
+	server.Handler().ServeHTTP(recorder, request)
+	assert.Equal(t, "audio", recorder.Body.String())
+
+	// The first request resolves the station
+	<-headers
+	header := <-headers
+	assert.Equal(t, "Noxon iRadio", header.Get("User-Agent"))
+	assert.Equal(t, "de", header.Get("Accept-Language"))
+	assert.Equal(t, "1", header.Get("Icy-MetaData"))
+	assert.Empty(t, header.Get("Range"))
+}
+
+func TestStreamHubTracksOnlyOpenedStreams(t *testing.T) {
+
+	// The primary goes down right after the station was resolved
+	primaryRequests := atomic.Int32{}
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if primaryRequests.Add(1) == 1 {
+			w.Header().Set("Content-Type", "audio/mpeg")
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	mirror := newAudioUpstream([]byte("audio"))
+	defer mirror.Close()
+	server, settings := newTestServer(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s", "alternativeUrls": [{"url": "%s"}]}]`, primary.URL, mirror.URL))
+
+	assert.Equal(t, "audio", requestPlayback(server, "mac", "station").Body.String())
+
+	// The failed attempt on the primary is no playback
+	history := settings.PlaybackManager.DeviceHistory("mac")
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, mirror.URL, history[0].StreamUrl)
+	}
+}
+
+func TestStreamHubStopsWhenDeviceDisconnects(t *testing.T) {
+
+	// A stalled upstream that doesn't send anything after the first bytes
+	connections := atomic.Int32{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connections.Add(1)
+		defer connections.Add(-1)
+		w.Header().Set("Content-Type", "audio/mpeg")
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write([]byte("audio"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+	_, settings := newTestServer(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s"}]`, upstream.URL))
+	server := httptest.NewServer(noxon.NewNoxonServer(settings).Handler())
+	defer server.Close()
+
+	listener := listen(t, server, "mac", "station", nil)
+	assert.Eventually(t, func() bool { return len(settings.PlaybackManager.Playbacks()) == 1 }, time.Second, 10*time.Millisecond)
+
+	// The playback and the upstream end right away - not only with the next write
+	listener.close()
+	assert.Eventually(t, func() bool { return len(settings.PlaybackManager.Playbacks()) == 0 }, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return connections.Load() == 0 }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,116 @@
+package noxon
+
+import (
+	"bufio"
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+func timeShiftStatus(t *testing.T, server *httptest.Server) []noxon.TimeShiftStatus {
+
+	statuses := []noxon.TimeShiftStatus{}
+	response, err := http.Get(server.URL + "/api/timeshift")
+	if assert.NoError(t, err) {
+		defer response.Body.Close()
+		assert.NoError(t, json.NewDecoder(response.Body).Decode(&statuses))
+	}
+	return statuses
+}
+
+func TestTimeShift(t *testing.T) {
+
+	for name, dir := range map[string]string{"memory": "", "disk": t.TempDir()} {
+		t.Run(name, func(t *testing.T) {
+
+			connections := atomic.Int32{}
+			upstream := newCounterUpstream(&connections)
+			defer upstream.Close()
+			window := 500 * time.Millisecond
+			_, settings := newTestServer(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s"}]`, upstream.URL))
+			server := httptest.NewServer(noxon.NewNoxonServer(settings.WithTimeShift(noxon.TimeShiftSettings{
+				Enabled:  true,
+				Duration: window,
+				Dir:      dir,
+			})).Handler())
+			defer server.Close()
+
+			// Live playback for longer than the window - older data is dropped
+			live := readCounters(t, server, "mac", "station", 150)
+			assert.Len(t, live, 150)
+			assertContiguous(t, live)
+			assert.Eventually(t, func() bool {
+				statuses := timeShiftStatus(t, server)
+				return len(statuses) == 1 && !statuses[0].Live
+			}, time.Second, 10*time.Millisecond)
+			statuses := timeShiftStatus(t, server)
+			assert.Equal(t, "station", statuses[0].StationId)
+			assert.LessOrEqual(t, statuses[0].Buffered, window+50*time.Millisecond)
+			// The upstream keeps being recorded for the paused device
+			assert.Equal(t, int32(1), connections.Load())
+
+			// The resumed playback continues where the device stopped (the preroll covers the whole buffer) without gaps
+			resumed := readCounters(t, server, "mac", "timeshift:station", 20)
+			assert.Len(t, resumed, 20)
+			assertContiguous(t, resumed)
+			assert.LessOrEqual(t, resumed[0], live[len(live)-1])
+			assert.Greater(t, resumed[0], live[0])
+
+			// The upstream is closed as soon as the position of the device fell out of the window
+			assert.Eventually(t, func() bool { return connections.Load() == 0 }, 2*window, 10*time.Millisecond)
+			assert.Empty(t, timeShiftStatus(t, server))
+
+			// Nothing to resume anymore
+			resume := requestPlayback(noxon.NewNoxonServer(settings), "mac", "timeshift:station")
+			assert.Equal(t, http.StatusNotFound, resume.Code)
+		})
+	}
+}
+
+func TestTimeShiftResumeStation(t *testing.T) {
+
+	connections := atomic.Int32{}
+	upstream := newCounterUpstream(&connections)
+	defer upstream.Close()
+	_, settings := newTestServer(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s"}]`, upstream.URL))
+	server := httptest.NewServer(noxon.NewNoxonServer(settings.WithSearchEndpoints([]string{"/search"}).WithTimeShift(noxon.TimeShiftSettings{
+		Enabled:  true,
+		Duration: time.Second,
+	})).Handler())
+	defer server.Close()
+
+	readCounters(t, server, "mac", "station", 10)
+	assert.Eventually(t, func() bool {
+		statuses := timeShiftStatus(t, server)
+		return len(statuses) == 1 && !statuses[0].Live
+	}, time.Second, 10*time.Millisecond)
+
+	// The paused station is offered first in the root menu - count and items agree
+	response, err := http.Get(server.URL + "/login?mac=mac")
+	if assert.NoError(t, err) {
+		defer response.Body.Close()
+		body := new(strings.Builder)
+		bufio.NewReader(response.Body).WriteTo(body)
+		assert.Contains(t, body.String(), "<ItemCount>2</ItemCount>")
+		assert.Contains(t, body.String(), "Resume Station")
+		assert.Contains(t, body.String(), b64.URLEncoding.EncodeToString([]byte("timeshift:station")))
+	}
+
+	// The stations can still be searched while the "Resume" station is offered
+	response, err = http.Get(server.URL + "/search?mac=mac&Search=station")
+	if assert.NoError(t, err) {
+		defer response.Body.Close()
+		body := new(strings.Builder)
+		bufio.NewReader(response.Body).WriteTo(body)
+		assert.Contains(t, body.String(), "<StationName>Station</StationName>")
+	}
+}
@@ -0,0 +1,140 @@
+package noxon
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// Passes the stream through but reports it as mp3 and counts the transcoded streams
+type countingTranscoder struct {
+	calls *atomic.Int32
+}
+
+func (t countingTranscoder) Transcode(source io.ReadCloser, contentType string) (io.ReadCloser, string, error) {
+
+	t.calls.Add(1)
+	return source, "audio/mpeg", nil
+}
+
+// Serves "audio" with the content type of the path (/audio/aac) - without a content type for /unknown
+func newContentTypeUpstream() *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentType := strings.TrimPrefix(r.URL.Path, "/"); contentType == "unknown" {
+			w.Header()["Content-Type"] = nil
+		} else {
+			w.Header().Set("Content-Type", contentType)
+		}
+		fmt.Fprint(w, "audio")
+	}))
+}
+
+func TestTranscoding(t *testing.T) {
+
+	upstream := newContentTypeUpstream()
+	defer upstream.Close()
+
+	for _, test := range []struct {
+		name        string
+		transcoding bool
+		path        string
+		transcode   string
+		transcoded  bool
+		contentType string
+	}{
+		{"mp3 is played as it is", true, "/audio/mpeg", "", false, "audio/mpeg"},
+		{"aac is transcoded", true, "/audio/aac", "", true, "audio/mpeg"},
+		{"an unknown content type is up to the device", true, "/unknown", "", false, "audio/mpeg"},
+		{"never transcoded", true, "/audio/aac", "never", false, "audio/aac"},
+		{"always transcoded", true, "/audio/mpeg", "always", true, "audio/mpeg"},
+		{"aac without transcoding", false, "/audio/aac", "", false, "audio/aac"},
+		{"always without transcoding", false, "/audio/aac", "always", false, "audio/aac"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			calls := atomic.Int32{}
+			settings := noxon.NewDefaultNoxonServerSettings().
+				WithWhitelist([]string{"*"}).
+				WithStationsModel(noxon.NewJsonModelFromJson([]byte(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s%s", "transcode": "%s"}]`, upstream.URL, test.path, test.transcode))))
+			if test.transcoding {
+				settings = settings.WithTranscoder(countingTranscoder{calls: &calls})
+			}
+			response := requestPlayback(noxon.NewNoxonServer(settings), "mac", "station")
+			assert.Equal(t, http.StatusOK, response.Code)
+			assert.Equal(t, "audio", response.Body.String())
+			assert.Equal(t, test.contentType, response.Header().Get("Content-Type"))
+			assert.Equal(t, test.transcoded, calls.Load() == 1)
+		})
+	}
+}
+
+// Stations with the same stream url but other transcoding options don't share the upstream
+func TestStreamHubSeparatesTranscodedStreams(t *testing.T) {
+
+	connections := atomic.Int32{}
+	upstream := newCounterUpstream(&connections)
+	defer upstream.Close()
+	calls := atomic.Int32{}
+	settings := noxon.NewDefaultNoxonServerSettings().
+		WithWhitelist([]string{"*"}).
+		WithTranscoder(countingTranscoder{calls: &calls}).
+		WithStationsModel(noxon.NewJsonModelFromJson([]byte(fmt.Sprintf(`[
+  {"id": "plain", "stationName": "Plain", "stationUrl": "%[1]s"},
+  {"id": "same", "stationName": "Same", "stationUrl": "%[1]s"},
+  {"id": "transcoded", "stationName": "Transcoded", "stationUrl": "%[1]s", "transcode": "always"}
+]`, upstream.URL))))
+	server := httptest.NewServer(noxon.NewNoxonServer(settings).Handler())
+	defer server.Close()
+
+	plain := listen(t, server, "first", "plain", nil)
+	defer plain.close()
+	assertContiguous(t, plain.counters(10))
+	same := listen(t, server, "second", "same", nil)
+	defer same.close()
+	assertContiguous(t, same.counters(10))
+	assert.Eventually(t, func() bool { return connections.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	transcoded := listen(t, server, "third", "transcoded", nil)
+	defer transcoded.close()
+	assertContiguous(t, transcoded.counters(10))
+	assert.Eventually(t, func() bool { return connections.Load() == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestFfmpegTranscoderLogsErrors(t *testing.T) {
+
+	// Fails like ffmpeg does with an unknown input format
+	ffmpeg := filepath.Join(t.TempDir(), "ffmpeg")
+	assert.NoError(t, os.WriteFile(ffmpeg, []byte("#!/bin/sh\necho 'first line' >&2\necho 'pipe:0: Invalid data found when processing input' >&2\nexit 1\n"), 0755))
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	transcoded, contentType, err := noxon.NewFfmpegTranscoder(ffmpeg, 128000).Transcode(io.NopCloser(strings.NewReader("audio")), "audio/aac")
+	assert.NoError(t, err)
+	assert.Equal(t, "audio/mpeg", contentType)
+	output, _ := io.ReadAll(transcoded)
+	assert.Empty(t, output)
+	transcoded.Close()
+
+	warnings := []string{}
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel {
+			warnings = append(warnings, entry.Message)
+		}
+	}
+	if assert.Len(t, warnings, 1) {
+		assert.Contains(t, warnings[0], "first line\npipe:0: Invalid data found when processing input")
+	}
+}
@@ -0,0 +1,123 @@
+package noxon
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Redirects /relative to "stream", /absolute and /scheme to the streamUrl, /hop<n> to /hop<n+1> and /ping to /pong
+// and back. /stream serves the audio
+func newRedirectingUpstream(streamUrl *string) *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/stream":
+			w.Header().Set("Content-Type", "audio/mpeg")
+			fmt.Fprint(w, "audio")
+		case r.URL.Path == "/relative":
+			w.Header().Set("Location", "stream")
+			w.WriteHeader(http.StatusFound)
+		case r.URL.Path == "/absolute":
+			http.Redirect(w, r, *streamUrl, http.StatusMovedPermanently)
+		case r.URL.Path == "/ping":
+			http.Redirect(w, r, "/pong", http.StatusFound)
+		case r.URL.Path == "/pong":
+			http.Redirect(w, r, "/ping", http.StatusFound)
+		case strings.HasPrefix(r.URL.Path, "/hop"):
+			hop, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hop"))
+			http.Redirect(w, r, fmt.Sprintf("/hop%d", hop+1), http.StatusTemporaryRedirect)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestUpstreamRedirects(t *testing.T) {
+
+	streamUrl := ""
+	upstream := newRedirectingUpstream(&streamUrl)
+	defer upstream.Close()
+	streamUrl = upstream.URL + "/stream"
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, streamUrl, http.StatusFound)
+	}))
+	defer secure.Close()
+
+	for _, test := range []struct {
+		name       string
+		stationUrl string
+		status     int
+	}{
+		{"relative location", upstream.URL + "/relative", http.StatusOK},
+		{"absolute location", upstream.URL + "/absolute", http.StatusOK},
+		{"from https to http", secure.URL, http.StatusOK},
+		{"too many redirects", upstream.URL + "/hop0", http.StatusBadGateway},
+		{"redirect loop", upstream.URL + "/ping", http.StatusBadGateway},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server, settings := newTestServer(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s", "tls": {"insecureSkipVerify": true}}]`, test.stationUrl))
+			response := requestPlayback(server, "mac", "station")
+			assert.Equal(t, test.status, response.Code)
+			if test.status == http.StatusOK {
+				assert.Equal(t, "audio", response.Body.String())
+				// The next playback starts at the new location
+				station, ok := settings.PlaybackManager.Station("mac", "station")
+				assert.True(t, ok)
+				assert.Equal(t, streamUrl, station.StreamUrl)
+			}
+		})
+	}
+}
+
+// The ServerName of a station is only sent to the host of the station url
+func TestUpstreamRedirectServerName(t *testing.T) {
+
+	mutex := sync.Mutex{}
+	serverNames := map[string][]string{}
+	newServer := func(name string, handler http.HandlerFunc) *httptest.Server {
+		server := httptest.NewUnstartedServer(handler)
+		server.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			serverNames[name] = append(serverNames[name], hello.ServerName)
+			return nil, nil
+		}}
+		server.StartTLS()
+		return server
+	}
+	target := newServer("target", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		fmt.Fprint(w, "audio")
+	})
+	defer target.Close()
+	origin := newServer("origin", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+"/stream", http.StatusFound)
+	})
+	defer origin.Close()
+
+	// the origin is requested by name, the target by ip - no SNI is sent for an ip
+	originUrl := strings.Replace(origin.URL, "127.0.0.1", "localhost", 1)
+	server, _ := newTestServer(fmt.Sprintf(`[{"id": "station", "stationName": "Station", "stationUrl": "%s", "tls": {"insecureSkipVerify": true, "serverName": "example.com"}}]`, originUrl))
+	response := requestPlayback(server, "mac", "station")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "audio", response.Body.String())
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.NotEmpty(t, serverNames["origin"])
+	for _, serverName := range serverNames["origin"] {
+		assert.Equal(t, "example.com", serverName)
+	}
+	assert.NotEmpty(t, serverNames["target"])
+	for _, serverName := range serverNames["target"] {
+		assert.Empty(t, serverName)
+	}
+}
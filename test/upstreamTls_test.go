@@ -0,0 +1,112 @@
+package noxon
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.privatehive.de/bjoern/noxon-server/pkg/noxon"
+	"github.com/stretchr/testify/assert"
+)
+
+func writePem(t *testing.T, name string, blockType string, data []byte) string {
+
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600))
+	return path
+}
+
+func getWithOptions(t *testing.T, options noxon.TlsOptions, url string) error {
+
+	config, err := options.TlsConfig()
+	assert.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	resp, err := client.Get(url)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+func TestTlsOptionsServerCertificate(t *testing.T) {
+
+	insecure := true
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	caFile := writePem(t, "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+
+	assert.Error(t, getWithOptions(t, noxon.TlsOptions{}, server.URL))
+	assert.NoError(t, getWithOptions(t, noxon.TlsOptions{InsecureSkipVerify: &insecure}, server.URL))
+	assert.NoError(t, getWithOptions(t, noxon.TlsOptions{CaFile: caFile}, server.URL))
+	// The test certificate is issued for example.com
+	assert.NoError(t, getWithOptions(t, noxon.TlsOptions{CaFile: caFile, ServerName: "example.com"}, server.URL))
+	assert.Error(t, getWithOptions(t, noxon.TlsOptions{CaFile: caFile, ServerName: "radio.invalid"}, server.URL))
+}
+
+func TestTlsOptionsClientCertificate(t *testing.T) {
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	privateKey, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	certFile := writePem(t, "client.pem", "CERTIFICATE", certificate)
+	keyFile := writePem(t, "client.key", "EC PRIVATE KEY", privateKey)
+	insecure := true
+
+	assert.Error(t, getWithOptions(t, noxon.TlsOptions{InsecureSkipVerify: &insecure}, server.URL))
+	assert.NoError(t, getWithOptions(t, noxon.TlsOptions{InsecureSkipVerify: &insecure, ClientCertFile: certFile, ClientKeyFile: keyFile}, server.URL))
+}
+
+func TestTlsOptionsInvalidFiles(t *testing.T) {
+
+	_, err := noxon.TlsOptions{CaFile: filepath.Join(t.TempDir(), "missing.pem")}.TlsConfig()
+	assert.Error(t, err)
+	_, err = noxon.TlsOptions{ClientCertFile: filepath.Join(t.TempDir(), "missing.pem")}.TlsConfig()
+	assert.Error(t, err)
+}
+
+func TestTlsOptionsOfStation(t *testing.T) {
+
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Write([]byte("audio"))
+	}))
+	defer upstream.Close()
+	insecure := true
+	settings := noxon.NewDefaultNoxonServerSettings().
+		WithWhitelist([]string{"*"}).
+		WithTls(noxon.TlsOptions{InsecureSkipVerify: &insecure}).
+		WithStationsModel(noxon.NewJsonModelFromJson([]byte(fmt.Sprintf(`[
+  {"id": "global", "stationName": "Global", "stationUrl": "%[1]s"},
+  {"id": "verified", "stationName": "Verified", "stationUrl": "%[1]s", "tls": {"insecureSkipVerify": false}}
+]`, upstream.URL))))
+	server := noxon.NewNoxonServer(settings)
+
+	// The station turns the verification on again
+	assert.Equal(t, "audio", requestPlayback(server, "mac", "global").Body.String())
+	assert.NotEqual(t, "audio", requestPlayback(server, "mac", "verified").Body.String())
+}